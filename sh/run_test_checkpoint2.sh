@@ -29,6 +29,8 @@ go test -run=TestOutOfOrderMsg2 -timeout=10s -race
 go test -run=TestOutOfOrderMsg3 -timeout=10s -race
 go test -run=TestExpBackOff1 -timeout=60s -race
 go test -run=TestExpBackOff2 -timeout=60s -race
+go test -run=TestExpBackOffVirtual1 -timeout=5s -race
+go test -run=TestExpBackOffVirtual2 -timeout=5s -race
 go test -run=TestMaxUnackedMessages1 -timeout=60s -race
 go test -run=TestMaxUnackedMessages2 -timeout=60s -race
 go test -run=TestMaxUnackedMessages3 -timeout=60s -race
@@ -43,6 +45,8 @@ go test -run=TestServerCloseConns1 -timeout=10s -race
 go test -run=TestServerCloseConns2 -timeout=10s -race
 go test -run=TestClientClose1 -timeout=20s -race
 go test -run=TestClientClose2 -timeout=20s -race
+go test -run=TestClientIsolated1 -timeout=10s -race
+go test -run=TestClientIsolated2 -timeout=10s -race
 go test -run=TestServerFastClose1 -timeout=20s -race
 go test -run=TestServerFastClose2 -timeout=20s
 go test -run=TestServerFastClose3 -timeout=20s
@@ -63,3 +67,14 @@ go test -run=TestCAckServer1 -timeout=20s -race
 go test -run=TestCAckServer2 -timeout=20s -race
 go test -run=TestCAckServer3 -timeout=20s -race
 go test -run=TestCAckServer4 -timeout=20s -race
+go test -run=TestAdversaryAckUnsent -timeout=10s -race
+go test -run=TestAdversaryBogusConnID -timeout=10s -race
+go test -run=TestAdversaryCAckBackwards -timeout=10s -race
+go test -run=TestAdversarySizeTooLarge -timeout=10s -race
+go test -run=TestAdversaryConnectFlood -timeout=10s -race
+go test -run=TestAdversaryDuplicateConnect -timeout=10s -race
+go test -run=TestAdversaryClientHostileServer -timeout=10s -race
+go test -run=FuzzStateful -timeout=20s -race
+go test -run=TestChaos1 -timeout=30s -race
+go test -run=TestChaos2 -timeout=30s -race
+go test -run=TestChaos3 -timeout=30s -race
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"math"
@@ -9,35 +11,42 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/cmu440/bitcoin"
 	"github.com/cmu440/lsp"
 )
 
+var jobID = flag.String("job", "", "ID for the request, so that running the client again with the same ID gets the same job's answer")
+
 var LOGF *log.Logger
 
 func main() {
 	// You may need a logger for debug purpose
 	const (
 		name = "clientLog.txt"
-		flag = os.O_RDWR | os.O_CREATE
+		mode = os.O_RDWR | os.O_CREATE
 		perm = os.FileMode(0666)
 	)
 
-	file, err := os.OpenFile(name, flag, perm)
+	flag.Parse()
+
+	file, err := os.OpenFile(name, mode, perm)
 	if err != nil {
 		return
 	}
 	defer file.Close()
 
-	const numArgs = 4
-	if len(os.Args) != numArgs {
-		fmt.Printf("Usage: ./%s <hostport> <message> <maxNonce>", os.Args[0])
+	LOGF = log.New(file, "", log.Lshortfile|log.Lmicroseconds)
+
+	const numArgs = 3
+	if flag.NArg() != numArgs {
+		fmt.Printf("Usage: ./%s [-job=id] <hostport> <message> <maxNonce>", os.Args[0])
 		return
 	}
-	hostport := os.Args[1]
-	message := os.Args[2]
-	maxNonce, err := strconv.ParseUint(os.Args[3], 10, 64)
+	hostport := flag.Arg(0)
+	message := flag.Arg(1)
+	maxNonce, err := strconv.ParseUint(flag.Arg(2), 10, 64)
 	if err != nil {
-		fmt.Printf("%s is not a number.\n", os.Args[3])
+		fmt.Printf("%s is not a number.\n", flag.Arg(2))
 		return
 	}
 	seed := rand.NewSource(time.Now().UnixNano())
@@ -51,11 +60,29 @@ func main() {
 
 	defer client.Close()
 
-	_ = message  // Keep compiler happy. Please remove!
-	_ = maxNonce // Keep compiler happy. Please remove!
-	// TODO: implement this!
-
-	printResult(0, 0)
+	request := bitcoin.NewRequest(message, 0, maxNonce)
+	request.Job = *jobID
+	payload, err := json.Marshal(request)
+	if err != nil {
+		fmt.Println("Failed to marshal request:", err)
+		return
+	}
+	if err := client.Write(payload); err != nil {
+		printDisconnected()
+		return
+	}
+	payload, err = client.Read()
+	if err != nil {
+		printDisconnected()
+		return
+	}
+	var result bitcoin.Message
+	if err := json.Unmarshal(payload, &result); err != nil || result.Type != bitcoin.Result {
+		LOGF.Printf("Bad reply from server: %s", payload)
+		printDisconnected()
+		return
+	}
+	printResult(result.Hash, result.Nonce)
 }
 
 // printResult prints the final result to stdout.
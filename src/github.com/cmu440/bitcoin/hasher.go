@@ -0,0 +1,70 @@
+package bitcoin
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"hash"
+	"math"
+	"strconv"
+)
+
+// A Hasher computes Hash for one message and many nonces without allocating.
+// The SHA-256 state after the message and its trailing space is computed once,
+// and restored before hashing each nonce, whose decimal digits are formatted
+// into a reusable buffer.
+type Hasher struct {
+	digest   hash.Hash
+	restore  encoding.BinaryUnmarshaler // digest, to restore midstate into.
+	midstate []byte                     // Marshaled state of digest after "msg ".
+	digits   []byte
+	sum      []byte
+}
+
+// NewHasher returns a Hasher for msg.
+func NewHasher(msg string) *Hasher {
+	digest := sha256.New()
+	digest.Write([]byte(msg + " "))
+	midstate, err := digest.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		panic(err) // sha256's digest always marshals.
+	}
+	return &Hasher{
+		digest:   digest,
+		restore:  digest.(encoding.BinaryUnmarshaler),
+		midstate: midstate,
+		digits:   make([]byte, 0, len("18446744073709551615")),
+		sum:      make([]byte, 0, sha256.Size),
+	}
+}
+
+// Hash returns Hash(msg, nonce).
+func (h *Hasher) Hash(nonce uint64) uint64 {
+	h.restore.UnmarshalBinary(h.midstate)
+	h.digits = strconv.AppendUint(h.digits[:0], nonce, 10)
+	h.digest.Write(h.digits)
+	h.sum = h.digest.Sum(h.sum[:0])
+	return binary.BigEndian.Uint64(h.sum)
+}
+
+// HashRange returns the minimum of Hash(msg, nonce) over the nonces
+// [lower, upper], and its nonce, with ties going to the lowest nonce. If lower
+// is greater than upper, it returns math.MaxUint64 and lower.
+func (h *Hasher) HashRange(lower, upper uint64) (minHash, nonce uint64) {
+	minHash, nonce = math.MaxUint64, lower
+	for n := lower; n <= upper; n++ {
+		if hash := h.Hash(n); hash < minHash {
+			minHash, nonce = hash, n
+		}
+		if n == math.MaxUint64 {
+			break
+		}
+	}
+	return minHash, nonce
+}
+
+// HashRange returns the minimum of Hash(msg, nonce) over the nonces
+// [lower, upper], and its nonce, with ties going to the lowest nonce.
+func HashRange(msg string, lower, upper uint64) (minHash, nonce uint64) {
+	return NewHasher(msg).HashRange(lower, upper)
+}
@@ -0,0 +1,99 @@
+package bitcoin
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+var hasherMessages = []string{"", "bradfitz", "a message with spaces", strings.Repeat("long ", 40)}
+
+func TestHasherMatchesHash(t *testing.T) {
+	nonces := []uint64{0, 1, 9, 10, 99, 100, 12345, 1 << 32, math.MaxUint64 - 1, math.MaxUint64}
+	for _, msg := range hasherMessages {
+		h := NewHasher(msg)
+		for _, nonce := range nonces {
+			if got, want := h.Hash(nonce), Hash(msg, nonce); got != want {
+				t.Errorf("Hasher(%q).Hash(%d) = %d, expected %d", msg, nonce, got, want)
+			}
+		}
+	}
+}
+
+func TestHashRangeMatchesHash(t *testing.T) {
+	ranges := [][2]uint64{{0, 0}, {0, 5000}, {995, 1005}, {math.MaxUint64 - 100, math.MaxUint64}}
+	for _, msg := range hasherMessages {
+		for _, r := range ranges {
+			want, wantNonce := uint64(math.MaxUint64), r[0]
+			for n := r[0]; ; n++ {
+				if hash := Hash(msg, n); hash < want {
+					want, wantNonce = hash, n
+				}
+				if n == r[1] {
+					break
+				}
+			}
+			if got, nonce := HashRange(msg, r[0], r[1]); got != want || nonce != wantNonce {
+				t.Errorf("HashRange(%q, %d, %d) = (%d, %d), expected (%d, %d)", msg, r[0], r[1], got, nonce, want, wantNonce)
+			}
+		}
+	}
+}
+
+func TestHasherDoesNotAllocate(t *testing.T) {
+	h := NewHasher("bradfitz")
+	if allocs := testing.AllocsPerRun(100, func() { h.HashRange(1000, 1100) }); allocs != 0 {
+		t.Errorf("HashRange made %v allocations, expected none", allocs)
+	}
+}
+
+func TestHashRangeAllocatesPerCall(t *testing.T) {
+	// Setting up the hasher may allocate, but hashing each nonce must not.
+	for _, msg := range hasherMessages {
+		one := testing.AllocsPerRun(100, func() { HashRange(msg, 1000, 1000) })
+		many := testing.AllocsPerRun(10, func() { HashRange(msg, 0, 10000) })
+		if many != one {
+			t.Errorf("HashRange(%q) made %v allocations for 10001 nonces and %v for one, expected the same",
+				msg, many, one)
+		}
+	}
+}
+
+// The benchmarks hash nonces of a 64-byte message, so that the midstate
+// saves a whole block.
+var benchMessage = strings.Repeat("x", 64)
+
+func BenchmarkHash(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Hash(benchMessage, uint64(i))
+	}
+}
+
+func BenchmarkHasher(b *testing.B) {
+	b.ReportAllocs()
+	h := NewHasher(benchMessage)
+	for i := 0; i < b.N; i++ {
+		h.Hash(uint64(i))
+	}
+}
+
+func BenchmarkHashRange(b *testing.B) {
+	b.ReportAllocs()
+	HashRange(benchMessage, 0, uint64(b.N)-1)
+}
+
+func BenchmarkHashShortMessage(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Hash("bradfitz", uint64(i))
+	}
+}
+
+func BenchmarkHasherShortMessage(b *testing.B) {
+	b.ReportAllocs()
+	h := NewHasher("bradfitz")
+	for i := 0; i < b.N; i++ {
+		h.Hash(uint64(i))
+	}
+}
@@ -10,16 +10,33 @@ const (
 	Join MsgType = iota
 	Request
 	Result
+	Cancel
+	Progress
 )
 
 // Message represents a message that can be sent between components in the bitcoin
 // mining distributed system. Messages must be marshalled into a byte slice before being
 // sent over the network.
+//
+// Job IDs let a client have many requests in progress on one connection, and
+// tell their results apart, which may come back in any order: the client
+// gives each request a Job, and its result carries the same Job. (A client
+// that sends one request at a time needn't give it a Job.) A client's job IDs
+// are its own, so clients needn't coordinate them. The server, in turn, gives
+// each of the requests it sends miners the ID of the job the nonces are from,
+// and miners set the same Job in their results and progress messages, and the
+// server in its cancel messages, for that request.
 type Message struct {
 	Type         MsgType
 	Data         string
 	Lower, Upper uint64
 	Hash, Nonce  uint64
+	MinerID      string  // In a join message, identifies the miner across connections.
+	Workers      int     // In a join message, how many goroutines the miner mines with.
+	Rate         float64 // In a join message, the miner's benchmarked nonces per second.
+	Processed    uint64  // In a progress message, how many nonces have been hashed.
+	Scanned      uint64  // In a progress message, how many nonces from Lower on have all been hashed.
+	Job          string  // Identifies the job a request, result, cancel or progress message is for.
 }
 
 // NewRequest creates a request message. Clients send request messages to the
@@ -34,7 +51,8 @@ func NewRequest(data string, lower, upper uint64) *Message {
 }
 
 // New result creates a result message. Miners send result messages to the server
-// and the server sends result messages to clients.
+// and the server sends result messages to clients. A miner sets Job, Data,
+// Lower and Upper in its result to those of the request it answers.
 func NewResult(hash, nonce uint64) *Message {
 	return &Message{
 		Type:  Result,
@@ -43,11 +61,54 @@ func NewResult(hash, nonce uint64) *Message {
 	}
 }
 
+// NewCancel creates a cancel message. The server sends cancel messages to miners
+// to tell them to stop working on the request with the same job, data, lower
+// and upper, because its client has gone away or another miner has already
+// answered it. A miner sends no result for a request it has been told to cancel.
+func NewCancel(data string, lower, upper uint64) *Message {
+	return &Message{
+		Type:  Cancel,
+		Data:  data,
+		Lower: lower,
+		Upper: upper,
+	}
+}
+
+// NewProgress creates a progress message. Miners send progress messages to the
+// server while mining a large request with the given data, lower and upper,
+// saying how many of its nonces they have hashed so far, how many from lower
+// on they have all hashed (so that the highest nonce scanned is
+// lower+scanned-1), and the minimum hash and its nonce among them.
+func NewProgress(data string, lower, upper, processed, scanned, hash, nonce uint64) *Message {
+	return &Message{
+		Type:      Progress,
+		Data:      data,
+		Lower:     lower,
+		Upper:     upper,
+		Processed: processed,
+		Scanned:   scanned,
+		Hash:      hash,
+		Nonce:     nonce,
+	}
+}
+
 // NewJoin creates a join message. Miners send join messages to the server.
 func NewJoin() *Message {
 	return &Message{Type: Join}
 }
 
+// NewJoinWithInfo creates a join message that says who the miner is, how many
+// goroutines it mines with, and how many nonces per second it hashed in a
+// benchmark at startup (or 0 if it doesn't know).
+func NewJoinWithInfo(minerID string, workers int, rate float64) *Message {
+	return &Message{
+		Type:    Join,
+		MinerID: minerID,
+		Workers: workers,
+		Rate:    rate,
+	}
+}
+
 func (m *Message) String() string {
 	var result string
 	switch m.Type {
@@ -55,8 +116,12 @@ func (m *Message) String() string {
 		result = fmt.Sprintf("[%s %s %d %d]", "Request", m.Data, m.Lower, m.Upper)
 	case Result:
 		result = fmt.Sprintf("[%s %d %d]", "Result", m.Hash, m.Nonce)
+	case Cancel:
+		result = fmt.Sprintf("[%s %s %d %d]", "Cancel", m.Data, m.Lower, m.Upper)
+	case Progress:
+		result = fmt.Sprintf("[%s %s %d %d %d %d %d %d]", "Progress", m.Data, m.Lower, m.Upper, m.Processed, m.Scanned, m.Hash, m.Nonce)
 	case Join:
-		result = fmt.Sprintf("[%s]", "Join")
+		result = fmt.Sprintf("[%s %s %d %.0f]", "Join", m.MinerID, m.Workers, m.Rate)
 	}
 	return result
 }
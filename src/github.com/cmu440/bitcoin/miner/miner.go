@@ -1,50 +1,330 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
 	"os"
+	"runtime"
+	"sync"
 	"time"
 
+	"github.com/cmu440/bitcoin"
 	"github.com/cmu440/lsp"
 )
 
+// cancelCheckInterval is how many nonces are hashed between checks for a
+// cancel, so that a miner stops within a few milliseconds of being told to.
+const cancelCheckInterval = 1 << 12
+
+const (
+	// progressInterval is how often a miner reports its progress on a
+	// request.
+	progressInterval = 500 * time.Millisecond
+
+	// benchmarkTime is how long a miner benchmarks its hash rate for when
+	// it starts.
+	benchmarkTime = 200 * time.Millisecond
+)
+
+var (
+	workers = flag.Int("workers", runtime.NumCPU(), "number of goroutines to mine with")
+	minerID = flag.String("id", defaultMinerID(), "ID that identifies this miner to the server across connections")
+)
+
+// defaultMinerID returns an ID made of the host name and the process ID.
+func defaultMinerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "miner"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
 // Attempt to connect miner as a client to the server.
 func joinWithServer(hostport string) (lsp.Client, error) {
 	// You will need this for randomized isn
 	seed := rand.NewSource(time.Now().UnixNano())
 	isn := rand.New(seed).Intn(int(math.Pow(2, 8)))
 
-	// TODO: implement this!
+	miner, err := lsp.NewClient(hostport, isn, lsp.NewParams())
+	if err != nil {
+		return nil, err
+	}
+	join := bitcoin.NewJoinWithInfo(*minerID, *workers, benchmark(*workers))
+	if err := write(miner, join); err != nil {
+		miner.Close()
+		return nil, err
+	}
+	return miner, nil
+}
+
+func write(miner lsp.Client, msg *bitcoin.Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return miner.Write(payload)
+}
+
+// A tracker records the progress of mining a request across its workers.
+type tracker struct {
+	mu          sync.Mutex
+	lower       uint64
+	processed   uint64            // Number of nonces hashed.
+	scanned     uint64            // Number of nonces from lower on all hashed.
+	ahead       map[uint64]uint64 // Sizes of batches hashed beyond those, by first nonce.
+	hash, nonce uint64            // Best result among them.
+}
+
+func newTracker(lower uint64) *tracker {
+	return &tracker{lower: lower, ahead: make(map[uint64]uint64), hash: math.MaxUint64, nonce: lower}
+}
+
+// record adds the result of hashing the nonces [lower, upper].
+func (t *tracker) record(lower, upper, hash, nonce uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.processed += upper - lower + 1
+	t.ahead[lower] = upper - lower + 1
+	for size, ok := t.ahead[t.lower+t.scanned]; ok; size, ok = t.ahead[t.lower+t.scanned] {
+		delete(t.ahead, t.lower+t.scanned)
+		t.scanned += size
+	}
+	if better(hash, nonce, t.hash, t.nonce) {
+		t.hash, t.nonce = hash, nonce
+	}
+}
+
+func (t *tracker) snapshot() (processed, scanned, hash, nonce uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.processed, t.scanned, t.hash, t.nonce
+}
+
+// mine returns the minimum hash over the nonces of a request, and its nonce,
+// with ties going to the lowest nonce. The given number of goroutines take
+// batches of cancelCheckInterval nonces in order, so that the nonces hashed
+// so far are all near the start of the range, and record their progress in t
+// after each. They give up, and mine returns false, if cancel is closed first.
+func mine(req *bitcoin.Message, workers int, cancel <-chan struct{}, t *tracker) (hash, nonce uint64, ok bool) {
+	if workers < 1 {
+		workers = 1
+	}
+	var mu sync.Mutex
+	next, finished, cancelled := req.Lower, req.Lower > req.Upper, false
+	// claim returns the next batch to hash, or false if there are none left.
+	claim := func() (lower, upper uint64, ok bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		select {
+		case <-cancel:
+			cancelled, finished = true, true
+		default:
+		}
+		if finished {
+			return 0, 0, false
+		}
+		lower, upper = next, req.Upper
+		if req.Upper-next >= cancelCheckInterval {
+			upper = next + cancelCheckInterval - 1
+		}
+		next, finished = upper+1, upper == req.Upper
+		return lower, upper, true
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hasher := bitcoin.NewHasher(req.Data)
+			for {
+				lower, upper, ok := claim()
+				if !ok {
+					return
+				}
+				hash, nonce := hasher.HashRange(lower, upper)
+				t.record(lower, upper, hash, nonce)
+			}
+		}()
+	}
+	wg.Wait()
+	if cancelled {
+		return 0, 0, false
+	}
+	_, _, hash, nonce = t.snapshot()
+	return hash, nonce, true
+}
 
-	return nil, nil
+// better reports whether the hash h1 of nonce n1 beats the hash h2 of nonce
+// n2: the minimum hash wins, and ties go to the lowest nonce, so that the
+// result doesn't depend on how the nonces were split.
+func better(h1, n1, h2, n2 uint64) bool {
+	return h1 < h2 || (h1 == h2 && n1 < n2)
 }
 
-var LOGF *log.Logger
+// benchmark returns how many nonces per second the given number of workers
+// hash, measured over benchmarkTime.
+func benchmark(workers int) float64 {
+	cancel := make(chan struct{})
+	t := newTracker(0)
+	start := time.Now()
+	time.AfterFunc(benchmarkTime, func() { close(cancel) })
+	mine(bitcoin.NewRequest("benchmark", 0, math.MaxUint64), workers, cancel, t)
+	processed, _, _, _ := t.snapshot()
+	return float64(processed) / time.Since(start).Seconds()
+}
+
+// An answer is a miner's result for a request.
+type answer struct {
+	req, result *bitcoin.Message
+}
+
+// sameRequest reports whether a and b are for the same job, data and range.
+func sameRequest(a, b *bitcoin.Message) bool {
+	return a.Job == b.Job && a.Data == b.Data && a.Lower == b.Lower && a.Upper == b.Upper
+}
+
+// run mines the requests the server sends, one at a time and in the order
+// they come, until the connection is lost. The server gives a miner one chunk
+// at a time, but a request that comes while another is being mined waits its
+// turn rather than replacing it. Mining is done on other goroutines, so that a
+// cancel can be read and acted on at once, and progress on the current
+// request reported every progressInterval.
+func run(miner lsp.Client) {
+	msgs := make(chan *bitcoin.Message)
+	go func() {
+		defer close(msgs)
+		for {
+			payload, err := miner.Read()
+			if err != nil {
+				return
+			}
+			var msg bitcoin.Message
+			if err := json.Unmarshal(payload, &msg); err != nil {
+				LOGF.Printf("Bad message from server: %s", err)
+				continue
+			}
+			msgs <- &msg
+		}
+	}()
+	answers := make(chan answer)
+	var current *bitcoin.Message // Request being mined, or nil if idle.
+	var queue []*bitcoin.Message // Requests waiting for it.
+	var cancel chan struct{}
+	var progress *tracker
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	// start mines the next request in the queue, if any.
+	start := func() {
+		if len(queue) == 0 {
+			return
+		}
+		current, queue = queue[0], queue[1:]
+		cancel, progress = make(chan struct{}), newTracker(current.Lower)
+		ticker.Reset(progressInterval)
+		go func(req *bitcoin.Message, cancel <-chan struct{}, t *tracker) {
+			hash, nonce, ok := mine(req, *workers, cancel, t)
+			if !ok {
+				return
+			}
+			result := bitcoin.NewResult(hash, nonce)
+			result.Job, result.Data, result.Lower, result.Upper = req.Job, req.Data, req.Lower, req.Upper
+			select {
+			case answers <- answer{req, result}:
+			case <-cancel:
+			}
+		}(current, cancel, progress)
+	}
+	defer func() {
+		if current != nil {
+			close(cancel)
+		}
+	}()
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			LOGF.Printf("Read %s", msg)
+			switch msg.Type {
+			case bitcoin.Request:
+				queue = append(queue, msg)
+				if current == nil {
+					start()
+				}
+			case bitcoin.Cancel:
+				if current != nil && sameRequest(current, msg) {
+					close(cancel)
+					current = nil
+					start()
+					continue
+				}
+				for i, req := range queue {
+					if sameRequest(req, msg) {
+						queue = append(queue[:i:i], queue[i+1:]...)
+						break
+					}
+				}
+			}
+		case <-ticker.C:
+			if current == nil {
+				continue
+			}
+			processed, scanned, hash, nonce := progress.snapshot()
+			report := bitcoin.NewProgress(current.Data, current.Lower, current.Upper, processed, scanned, hash, nonce)
+			report.Job = current.Job
+			if err := write(miner, report); err != nil {
+				return
+			}
+		case a := <-answers:
+			if a.req != current {
+				continue
+			}
+			current = nil
+			LOGF.Printf("Writing %s", a.result)
+			if err := write(miner, a.result); err != nil {
+				return
+			}
+			start()
+		}
+	}
+}
+
+// LOGF discards everything until main opens the log file.
+var LOGF = log.New(ioutil.Discard, "", 0)
 
 func main() {
 	// You may need a logger for debug purpose
 	const (
 		name = "minerLog.txt"
-		flag = os.O_RDWR | os.O_CREATE
+		mode = os.O_RDWR | os.O_CREATE
 		perm = os.FileMode(0666)
 	)
 
-	file, err := os.OpenFile(name, flag, perm)
+	flag.Parse()
+
+	file, err := os.OpenFile(name, mode, perm)
 	if err != nil {
 		return
 	}
 	defer file.Close()
 
-	const numArgs = 2
-	if len(os.Args) != numArgs {
-		fmt.Printf("Usage: ./%s <hostport>", os.Args[0])
+	LOGF = log.New(file, "", log.Lshortfile|log.Lmicroseconds)
+	// Usage: LOGF.Println() or LOGF.Printf()
+
+	const numArgs = 1
+	if flag.NArg() != numArgs || *workers < 1 {
+		fmt.Printf("Usage: ./%s [-workers=n] [-id=id] <hostport>", os.Args[0])
 		return
 	}
 
-	hostport := os.Args[1]
+	hostport := flag.Arg(0)
 	miner, err := joinWithServer(hostport)
 	if err != nil {
 		fmt.Println("Failed to join with server:", err)
@@ -53,5 +333,5 @@ func main() {
 
 	defer miner.Close()
 
-	// TODO: implement this!
+	run(miner)
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cmu440/bitcoin"
+)
+
+func TestMineMinimum(t *testing.T) {
+	req := bitcoin.NewRequest("minimum", 100, 20000)
+	want, wantNonce := uint64(math.MaxUint64), uint64(0)
+	for n := req.Lower; n <= req.Upper; n++ {
+		if h := bitcoin.Hash(req.Data, n); h < want {
+			want, wantNonce = h, n
+		}
+	}
+	for _, workers := range []int{1, 2, 3, 8, 64} {
+		hash, nonce, ok := mine(req, workers, make(chan struct{}), newTracker(req.Lower))
+		if !ok || hash != want || nonce != wantNonce {
+			t.Fatalf("Mined (%d, %d, %t) with %d workers, expected (%d, %d, true)", hash, nonce, ok, workers, want, wantNonce)
+		}
+	}
+}
+
+func TestMineMoreWorkersThanNonces(t *testing.T) {
+	for _, upper := range []uint64{0, 1, 4} {
+		req := bitcoin.NewRequest("few", 0, upper)
+		want, wantNonce, _ := mine(req, 1, make(chan struct{}), newTracker(0))
+		if hash, nonce, ok := mine(req, 8, make(chan struct{}), newTracker(0)); !ok || hash != want || nonce != wantNonce {
+			t.Errorf("Mined (%d, %d, %t) over [0, %d], expected (%d, %d, true)", hash, nonce, ok, upper, want, wantNonce)
+		}
+	}
+}
+
+func TestBetterBreaksTiesByNonce(t *testing.T) {
+	if !better(5, 10, 6, 1) || better(6, 1, 5, 10) {
+		t.Error("The lower hash did not win")
+	}
+	if !better(5, 1, 5, 10) || better(5, 10, 5, 1) {
+		t.Error("A tie did not go to the lower nonce")
+	}
+}
+
+func TestMineCancel(t *testing.T) {
+	cancel := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		_, _, ok := mine(bitcoin.NewRequest("cancel", 0, math.MaxUint64), 4, cancel, newTracker(0))
+		done <- ok
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(cancel)
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("Mining finished, expected it to be cancelled")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Mining was not cancelled within 500ms")
+	}
+}
+
+func TestMineTracksProgress(t *testing.T) {
+	req := bitcoin.NewRequest("progress", 10, 10000)
+	tr := newTracker(req.Lower)
+	hash, nonce, _ := mine(req, 3, make(chan struct{}), tr)
+	if processed, scanned, h, n := tr.snapshot(); processed != 9991 || scanned != 9991 || h != hash || n != nonce {
+		t.Errorf("Tracked (%d, %d, %d, %d), expected (9991, 9991, %d, %d)", processed, scanned, h, n, hash, nonce)
+	}
+}
+
+func TestTrackerScannedPrefix(t *testing.T) {
+	tr := newTracker(100)
+	tr.record(200, 299, 5, 250)
+	if processed, scanned, _, _ := tr.snapshot(); processed != 100 || scanned != 0 {
+		t.Fatalf("Tracked %d processed and %d scanned, expected 100 and 0", processed, scanned)
+	}
+	tr.record(100, 199, 5, 150)
+	tr.record(400, 499, 9, 400)
+	processed, scanned, hash, nonce := tr.snapshot()
+	if processed != 300 || scanned != 200 {
+		t.Fatalf("Tracked %d processed and %d scanned, expected 300 and 200", processed, scanned)
+	}
+	if hash != 5 || nonce != 150 {
+		t.Fatalf("Tracked best (%d, %d), expected (5, 150)", hash, nonce)
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	if rate := benchmark(2); rate <= 0 {
+		t.Errorf("Benchmarked %f nonces/sec, expected a positive rate", rate)
+	}
+}
+
+// fakeServer is a connection to a server that sends the miner the messages
+// on in, and passes the results the miner writes to out.
+type fakeServer struct {
+	in  chan *bitcoin.Message
+	out chan *bitcoin.Message
+}
+
+func (f *fakeServer) ConnID() int { return 1 }
+
+func (f *fakeServer) Read() ([]byte, error) {
+	msg, ok := <-f.in
+	if !ok {
+		return nil, errors.New("connection closed")
+	}
+	return json.Marshal(msg)
+}
+
+func (f *fakeServer) Write(payload []byte) error {
+	var msg bitcoin.Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+	if msg.Type == bitcoin.Result {
+		f.out <- &msg
+	}
+	return nil
+}
+
+func (f *fakeServer) Close() error { return nil }
+
+func TestRunQueuesRequests(t *testing.T) {
+	server := &fakeServer{in: make(chan *bitcoin.Message), out: make(chan *bitcoin.Message, 3)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(server)
+	}()
+	for _, job := range []string{"1", "2", "3"} {
+		req := bitcoin.NewRequest("queued", 0, 1<<16)
+		req.Job = job
+		server.in <- req
+	}
+	// The second request is cancelled while it waits.
+	cancel := bitcoin.NewCancel("queued", 0, 1<<16)
+	cancel.Job = "2"
+	server.in <- cancel
+	for _, want := range []string{"1", "3"} {
+		select {
+		case result := <-server.out:
+			if result.Job != want {
+				t.Fatalf("Got a result for job %s, expected job %s", result.Job, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("No result for job %s", want)
+		}
+	}
+	close(server.in)
+	<-done
+	if len(server.out) != 0 {
+		t.Errorf("Got a result for job %s, expected none", (<-server.out).Job)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// compactAfter is how many records are appended to the journal before it is
+// rewritten without the jobs answered since.
+const compactAfter = 1 << 12
+
+// Kinds of journal records.
+const (
+	accepted = "accept" // A client's request was accepted, or resumed.
+	assigned = "assign" // A chunk was given to a miner.
+	mined    = "result" // A chunk's result was counted.
+	answered = "done"   // A request's answer was found.
+	dropped  = "drop"   // A request's client went away.
+)
+
+// A record is an entry in the journal. Only requests with a job ID are
+// journaled, since only they can be asked for again. Records refer to a job
+// by the key the scheduler gave it; those accepting or answering a job also
+// hold the client's job ID, data and range, by which a client asks for it.
+type record struct {
+	Kind         string
+	Key          uint64
+	Job          string `json:",omitempty"`
+	Data         string `json:",omitempty"`
+	Lower, Upper uint64
+	Hash, Nonce  uint64 `json:",omitempty"`
+	Miner        string `json:",omitempty"`
+}
+
+// A journal is an append-only file of records, one JSON object per line, from
+// which the scheduler's jobs can be rebuilt when the server restarts. Every
+// record is written before the scheduler goes on, but only those accepting or
+// answering a job are synced to disk, taking the records before them along:
+// losing the others to a power failure just means mining some nonces again.
+// Every so often the file is replaced by a shorter one with the same jobs.
+type journal struct {
+	path     string
+	file     *os.File
+	enc      *json.Encoder
+	appended int // Number of records appended since the file was written.
+}
+
+// openJournal opens the journal at path, creating it if need be, and returns
+// the records already in it. A record cut short by a crash ends the journal.
+func openJournal(path string) (*journal, []record, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	var records []record
+	var end int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			break
+		}
+		records = append(records, r)
+		end += int64(len(line))
+	}
+	// Drop anything after the last whole record, so that new records follow
+	// on from it.
+	if err := file.Truncate(end); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(end, 0); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return &journal{path: path, file: file, enc: json.NewEncoder(file)}, records, nil
+}
+
+// append writes r to the end of the journal, and syncs it to disk if it
+// accepts or answers a job. A nil journal discards it.
+func (jn *journal) append(r record) {
+	if jn == nil {
+		return
+	}
+	jn.appended++
+	if err := jn.enc.Encode(r); err != nil {
+		LOGF.Printf("Failed to journal %+v: %s", r, err)
+		return
+	}
+	if r.Kind != accepted && r.Kind != answered {
+		return
+	}
+	if err := jn.file.Sync(); err != nil {
+		LOGF.Printf("Failed to sync the journal: %s", err)
+	}
+}
+
+// due reports whether enough records have been appended that the journal
+// should be compacted.
+func (jn *journal) due() bool {
+	return jn != nil && jn.appended >= compactAfter
+}
+
+// compact replaces the journal with one holding only the given records. The
+// new file is written beside the old one and renamed over it, so that a crash
+// part way through leaves one or the other whole. If it fails, the journal
+// carries on in the old file.
+func (jn *journal) compact(records []record) {
+	if jn == nil {
+		return
+	}
+	tmp := jn.path + ".tmp"
+	file, err := writeRecords(tmp, records)
+	if err == nil {
+		if err = os.Rename(tmp, jn.path); err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		LOGF.Printf("Failed to compact the journal: %s", err)
+		os.Remove(tmp)
+		return
+	}
+	if dir, err := os.Open(filepath.Dir(jn.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	jn.file.Close()
+	jn.file, jn.enc, jn.appended = file, json.NewEncoder(file), 0
+}
+
+// writeRecords writes a new journal with the given records to path, syncs it
+// to disk, and returns it open for more records to be appended.
+func writeRecords(path string, records []record) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err = enc.Encode(r); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (jn *journal) close() error {
+	if jn == nil {
+		return nil
+	}
+	return jn.file.Close()
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmu440/bitcoin"
+)
+
+func TestJournalDropsTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	jn, _, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jn.append(record{Kind: accepted, Job: "a", Data: "data", Upper: 10})
+	jn.append(record{Kind: mined, Job: "a", Upper: 5, Hash: 3, Nonce: 2})
+	jn.close()
+	// A crash cuts the next record short.
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Kind":"done","Jo`)
+	file.Close()
+
+	jn, records, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].Kind != mined || records[1].Hash != 3 {
+		t.Fatalf("Read %+v, expected the two whole records", records)
+	}
+	jn.append(record{Kind: answered, Job: "a", Hash: 3, Nonce: 2})
+	jn.close()
+	_, records, err = openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[2].Kind != answered {
+		t.Fatalf("Read %+v, expected the new record after the two whole ones", records)
+	}
+}
+
+func TestSubtract(t *testing.T) {
+	pending := []nonceRange{{0, 9}, {20, 29}}
+	got := subtract(pending, nonceRange{5, 24})
+	want := []nonceRange{{0, 4}, {25, 29}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("Got %v, expected %v", got, want)
+	}
+}
+
+// newJournaledScheduler returns a scheduler restored from the journal at path.
+func newJournaledScheduler(t *testing.T, path string) (*scheduler, *fakeClock) {
+	s, clock := newTestScheduler()
+	jn, records, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { jn.close() })
+	s.journal = jn
+	s.restore(records)
+	return s, clock
+}
+
+func TestSchedulerRestartsFromJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	const upper = 4*initialChunkSize - 1
+	want, wantNonce := mine(bitcoin.NewRequest("restart", 0, upper))
+
+	// One chunk is mined before the server crashes, and one is in flight.
+	s, clock := newJournaledScheduler(t, path)
+	s.addMiner(1, "", 1, 0)
+	s.addMiner(2, "", 1, 0)
+	sends := s.addJob(10, "job", "restart", 0, upper)
+	first := requestFor(t, sends, 1)
+	clock.advance(time.Millisecond)
+	hash, nonce := mine(first)
+	s.result(1, answer(first, hash, nonce))
+	s.journal.close()
+
+	// After the restart, the rest is mined before the client reconnects.
+	s, clock = newJournaledScheduler(t, path)
+	if len(s.jobs) != 1 || s.jobs[0].client != noClient {
+		t.Fatalf("Restored %d jobs, expected one without a client", len(s.jobs))
+	}
+	reply, mined := mineAll(s, clock, s.addMiner(3, "", 1, 0), 10, func(int) time.Duration { return time.Millisecond })
+	if reply != nil {
+		t.Fatalf("Sent %s to the old client, expected nothing", reply)
+	}
+	if mined != upper+1-initialChunkSize {
+		t.Errorf("Mined %d nonces after the restart, expected %d", mined, upper+1-initialChunkSize)
+	}
+	sends = s.addJob(20, "job", "restart", 0, upper)
+	if len(sends) != 1 || sends[0].connID != 20 || sends[0].msg.Hash != want || sends[0].msg.Nonce != wantNonce || sends[0].msg.Job != "job" {
+		t.Fatalf("Sent %v to the reconnected client, expected %s", sends, bitcoin.NewResult(want, wantNonce))
+	}
+
+	// The answer is still there after another restart.
+	s.journal.close()
+	s, _ = newJournaledScheduler(t, path)
+	if sends := s.addJob(30, "job", "restart", 0, upper); len(sends) != 1 || sends[0].msg.Hash != want {
+		t.Fatalf("Sent %v after another restart, expected %s", sends, bitcoin.NewResult(want, wantNonce))
+	}
+}
+
+func TestSchedulerResumesDroppedJob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	const upper = 4*initialChunkSize - 1
+	want, wantNonce := mine(bitcoin.NewRequest("resume", 0, upper))
+	for _, restart := range []bool{false, true} {
+		os.Remove(path)
+		s, clock := newJournaledScheduler(t, path)
+		s.addMiner(1, "", 1, 0)
+		first := requestFor(t, s.addJob(10, "job", "resume", 0, upper), 1)
+		clock.advance(time.Millisecond)
+		hash, nonce := mine(first)
+		second := requestFor(t, s.result(1, answer(first, hash, nonce)), 1)
+
+		// The client goes away while the second chunk is mined, and the
+		// miner is told to stop. The job isn't mined until it comes back.
+		sends := s.removeClient(10)
+		if len(sends) != 1 || sends[0].msg.Type != bitcoin.Cancel || sends[0].msg.Lower != second.Lower {
+			t.Fatalf("Sent %v, expected only a cancel of %s", sends, second)
+		}
+		if restart {
+			s.journal.close()
+			s, clock = newJournaledScheduler(t, path)
+			s.addMiner(1, "", 1, 0)
+		}
+		if len(s.jobs) != 0 {
+			t.Fatalf("Mining %d jobs, expected none", len(s.jobs))
+		}
+		reply, mined := mineAll(s, clock, s.addJob(20, "job", "resume", 0, upper), 20, func(int) time.Duration { return time.Millisecond })
+		if mined != upper+1-initialChunkSize {
+			t.Errorf("Restart %t: mined %d nonces after the client came back, expected %d", restart, mined, upper+1-initialChunkSize)
+		}
+		if reply == nil || reply.Hash != want || reply.Nonce != wantNonce {
+			t.Errorf("Restart %t: client got %v, expected %s", restart, reply, bitcoin.NewResult(want, wantNonce))
+		}
+		s.journal.close()
+	}
+}
+
+func TestSchedulerMatchesJobByDataAndRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	const upper = initialChunkSize - 1
+	s, clock := newJournaledScheduler(t, path)
+	delay := func(int) time.Duration { return time.Millisecond }
+	reply, _ := mineAll(s, clock, append(s.addMiner(1, "", 1, 0), s.addJob(10, "job", "first", 0, upper)...), 10, delay)
+	if reply == nil {
+		t.Fatal("First job wasn't answered")
+	}
+
+	// The same job ID with other data, or another range, is another job.
+	for _, req := range []*bitcoin.Message{
+		bitcoin.NewRequest("second", 0, upper),
+		bitcoin.NewRequest("first", 1, upper),
+	} {
+		want, wantNonce := mine(req)
+		reply, mined := mineAll(s, clock, s.addJob(20, "job", req.Data, req.Lower, req.Upper), 20, delay)
+		if mined != req.Upper-req.Lower+1 {
+			t.Errorf("Mined %d nonces for %s, expected %d", mined, req, req.Upper-req.Lower+1)
+		}
+		if reply == nil || reply.Hash != want || reply.Nonce != wantNonce {
+			t.Errorf("Client got %v for %s, expected %s", reply, req, bitcoin.NewResult(want, wantNonce))
+		}
+	}
+}
+
+func TestSchedulerKeepsNoAnswersWithoutJournal(t *testing.T) {
+	s, clock := newTestScheduler()
+	const upper = initialChunkSize - 1
+	delay := func(int) time.Duration { return time.Millisecond }
+	mineAll(s, clock, append(s.addMiner(1, "", 1, 0), s.addJob(10, "job", "data", 0, upper)...), 10, delay)
+	if len(s.answers) != 0 {
+		t.Fatalf("Kept %d answers, expected none", len(s.answers))
+	}
+	if _, mined := mineAll(s, clock, s.addJob(20, "job", "data", 0, upper), 20, delay); mined != upper+1 {
+		t.Errorf("Mined %d nonces the second time, expected %d", mined, upper+1)
+	}
+}
+
+func TestSchedulerKeepsOtherClientsJob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	const upper = 2*initialChunkSize - 1
+	s, clock := newJournaledScheduler(t, path)
+	queue := append(s.addMiner(1, "", 1, 0), s.addJob(10, "job", "shared", 0, upper)...)
+
+	// Another client asking for the same job while the first is connected
+	// gets it mined separately, and the first still gets its answer.
+	queue = append(queue, s.addJob(20, "job", "shared", 0, upper)...)
+	if len(s.jobs) != 2 || s.jobs[0].client != 10 || s.jobs[1].client != 20 {
+		t.Fatalf("Mining %d jobs, expected one for each client", len(s.jobs))
+	}
+	if s.jobs[1].journaled {
+		t.Error("Journaled the second client's job, expected only the first")
+	}
+	queue = append(queue, s.removeClient(20)...)
+	reply, _ := mineAll(s, clock, queue, 10, func(int) time.Duration { return time.Millisecond })
+	want, wantNonce := mine(bitcoin.NewRequest("shared", 0, upper))
+	if reply == nil || reply.Hash != want || reply.Nonce != wantNonce {
+		t.Errorf("First client got %v, expected %s", reply, bitcoin.NewResult(want, wantNonce))
+	}
+}
+
+func TestSchedulerCompactsJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	const upper = 4*initialChunkSize - 1
+	delay := func(int) time.Duration { return time.Millisecond }
+	s, clock := newJournaledScheduler(t, path)
+	for i := 0; i < 3; i++ {
+		data := fmt.Sprintf("answered-%d", i)
+		if reply, _ := mineAll(s, clock, append(s.addMiner(1, "", 1, 0), s.addJob(10, "job", data, 0, upper)...), 10, delay); reply == nil {
+			t.Fatalf("Job %d wasn't answered", i)
+		}
+		s.removeMiner(1)
+	}
+
+	// One chunk of another job is mined, and the next is in flight.
+	s.addMiner(1, "", 1, 0)
+	first := requestFor(t, s.addJob(10, "job", "open", 0, upper), 1)
+	clock.advance(time.Millisecond)
+	hash, nonce := mine(first)
+	second := requestFor(t, s.result(1, answer(first, hash, nonce)), 1)
+	before := countLines(t, path)
+	s.journal.compact(s.snapshot())
+	if after := countLines(t, path); after >= before || after != 3+1+1+1 {
+		t.Fatalf("Journal has %d records after compacting %d, expected 6", after, before)
+	}
+	s.journal.close()
+
+	// Everything is still there, and the chunk in flight is mined first.
+	s, clock = newJournaledScheduler(t, path)
+	for i := 0; i < 3; i++ {
+		if sends := s.addJob(20, "job", fmt.Sprintf("answered-%d", i), 0, upper); len(sends) != 1 || sends[0].msg.Type != bitcoin.Result {
+			t.Fatalf("Sent %v for answered job %d, expected its result", sends, i)
+		}
+	}
+	next := requestFor(t, s.addMiner(2, "", 1, 0), 2)
+	if next.Lower != second.Lower {
+		t.Fatalf("Sent %s after the restart, expected the chunk in flight, %s", next, second)
+	}
+	want, wantNonce := mine(bitcoin.NewRequest("open", 0, upper))
+	s.addJob(30, "job", "open", 0, upper)
+	reply, mined := mineAll(s, clock, []send{{2, next}}, 30, delay)
+	if mined != upper+1-initialChunkSize {
+		t.Errorf("Mined %d nonces after the restart, expected %d", mined, upper+1-initialChunkSize)
+	}
+	if reply == nil || reply.Hash != want || reply.Nonce != wantNonce {
+		t.Errorf("Client got %v, expected %s", reply, bitcoin.NewResult(want, wantNonce))
+	}
+}
+
+func TestCompactedJournalKeepsAnsweredKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	s, clock := newJournaledScheduler(t, path)
+	queue := append(s.addMiner(1, "", 1, 0), s.addJob(10, "job", "answered", 0, initialChunkSize-1)...)
+	if reply, _ := mineAll(s, clock, queue, 10, func(int) time.Duration { return time.Millisecond }); reply == nil {
+		t.Fatal("Job wasn't answered")
+	}
+	lastKey := s.lastKey
+	s.journal.compact(s.snapshot())
+	s.journal.close()
+
+	// Jobs created after the restart mustn't reuse the answered job's key.
+	s, _ = newJournaledScheduler(t, path)
+	if s.lastKey != lastKey {
+		t.Fatalf("Restored last key %d, expected %d", s.lastKey, lastKey)
+	}
+}
+
+// countLines returns the number of lines in the file at path.
+func countLines(t *testing.T, path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A policy chooses which job each chunk is taken from, and so how miners are
+// shared between clients.
+type policy interface {
+	// next returns the job to take the next chunk from, or nil if none of
+	// jobs (which are in arrival order) has unassigned work.
+	next(jobs []*job) *job
+}
+
+// policies maps the name of each policy, as given on the command line, to a
+// function that creates it.
+var policies = map[string]func() policy{
+	"fifo": func() policy { return fifo{} },
+	"srwf": func() policy { return srwf{} },
+	"rr":   func() policy { return &roundRobin{} },
+}
+
+const defaultPolicy = "rr"
+
+// newPolicy returns the policy with the given name.
+func newPolicy(name string) (policy, error) {
+	newP, ok := policies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown policy %q (expected one of %s)", name, policyNames())
+	}
+	return newP(), nil
+}
+
+func policyNames() string {
+	var names []string
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// fifo serves jobs in the order they arrived: the miners all work on the
+// oldest job until it has been handed out in full.
+type fifo struct{}
+
+func (fifo) next(jobs []*job) *job {
+	for _, j := range jobs {
+		if len(j.pending) > 0 {
+			return j
+		}
+	}
+	return nil
+}
+
+// srwf serves the job with the shortest remaining work first, counting both
+// the nonces not yet assigned and those being mined.
+type srwf struct{}
+
+func (srwf) next(jobs []*job) *job {
+	var best *job
+	for _, j := range jobs {
+		if len(j.pending) > 0 && (best == nil || j.remaining() < best.remaining()) {
+			best = j
+		}
+	}
+	return best
+}
+
+// roundRobin takes successive chunks from each job in turn, so that every
+// job gets a share of the miners however large the others are.
+type roundRobin struct {
+	last *job // Job the last chunk was taken from.
+}
+
+func (rr *roundRobin) next(jobs []*job) *job {
+	start := 0
+	for i, j := range jobs {
+		if j == rr.last {
+			start = i + 1
+			break
+		}
+	}
+	for i := range jobs {
+		if j := jobs[(start+i)%len(jobs)]; len(j.pending) > 0 {
+			rr.last = j
+			return j
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cmu440/bitcoin"
+)
+
+// A simJob is a request arriving at the given time after the start of a
+// simulation.
+type simJob struct {
+	at   time.Duration
+	size uint64
+}
+
+// simulate runs jobs on miners with the given hash rates (in nonces per
+// second) under policy p, and returns each job's response time. Miners take
+// exactly as long as their rate says; no hashing is done.
+func simulate(t *testing.T, p policy, rates []float64, jobs []simJob) []time.Duration {
+	s, clock := newTestScheduler()
+	s.policy = p
+	start := clock.now()
+	const firstClient = 100
+	type running struct {
+		done time.Time
+		req  *bitcoin.Message
+	}
+	busy := make(map[int]running) // By miner connection ID.
+	responses := make([]time.Duration, len(jobs))
+	replies := 0
+	handle := func(sends []send) {
+		for _, snd := range sends {
+			if snd.connID >= firstClient {
+				responses[snd.connID-firstClient] = clock.now().Sub(start.Add(jobs[snd.connID-firstClient].at))
+				replies++
+				continue
+			}
+			if snd.msg.Type == bitcoin.Cancel {
+				delete(busy, snd.connID)
+				continue
+			}
+			size := float64(snd.msg.Upper - snd.msg.Lower + 1)
+			busy[snd.connID] = running{clock.now().Add(time.Duration(size / rates[snd.connID] * float64(time.Second))), snd.msg}
+		}
+	}
+	for i := range rates {
+		handle(s.addMiner(i, "", 1, 0))
+	}
+	next := 0
+	for replies < len(jobs) {
+		// Find the next event: a job arriving, or a miner finishing.
+		miner, at := -1, time.Time{}
+		if next < len(jobs) {
+			at = start.Add(jobs[next].at)
+		}
+		for id, r := range busy {
+			if (miner == -1 && next == len(jobs)) || r.done.Before(at) || (r.done.Equal(at) && id < miner) {
+				miner, at = id, r.done
+			}
+		}
+		if miner == -1 && next == len(jobs) {
+			t.Fatalf("Simulation stalled with %d of %d jobs answered", replies, len(jobs))
+		}
+		clock.t = at
+		if miner == -1 {
+			handle(s.addJob(firstClient+next, "", "sim", 0, jobs[next].size-1))
+			next++
+			continue
+		}
+		req := busy[miner].req
+		delete(busy, miner)
+		handle(s.result(miner, answer(req, req.Lower, req.Lower)))
+	}
+	return responses
+}
+
+func mean(ds []time.Duration) time.Duration {
+	var total time.Duration
+	for _, d := range ds {
+		total += d
+	}
+	return total / time.Duration(len(ds))
+}
+
+// meanResponseTimes returns the mean response time of jobs under each policy.
+func meanResponseTimes(t *testing.T, rates []float64, jobs []simJob) map[string]time.Duration {
+	means := make(map[string]time.Duration)
+	for name, newP := range policies {
+		means[name] = mean(simulate(t, newP(), rates, jobs))
+		t.Logf("%s: mean response time %s", name, means[name].Round(time.Millisecond))
+	}
+	return means
+}
+
+var simRates = []float64{1e6, 1e6, 2e6, 4e6}
+
+func TestPolicyMixedWorkload(t *testing.T) {
+	// One huge job, and small ones arriving soon after it.
+	jobs := []simJob{{0, 200e6}}
+	for i := 1; i <= 5; i++ {
+		jobs = append(jobs, simJob{time.Duration(i) * 500 * time.Millisecond, 2e6})
+	}
+	means := meanResponseTimes(t, simRates, jobs)
+	if means["srwf"] >= means["rr"] || means["rr"] >= means["fifo"] {
+		t.Errorf("Mean response times are %v, expected srwf < rr < fifo", means)
+	}
+	// Under FIFO, the small jobs wait for almost all of the huge one.
+	if means["fifo"] < 2*means["rr"] {
+		t.Errorf("FIFO mean response time %s is not much worse than round-robin's %s", means["fifo"], means["rr"])
+	}
+}
+
+func TestPolicyEqualWorkload(t *testing.T) {
+	// Equal jobs arriving together: taking turns only delays every job, so
+	// FIFO and SRWF (which degenerates to FIFO) beat round-robin.
+	var jobs []simJob
+	for i := 0; i < 6; i++ {
+		jobs = append(jobs, simJob{0, 50e6})
+	}
+	means := meanResponseTimes(t, simRates, jobs)
+	if means["fifo"] >= means["rr"] || means["srwf"] >= means["rr"] {
+		t.Errorf("Mean response times are %v, expected fifo and srwf < rr", means)
+	}
+}
+
+func TestPolicySmallJobNotStarved(t *testing.T) {
+	// A small job arriving behind a huge one gets its answer within a few
+	// chunks under SRWF and round-robin.
+	jobs := []simJob{{0, 500e6}, {time.Second, 1e6}}
+	for _, name := range []string{"srwf", "rr"} {
+		responses := simulate(t, policies[name](), simRates, jobs)
+		if responses[1] > 3*defaultChunkTime {
+			t.Errorf("%s: small job took %s", name, responses[1])
+		}
+	}
+}
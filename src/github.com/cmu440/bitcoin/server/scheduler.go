@@ -0,0 +1,805 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cmu440/bitcoin"
+)
+
+const (
+	// defaultChunkTime is how long each chunk should take a miner.
+	defaultChunkTime = time.Second
+
+	// initialChunkSize is the size of a miner's first chunk per worker, before
+	// its hash rate is known, if no other miner's is either.
+	initialChunkSize = 1 << 14
+
+	// minChunkSize keeps chunks from becoming so small that messaging
+	// dominates hashing.
+	minChunkSize = 1 << 10
+
+	// rateWeight is the weight given to the latest measurement when updating
+	// a miner's hash rate.
+	rateWeight = 0.5
+
+	// stragglerFactor is how many times longer than its peers would take a
+	// miner may spend on a chunk before an idle miner is also given it.
+	stragglerFactor = 2
+)
+
+// A nonceRange is the inclusive range of nonces [lower, upper].
+type nonceRange struct {
+	lower, upper uint64
+}
+
+// size returns the number of nonces in r, saturating at math.MaxUint64.
+func (r nonceRange) size() uint64 {
+	if r.upper-r.lower == math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return r.upper - r.lower + 1
+}
+
+// noClient is the client of a job whose client has yet to reconnect after the
+// server restarted.
+const noClient = 0
+
+// A job is a client's request, which is split into chunks for the miners.
+type job struct {
+	client    int    // Connection ID of the client.
+	id        string // Job ID chosen by the client, if any.
+	key       uint64 // Job ID in messages to miners and the journal, unique among all jobs.
+	journaled bool
+	data      string
+	lower     uint64 // The range requested.
+	upper     uint64
+	pending   []nonceRange // Not yet assigned to a miner.
+	running   int          // Number of chunks assigned but not finished.
+	mining    float64      // Number of nonces in those chunks.
+	hash      uint64       // Best result so far.
+	nonce     uint64
+	dropped   bool // True if the client has gone away.
+}
+
+func (j *job) done() bool {
+	return len(j.pending) == 0 && j.running == 0
+}
+
+// merge records a result if it is better than the best so far: the minimum
+// hash wins, and ties go to the lowest nonce.
+func (j *job) merge(hash, nonce uint64) {
+	if hash < j.hash || (hash == j.hash && nonce < j.nonce) {
+		j.hash, j.nonce = hash, nonce
+	}
+}
+
+// take removes up to size nonces from the front of the job's pending work.
+func (j *job) take(size uint64) nonceRange {
+	r := j.pending[0]
+	if size >= r.size() {
+		j.pending = j.pending[1:]
+		return r
+	}
+	j.pending[0].lower += size
+	return nonceRange{r.lower, r.lower + size - 1}
+}
+
+// remaining returns the number of nonces not yet mined.
+func (j *job) remaining() float64 {
+	return j.unassigned() + j.mining
+}
+
+// unassigned returns the number of nonces not yet assigned to a miner.
+func (j *job) unassigned() float64 {
+	var n float64
+	for _, r := range j.pending {
+		n += float64(r.size())
+	}
+	return n
+}
+
+// A chunk is a part of a job assigned to one or more miners.
+type chunk struct {
+	job *job
+	nonceRange
+	miners []*miner // More than one if the chunk was re-executed speculatively.
+	done   bool     // True once a result has been counted.
+}
+
+// A jobKey is what a client asks for a journaled job by. Requests are only
+// for the same job if they agree on all of it, so that a job ID reused for
+// other data, or by another client, is never given the wrong answer.
+type jobKey struct {
+	id, data     string
+	lower, upper uint64
+}
+
+func (j *job) jobKey() jobKey {
+	return jobKey{j.id, j.data, j.lower, j.upper}
+}
+
+// A storedAnswer is the result of a journaled job, kept for its client to ask
+// for again, along with the job's key, which stays taken.
+type storedAnswer struct {
+	key    uint64
+	result *bitcoin.Message
+}
+
+// answeredBy reports whether r is a result for c. Two chunks of the same job
+// with the same range have the same result, so it doesn't matter which one r
+// was for.
+func (c *chunk) answeredBy(r *bitcoin.Message) bool {
+	return r.Job == strconv.FormatUint(c.job.key, 10) && r.Data == c.job.data && r.Lower == c.lower && r.Upper == c.upper
+}
+
+// request returns the request to send a miner for c.
+func (c *chunk) request() *bitcoin.Message {
+	req := bitcoin.NewRequest(c.job.data, c.lower, c.upper)
+	req.Job = strconv.FormatUint(c.job.key, 10)
+	return req
+}
+
+// without returns c.miners without m.
+func (c *chunk) without(m *miner) []*miner {
+	var miners []*miner
+	for _, other := range c.miners {
+		if other != m {
+			miners = append(miners, other)
+		}
+	}
+	return miners
+}
+
+type miner struct {
+	connID  int
+	id      string    // Identifies the miner across connections, if not empty.
+	workers int       // Number of goroutines it mines with.
+	rate    float64   // Measured hash rate in nonces per second, or 0 if unknown.
+	chunk   *chunk    // Chunk being mined, or nil if idle.
+	started time.Time // When the miner was given chunk.
+
+	// The miner's latest progress report on chunk, if any.
+	processed uint64 // Number of nonces hashed.
+	scanned   uint64 // Number of nonces from the chunk's lower on all hashed.
+	reported  time.Time
+	hash      uint64 // Best result among them.
+	nonce     uint64
+}
+
+// eta returns how many seconds from now m is expected to finish its chunk, or
+// -1 if that isn't known. Once m has reported progress on the chunk, it is
+// expected to go on at the rate it has so far.
+func (m *miner) eta(now time.Time) float64 {
+	rate := m.rate
+	done := now.Sub(m.started).Seconds() * rate
+	if elapsed := m.reported.Sub(m.started).Seconds(); m.processed > 0 && elapsed > 0 {
+		rate = float64(m.processed) / elapsed
+		done = float64(m.processed) + now.Sub(m.reported).Seconds()*rate
+	}
+	if rate <= 0 {
+		return -1
+	}
+	return math.Max(0, (float64(m.chunk.size())-done)/rate)
+}
+
+// A send is a message the server should send.
+type send struct {
+	connID int
+	msg    *bitcoin.Message
+}
+
+// A scheduler splits client requests into chunks and assigns them to miners.
+// Each miner works on one chunk at a time, taken from the job its policy
+// chooses. A chunk is sized from the miner's measured hash rate so that it
+// takes about chunkTime, except near the end of a job, where each miner is
+// given just enough to finish when the others are expected to, so that a slow
+// miner doesn't hold up the reply. Until a miner's rate is measured, it is
+// guessed from its peers' rate per worker and the number of workers it
+// reported when it joined.
+//
+// If a miner is lost, the part of its chunk it hadn't reported scanning goes
+// back to the front of its job's pending work. If a miner is taking much
+// longer than its peers would, and another is idle, the idle miner is given
+// the same chunk; whichever finishes first counts, and the other is told to
+// cancel it. Likewise, if a client goes away, the miners working on its
+// request are told to cancel, and are free for other requests at once.
+//
+// A client's job IDs only name its own jobs: each job belongs to the
+// connection that asked for it, and its answer goes only there, so clients
+// using the same IDs at once never get each other's answers.
+//
+// If the scheduler has a journal, requests with a job ID are journaled, so
+// that a client can ask for one again after losing its connection, or after
+// the server restarts: it gets the answer if it has been found, and otherwise
+// mining resumes where it left off. Only a job whose client has gone away can
+// be taken over like this, and only by a request with the same data and range.
+//
+// The scheduler does no I/O besides the journal: each method returns the
+// messages the server should send as a result.
+type scheduler struct {
+	chunkTime time.Duration
+	policy    policy
+	now       func() time.Time
+	miners    []*miner                // In the order they joined.
+	jobs      []*job                  // In arrival order.
+	rates     map[string]float64      // Rates of miners that have gone away, by ID.
+	journal   *journal                // Or nil, if requests aren't journaled.
+	answers   map[jobKey]storedAnswer // Results of journaled jobs.
+	saved     map[jobKey]*job         // Journaled jobs whose clients went away.
+	lastKey   uint64                  // Key of the latest job created.
+}
+
+func newScheduler(chunkTime time.Duration, p policy, now func() time.Time) *scheduler {
+	return &scheduler{
+		chunkTime: chunkTime,
+		policy:    p,
+		now:       now,
+		rates:     make(map[string]float64),
+		answers:   make(map[jobKey]storedAnswer),
+		saved:     make(map[jobKey]*job),
+	}
+}
+
+// newJob returns a job for the nonces [lower, upper].
+func (s *scheduler) newJob(client int, id, data string, lower, upper uint64) *job {
+	s.lastKey++
+	j := &job{client: client, id: id, key: s.lastKey, data: data, lower: lower, upper: upper, hash: math.MaxUint64}
+	if lower <= upper {
+		j.pending = []nonceRange{{lower, upper}}
+	}
+	return j
+}
+
+// record journals r for j, if j is journaled.
+func (s *scheduler) record(j *job, r record) {
+	if j.journaled {
+		r.Key = j.key
+		s.journal.append(r)
+	}
+}
+
+// journaledJob returns the live journaled job with the given key, if any.
+func (s *scheduler) journaledJob(key jobKey) *job {
+	for _, j := range s.jobs {
+		if j.journaled && j.jobKey() == key {
+			return j
+		}
+	}
+	return nil
+}
+
+// restore rebuilds the jobs in a journal: those that were answered are
+// remembered, and the rest are mined from where they left off, though only
+// those whose clients were still connected are mined before the clients ask
+// again. Chunks that were assigned but had no result are mined again, before
+// the rest of their jobs. The journal is then compacted.
+func (s *scheduler) restore(records []record) {
+	jobs := make(map[uint64]*job)
+	var order []*job
+	active := make(map[*job]bool)
+	inFlight := make(map[*job][]nonceRange)
+	for _, r := range records {
+		if r.Key > s.lastKey {
+			// Keys of jobs created from now on follow on from the journal's.
+			s.lastKey = r.Key
+		}
+		j := jobs[r.Key]
+		switch {
+		case r.Kind == accepted && j == nil:
+			j = &job{client: noClient, id: r.Job, key: r.Key, journaled: true, data: r.Data,
+				lower: r.Lower, upper: r.Upper, hash: math.MaxUint64}
+			if r.Lower <= r.Upper {
+				j.pending = []nonceRange{{r.Lower, r.Upper}}
+			}
+			jobs[r.Key] = j
+			order = append(order, j)
+			active[j] = true
+		case r.Kind == answered:
+			result := bitcoin.NewResult(r.Hash, r.Nonce)
+			result.Job = r.Job
+			s.answers[jobKey{r.Job, r.Data, r.Lower, r.Upper}] = storedAnswer{r.Key, result}
+			delete(jobs, r.Key)
+		case j == nil:
+			// A record for a job answered earlier.
+		case r.Kind == accepted:
+			active[j] = true
+		case r.Kind == dropped:
+			active[j] = false
+		case r.Kind == assigned:
+			inFlight[j] = append(inFlight[j], nonceRange{r.Lower, r.Upper})
+		case r.Kind == mined:
+			j.merge(r.Hash, r.Nonce)
+			j.pending = subtract(j.pending, nonceRange{r.Lower, r.Upper})
+		}
+	}
+	defer func() { s.journal.compact(s.snapshot()) }()
+	for _, j := range order {
+		if jobs[j.key] != j {
+			continue
+		}
+		var first []nonceRange
+		for _, r := range inFlight[j] {
+			first = append(first, intersect(j.pending, r)...)
+			j.pending = subtract(j.pending, r)
+		}
+		j.pending = append(first, j.pending...)
+		if !active[j] {
+			s.saved[j.jobKey()] = j
+			continue
+		}
+		s.jobs = append(s.jobs, j)
+		s.finish(j)
+	}
+}
+
+// snapshot returns the records of a journal holding just the scheduler's
+// journaled jobs and answers: for each job, what has been mined of it, and
+// the chunks being mined.
+func (s *scheduler) snapshot() []record {
+	var records []record
+	add := func(j *job) {
+		records = append(records, record{Kind: accepted, Key: j.key, Job: j.id, Data: j.data, Lower: j.lower, Upper: j.upper})
+		var running []nonceRange
+		seen := make(map[*chunk]bool)
+		for _, m := range s.miners {
+			if c := m.chunk; c != nil && c.job == j && !c.done && !seen[c] {
+				seen[c] = true
+				running = append(running, c.nonceRange)
+			}
+		}
+		left := append(append([]nonceRange(nil), j.pending...), running...)
+		done := []nonceRange{{j.lower, j.upper}}
+		if j.lower > j.upper {
+			done = nil
+		}
+		for _, r := range left {
+			done = subtract(done, r)
+		}
+		for _, r := range done {
+			records = append(records, record{Kind: mined, Key: j.key, Lower: r.lower, Upper: r.upper, Hash: j.hash, Nonce: j.nonce})
+		}
+		for _, r := range running {
+			records = append(records, record{Kind: assigned, Key: j.key, Lower: r.lower, Upper: r.upper})
+		}
+	}
+	for _, j := range s.jobs {
+		if j.journaled {
+			add(j)
+		}
+	}
+	for _, j := range s.saved {
+		add(j)
+		records = append(records, record{Kind: dropped, Key: j.key})
+	}
+	for key, a := range s.answers {
+		records = append(records, record{Kind: answered, Key: a.key, Job: key.id, Data: key.data, Lower: key.lower, Upper: key.upper,
+			Hash: a.result.Hash, Nonce: a.result.Nonce})
+	}
+	return records
+}
+
+// intersect returns the parts of the ranges in pending that are within r.
+func intersect(pending []nonceRange, r nonceRange) []nonceRange {
+	var in []nonceRange
+	for _, p := range pending {
+		if p.upper < r.lower || p.lower > r.upper {
+			continue
+		}
+		lower, upper := p.lower, p.upper
+		if lower < r.lower {
+			lower = r.lower
+		}
+		if upper > r.upper {
+			upper = r.upper
+		}
+		in = append(in, nonceRange{lower, upper})
+	}
+	return in
+}
+
+// subtract returns the ranges in pending without the nonces in r.
+func subtract(pending []nonceRange, r nonceRange) []nonceRange {
+	var left []nonceRange
+	for _, p := range pending {
+		if p.upper < r.lower || p.lower > r.upper {
+			left = append(left, p)
+			continue
+		}
+		if p.lower < r.lower {
+			left = append(left, nonceRange{p.lower, r.lower - 1})
+		}
+		if p.upper > r.upper {
+			left = append(left, nonceRange{r.upper + 1, p.upper})
+		}
+	}
+	return left
+}
+
+func (s *scheduler) miner(connID int) *miner {
+	for _, m := range s.miners {
+		if m.connID == connID {
+			return m
+		}
+	}
+	return nil
+}
+
+// addMiner adds an idle miner that mines with the given number of workers,
+// and whose benchmarked rate (or 0 if unknown) is given. If a miner with the
+// same ID was seen before, the rate measured then is used instead.
+func (s *scheduler) addMiner(connID int, id string, workers int, rate float64) []send {
+	if workers < 1 {
+		workers = 1
+	}
+	if r, ok := s.rates[id]; ok && id != "" {
+		rate = r
+		delete(s.rates, id)
+	}
+	s.miners = append(s.miners, &miner{connID: connID, id: id, workers: workers, rate: math.Max(0, rate)})
+	return s.assign()
+}
+
+// addJob adds a client's request for the nonces [lower, upper]. If requests
+// are journaled, and the request has the job ID, data and range of one seen
+// before, the client is given the answer if it has been found, and otherwise
+// the job carries on, and the client is sent its answer when it is found. A
+// job that another connected client is still waiting for stays that client's,
+// though: the request is mined separately, and isn't journaled.
+func (s *scheduler) addJob(client int, id, data string, lower, upper uint64) []send {
+	key := jobKey{id, data, lower, upper}
+	journaled := id != "" && s.journal != nil
+	if journaled {
+		if a, ok := s.answers[key]; ok {
+			return []send{{client, a.result}}
+		}
+		if j, ok := s.saved[key]; ok {
+			delete(s.saved, key)
+			j.client = client
+			s.jobs = append(s.jobs, j)
+			s.record(j, record{Kind: accepted})
+			return append(s.finish(j), s.assign()...)
+		}
+		if j := s.journaledJob(key); j != nil && j.client == noClient {
+			// Restored from the journal, and waiting for its client.
+			j.client = client
+			return nil
+		} else if j != nil {
+			journaled = false
+		}
+	}
+	j := s.newJob(client, id, data, lower, upper)
+	j.journaled = journaled
+	s.jobs = append(s.jobs, j)
+	s.record(j, record{Kind: accepted, Job: id, Data: data, Lower: lower, Upper: upper})
+	return append(s.finish(j), s.assign()...)
+}
+
+// result records a miner's result for its current chunk. A result for any
+// other range is left over from a chunk the miner has been told to cancel,
+// and is ignored.
+func (s *scheduler) result(connID int, r *bitcoin.Message) []send {
+	m := s.miner(connID)
+	if m == nil || m.chunk == nil || !m.chunk.answeredBy(r) {
+		return nil
+	}
+	c := m.chunk
+	m.chunk = nil
+	c.miners = c.without(m)
+	if elapsed := s.now().Sub(m.started).Seconds(); elapsed > 0 {
+		measured := float64(c.size()) / elapsed
+		if m.rate == 0 {
+			m.rate = measured
+		} else {
+			m.rate = rateWeight*measured + (1-rateWeight)*m.rate
+		}
+	}
+	c.done = true
+	c.job.running--
+	c.job.mining -= float64(c.size())
+	c.job.merge(r.Hash, r.Nonce)
+	s.record(c.job, record{Kind: mined, Lower: c.lower, Upper: c.upper, Hash: r.Hash, Nonce: r.Nonce})
+	// Any other miner re-executing the chunk can stop.
+	sends := s.cancel(c)
+	sends = append(sends, s.finish(c.job)...)
+	return append(sends, s.assign()...)
+}
+
+// progress records a miner's progress report on its current chunk. Reports on
+// any other range are ignored, like results.
+func (s *scheduler) progress(connID int, r *bitcoin.Message) []send {
+	m := s.miner(connID)
+	if m == nil || m.chunk == nil || !m.chunk.answeredBy(r) || r.Processed <= m.processed ||
+		r.Scanned > r.Processed || r.Scanned > m.chunk.size() {
+		return nil
+	}
+	m.processed, m.scanned, m.reported = r.Processed, r.Scanned, s.now()
+	m.hash, m.nonce = r.Hash, r.Nonce
+	// The report may show that m is a straggler.
+	return s.assign()
+}
+
+// eta returns how many seconds from now j is expected to be done, or -1 if
+// that isn't known.
+func (s *scheduler) eta(j *job) float64 {
+	now := s.now()
+	var end float64
+	for _, m := range s.miners {
+		if m.chunk == nil || m.chunk.job != j {
+			continue
+		}
+		eta := m.eta(now)
+		if eta < 0 {
+			return -1
+		}
+		end = math.Max(end, eta)
+	}
+	if left := j.unassigned(); left > 0 {
+		return math.Max(end, s.finishTime(left))
+	}
+	return end
+}
+
+// cancel tells the miners working on c to stop, and leaves them idle.
+func (s *scheduler) cancel(c *chunk) []send {
+	var sends []send
+	for _, m := range c.miners {
+		m.chunk = nil
+		cancel := bitcoin.NewCancel(c.job.data, c.lower, c.upper)
+		cancel.Job = strconv.FormatUint(c.job.key, 10)
+		sends = append(sends, send{m.connID, cancel})
+	}
+	c.miners = nil
+	return sends
+}
+
+// removeMiner forgets a miner that has gone away, remembering its rate by its
+// ID. Unless another miner is also working on its chunk, the part of the chunk
+// that the miner hadn't reported scanning goes back to be reassigned, and the
+// best result it had reported is kept.
+func (s *scheduler) removeMiner(connID int) []send {
+	m := s.miner(connID)
+	if m == nil {
+		return nil
+	}
+	for i, other := range s.miners {
+		if other == m {
+			s.miners = append(s.miners[:i], s.miners[i+1:]...)
+			break
+		}
+	}
+	if m.id != "" && m.rate > 0 {
+		s.rates[m.id] = m.rate
+	}
+	var sends []send
+	if c := m.chunk; c != nil {
+		c.miners = c.without(m)
+		if !c.done && len(c.miners) == 0 {
+			// If m had scanned all of c, that may have been the last of
+			// the job.
+			s.requeue(m, c)
+			sends = s.finish(c.job)
+		} else if !c.done && m.processed > 0 {
+			c.job.merge(m.hash, m.nonce)
+		}
+	}
+	return append(sends, s.assign()...)
+}
+
+// requeue puts the part of c that m hadn't reported scanning back at the
+// front of its job's pending work, and keeps the best result m had reported.
+func (s *scheduler) requeue(m *miner, c *chunk) {
+	j := c.job
+	if m.processed > 0 {
+		j.merge(m.hash, m.nonce)
+	}
+	if m.scanned > 0 {
+		s.record(j, record{Kind: mined, Lower: c.lower, Upper: c.lower + m.scanned - 1, Hash: m.hash, Nonce: m.nonce})
+	}
+	j.running--
+	j.mining -= float64(c.size())
+	if m.scanned < c.size() {
+		j.pending = append([]nonceRange{{c.lower + m.scanned, c.upper}}, j.pending...)
+	}
+}
+
+// tick gives idle miners any work that has become worth doing with the
+// passage of time, namely re-executing stragglers' chunks.
+func (s *scheduler) tick() []send {
+	return s.assign()
+}
+
+// removeClient forgets the jobs of a client that has gone away, except that
+// journaled jobs are set aside in case the client asks for them again. Miners
+// working on their chunks are told to stop, and given other work at once.
+func (s *scheduler) removeClient(connID int) []send {
+	var sends []send
+	for _, m := range s.miners {
+		if c := m.chunk; c != nil && c.job.client == connID && !c.done {
+			s.requeue(m, c)
+			c.done = true
+			sends = append(sends, s.cancel(c)...)
+		}
+	}
+	for _, j := range append([]*job(nil), s.jobs...) {
+		if j.client != connID {
+			continue
+		}
+		if !j.journaled {
+			j.dropped = true
+			j.pending = nil
+			s.finish(j)
+			continue
+		}
+		s.remove(j)
+		j.client = noClient
+		s.saved[j.jobKey()] = j
+		s.record(j, record{Kind: dropped})
+	}
+	return append(sends, s.assign()...)
+}
+
+func (s *scheduler) remove(j *job) {
+	for i, other := range s.jobs {
+		if other == j {
+			s.jobs = append(s.jobs[:i], s.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// finish removes j if it is done, returning the reply to its client, if it
+// has one.
+func (s *scheduler) finish(j *job) []send {
+	if !j.done() {
+		return nil
+	}
+	s.remove(j)
+	result := bitcoin.NewResult(j.hash, j.nonce)
+	result.Job = j.id
+	if j.journaled {
+		s.answers[j.jobKey()] = storedAnswer{j.key, result}
+		s.record(j, record{Kind: answered, Job: j.id, Data: j.data, Lower: j.lower, Upper: j.upper, Hash: j.hash, Nonce: j.nonce})
+		if s.journal.due() {
+			s.journal.compact(s.snapshot())
+		}
+	}
+	if j.dropped || j.client == noClient {
+		return nil
+	}
+	return []send{{j.client, result}}
+}
+
+// assign gives a chunk to every idle miner while there is work to do.
+func (s *scheduler) assign() []send {
+	var sends []send
+	for _, m := range s.miners {
+		if m.chunk != nil {
+			continue
+		}
+		var c *chunk
+		if j := s.policy.next(s.jobs); j != nil {
+			c = &chunk{job: j, nonceRange: j.take(s.chunkSize(m, j))}
+			j.running++
+			j.mining += float64(c.size())
+		} else if c = s.straggler(); c == nil {
+			break
+		}
+		c.miners = append(c.miners, m)
+		m.chunk, m.started = c, s.now()
+		s.record(c.job, record{Kind: assigned, Lower: c.lower, Upper: c.upper, Miner: m.id})
+		m.processed, m.scanned = 0, 0
+		sends = append(sends, send{m.connID, c.request()})
+	}
+	return sends
+}
+
+// straggler returns the chunk that is expected to overrun the time its
+// miner's peers would take with as many workers by the most, if any is by more
+// than stragglerFactor, and it is not already being re-executed. A miner's
+// expected time is what it has taken so far, plus its ETA once it has
+// reported progress.
+func (s *scheduler) straggler() *chunk {
+	var worst *chunk
+	var worstFactor float64
+	for _, m := range s.miners {
+		c := m.chunk
+		if c == nil || c.done || len(c.miners) > 1 || c.job.dropped {
+			continue
+		}
+		peerRate := s.workerRate(m)
+		if peerRate == 0 {
+			continue
+		}
+		expected := float64(c.size()) / (peerRate * float64(m.workers))
+		taken := s.now().Sub(m.started).Seconds()
+		if m.processed > 0 {
+			taken += m.eta(s.now())
+		}
+		factor := taken / expected
+		if factor > stragglerFactor && factor > worstFactor {
+			worst, worstFactor = c, factor
+		}
+	}
+	return worst
+}
+
+// chunkSize returns the size of the next chunk of j to give to m.
+func (s *scheduler) chunkSize(m *miner, j *job) uint64 {
+	rate := m.rate
+	if rate == 0 {
+		// Until m has finished a chunk, guess its rate from its peers'.
+		if rate = s.workerRate(m) * float64(m.workers); rate == 0 {
+			return initialChunkSize * uint64(m.workers)
+		}
+	}
+	seconds := s.chunkTime.Seconds()
+	// If the miners between them would finish the job within a chunk, give
+	// m just enough to finish when the others are expected to.
+	if end := s.finishTime(j.unassigned()); end < seconds {
+		seconds = end
+	}
+	size := rate * seconds
+	if size < minChunkSize {
+		return minChunkSize
+	}
+	if size >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(size)
+}
+
+// workerRate returns the mean hash rate per worker of the miners other than m
+// whose rates are known, or 0 if there are none.
+func (s *scheduler) workerRate(m *miner) float64 {
+	var rate float64
+	var workers int
+	for _, other := range s.miners {
+		if other != m && other.rate > 0 {
+			rate += other.rate
+			workers += other.workers
+		}
+	}
+	if workers == 0 {
+		return 0
+	}
+	return rate / float64(workers)
+}
+
+// finishTime returns how many seconds from now the miners whose rates are
+// known would take to hash left more nonces, if each started on them as soon
+// as it finished its current chunk.
+func (s *scheduler) finishTime(left float64) float64 {
+	type capacity struct {
+		free float64 // Seconds from now until the miner is free.
+		rate float64
+	}
+	now := s.now()
+	var caps []capacity
+	for _, m := range s.miners {
+		if m.rate == 0 {
+			continue
+		}
+		c := capacity{rate: m.rate}
+		if m.chunk != nil {
+			c.free = m.eta(now)
+		}
+		caps = append(caps, c)
+	}
+	sort.Slice(caps, func(i, j int) bool { return caps[i].free < caps[j].free })
+	// Add miners in the order they become free until the work runs out
+	// before the next one would join in.
+	var rate, work float64
+	end := math.Inf(1)
+	for i, c := range caps {
+		rate += c.rate
+		work += c.rate * c.free
+		end = (left + work) / rate
+		if i+1 == len(caps) || end <= caps[i+1].free {
+			break
+		}
+	}
+	return end
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cmu440/bitcoin"
+)
+
+// fakeClock is a clock for the scheduler that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestScheduler() (*scheduler, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	return newScheduler(time.Second, fifo{}, clock.now), clock
+}
+
+// mine returns the minimum hash and its nonce over a request's range, with
+// ties going to the lowest nonce.
+func mine(msg *bitcoin.Message) (uint64, uint64) {
+	best, bestNonce := uint64(math.MaxUint64), msg.Lower
+	for nonce := msg.Lower; nonce <= msg.Upper; nonce++ {
+		if h := bitcoin.Hash(msg.Data, nonce); h < best {
+			best, bestNonce = h, nonce
+		}
+		if nonce == math.MaxUint64 {
+			break
+		}
+	}
+	return best, bestNonce
+}
+
+// requestFor returns the request sent to connID, failing the test if there
+// isn't exactly one.
+func requestFor(t *testing.T, sends []send, connID int) *bitcoin.Message {
+	t.Helper()
+	var found *bitcoin.Message
+	for _, s := range sends {
+		if s.connID == connID {
+			if found != nil {
+				t.Fatalf("Sent %s and %s to connection %d", found, s.msg, connID)
+			}
+			found = s.msg
+		}
+	}
+	if found == nil || found.Type != bitcoin.Request {
+		t.Fatalf("Sent %v to connection %d, expected a request", found, connID)
+	}
+	return found
+}
+
+// answer returns a miner's result for a request.
+func answer(req *bitcoin.Message, hash, nonce uint64) *bitcoin.Message {
+	r := bitcoin.NewResult(hash, nonce)
+	r.Job, r.Data, r.Lower, r.Upper = req.Job, req.Data, req.Lower, req.Upper
+	return r
+}
+
+// report returns a miner's progress report on a request.
+func report(req *bitcoin.Message, processed, scanned, hash, nonce uint64) *bitcoin.Message {
+	r := bitcoin.NewProgress(req.Data, req.Lower, req.Upper, processed, scanned, hash, nonce)
+	r.Job = req.Job
+	return r
+}
+
+// mineAll answers every request in queue, and the requests that follow,
+// advancing the clock by delay(miner) for each, and returns the reply sent to
+// client and the number of nonces mined.
+func mineAll(s *scheduler, clock *fakeClock, queue []send, client int, delay func(int) time.Duration) (*bitcoin.Message, uint64) {
+	var reply *bitcoin.Message
+	var mined uint64
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if next.connID == client {
+			reply = next.msg
+			continue
+		}
+		if next.msg.Type != bitcoin.Request {
+			continue
+		}
+		clock.advance(delay(next.connID))
+		hash, nonce := mine(next.msg)
+		mined += chunkSizeOf(next.msg)
+		queue = append(queue, s.result(next.connID, answer(next.msg, hash, nonce))...)
+	}
+	return reply, mined
+}
+
+// requestsFor returns the sends to connID.
+func requestsFor(sends []send, connID int) []send {
+	var found []send
+	for _, s := range sends {
+		if s.connID == connID {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+func chunkSizeOf(msg *bitcoin.Message) uint64 {
+	return msg.Upper - msg.Lower + 1
+}
+
+func TestSchedulerSizesChunksByHashRate(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.addMiner(1, "", 1, 0)
+	s.addMiner(2, "", 1, 0)
+	sends := s.addJob(10, "", "rate", 0, 1<<30)
+	first1, first2 := requestFor(t, sends, 1), requestFor(t, sends, 2)
+	if chunkSizeOf(first1) != initialChunkSize || chunkSizeOf(first2) != initialChunkSize {
+		t.Fatalf("First chunks are %s and %s, expected %d nonces each", first1, first2, initialChunkSize)
+	}
+	if first2.Lower != first1.Upper+1 {
+		t.Fatalf("Chunks %s and %s are not contiguous", first1, first2)
+	}
+
+	// Miner 1 is four times faster than miner 2.
+	clock.advance(16 * time.Millisecond)
+	next1 := requestFor(t, s.result(1, answer(first1, 5, first1.Lower)), 1)
+	clock.advance(48 * time.Millisecond)
+	next2 := requestFor(t, s.result(2, answer(first2, 7, first2.Lower)), 2)
+	size1, size2 := chunkSizeOf(next1), chunkSizeOf(next2)
+	if want := uint64(initialChunkSize / 0.016); size1 < want*99/100 || size1 > want*101/100 {
+		t.Errorf("Miner 1 got %d nonces, expected about %d", size1, want)
+	}
+	if ratio := float64(size1) / float64(size2); ratio < 3.9 || ratio > 4.1 {
+		t.Errorf("Miners got %d and %d nonces, expected a ratio of 4", size1, size2)
+	}
+}
+
+func TestSchedulerWeightsByWorkers(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.addMiner(1, "", 1, 0)
+	s.addMiner(2, "", 4, 0)
+	sends := s.addJob(10, "", "workers", 0, 1<<40)
+	first1, first2 := requestFor(t, sends, 1), requestFor(t, sends, 2)
+	if chunkSizeOf(first1) != initialChunkSize || chunkSizeOf(first2) != 4*initialChunkSize {
+		t.Fatalf("First chunks are %s and %s, expected %d and %d nonces", first1, first2, initialChunkSize, 4*initialChunkSize)
+	}
+
+	// Miner 1 mines 1M nonces/sec, so a new miner with 8 workers is expected
+	// to mine 8M.
+	clock.advance(time.Duration(initialChunkSize) * time.Microsecond)
+	s.result(1, answer(first1, 0, first1.Lower))
+	if size := chunkSizeOf(requestFor(t, s.addMiner(3, "", 8, 0), 3)); size != 8000000 {
+		t.Errorf("Miner 3 got %d nonces, expected 8000000", size)
+	}
+}
+
+func TestSchedulerWeightsStragglerByWorkers(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.addMiner(1, "", 1, 0)
+	s.addMiner(2, "", 4, 0)
+	sends := s.addJob(10, "", "workers", 0, 5*initialChunkSize-1)
+	first1, first2 := requestFor(t, sends, 1), requestFor(t, sends, 2)
+
+	// Miner 1 mines 1M nonces/sec, so miner 2 should take a quarter of what
+	// its chunk would take miner 1, and is a straggler after three times that.
+	clock.advance(time.Duration(initialChunkSize) * time.Microsecond)
+	if sends := s.result(1, answer(first1, 0, first1.Lower)); len(sends) != 0 {
+		t.Fatalf("Sent %v, expected nothing", sends)
+	}
+	clock.advance(2 * time.Duration(initialChunkSize) * time.Microsecond)
+	again := requestFor(t, s.tick(), 1)
+	if again.Lower != first2.Lower || again.Upper != first2.Upper {
+		t.Fatalf("Miner 1 got %s, expected miner 2's chunk %s", again, first2)
+	}
+}
+
+func TestSchedulerUsesJoinRate(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.addMiner(1, "miner", 1, 0)
+	first := requestFor(t, s.addJob(10, "", "rates", 0, 1<<40), 1)
+	if size := chunkSizeOf(requestFor(t, s.addMiner(2, "benchmarked", 1, 2e6), 2)); size != 2000000 {
+		t.Errorf("Miner 2 got %d nonces, expected its benchmarked rate of 2000000", size)
+	}
+
+	// Miner 1 mines 1M nonces/sec. When it comes back, that is remembered.
+	clock.advance(time.Duration(initialChunkSize) * time.Microsecond)
+	s.result(1, answer(first, 0, first.Lower))
+	s.removeMiner(1)
+	if size := chunkSizeOf(requestFor(t, s.addMiner(3, "miner", 1, 5e6), 3)); size != 1000000 {
+		t.Errorf("Miner 1 got %d nonces when it came back, expected 1000000", size)
+	}
+}
+
+func TestSchedulerProgressFindsStraggler(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.addMiner(1, "", 1, 1e6)
+	s.addMiner(2, "", 1, 1e6)
+	sends := s.addJob(10, "", "progress", 0, 2e6-1)
+	fast, slow := requestFor(t, sends, 1), requestFor(t, sends, 2)
+
+	// Miner 2 reports that it is going at a tenth of its rate.
+	clock.advance(100 * time.Millisecond)
+	s.progress(1, report(fast, 1e5, 0, 7, fast.Lower))
+	s.progress(2, report(slow, 1e4, 0, 7, slow.Lower))
+	if eta := s.eta(s.jobs[0]); eta < 9.89 || eta > 9.91 {
+		t.Errorf("ETA is %.2fs, expected 9.9s", eta)
+	}
+
+	// Once miner 1 is done, it is given miner 2's chunk at once, rather than
+	// after miner 2 has taken twice as long as it should have.
+	clock.advance(900 * time.Millisecond)
+	sends = s.result(1, answer(fast, 5, fast.Lower))
+	if again := requestFor(t, sends, 1); again.Lower != slow.Lower || again.Upper != slow.Upper {
+		t.Fatalf("Miner 1 got %s, expected miner 2's chunk %s", again, slow)
+	}
+}
+
+func TestSchedulerKeepsPartialResult(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.addMiner(1, "", 1, 0)
+	s.addMiner(2, "", 1, 0)
+	const upper = 2*initialChunkSize - 1
+	sends := s.addJob(10, "", "partial", 0, upper)
+	lost := requestFor(t, sends, 1)
+
+	// Miner 1 reports an (impossibly good) hash before it is lost. Its chunk
+	// is mined again, and the reported hash is still the answer.
+	s.progress(1, report(lost, 100, 0, 0, lost.Lower+7))
+	s.removeMiner(1)
+	reply, _ := mineAll(s, clock, sends, 10, func(int) time.Duration { return time.Millisecond })
+	if reply == nil || reply.Hash != 0 || reply.Nonce != lost.Lower+7 {
+		t.Fatalf("Client got %v, expected the partial result [Result 0 %d]", reply, lost.Lower+7)
+	}
+}
+
+func TestSchedulerResumesLostChunk(t *testing.T) {
+	const upper = 3*initialChunkSize - 1
+	want, wantNonce := mine(bitcoin.NewRequest("resume", 0, upper))
+	for _, scanned := range []uint64{0, 1, initialChunkSize / 4, initialChunkSize / 2, initialChunkSize - 1, initialChunkSize} {
+		s, clock := newTestScheduler()
+		s.addMiner(1, "", 1, 0)
+		s.addMiner(2, "", 1, 0)
+		sends := s.addJob(10, "", "resume", 0, upper)
+		lost := requestFor(t, sends, 1)
+
+		// Miner 1 reports truthfully on the nonces it has scanned, and is
+		// then lost. Only the rest of its chunk is mined again.
+		if scanned > 0 {
+			hash, nonce := mine(bitcoin.NewRequest(lost.Data, lost.Lower, lost.Lower+scanned-1))
+			s.progress(1, report(lost, scanned, scanned, hash, nonce))
+		}
+		queue := append(requestsFor(sends, 2), s.removeMiner(1)...)
+		var reply *bitcoin.Message
+		var remined uint64
+		for len(queue) > 0 {
+			next := queue[0]
+			queue = queue[1:]
+			if next.connID == 10 {
+				reply = next.msg
+				continue
+			}
+			if next.msg.Lower >= lost.Lower && next.msg.Upper <= lost.Upper {
+				if next.msg.Lower < lost.Lower+scanned {
+					t.Errorf("Lost after scanning %d: %s was mined again", scanned, next.msg)
+				}
+				remined += chunkSizeOf(next.msg)
+			}
+			clock.advance(time.Millisecond)
+			hash, nonce := mine(next.msg)
+			queue = append(queue, s.result(next.connID, answer(next.msg, hash, nonce))...)
+		}
+		if remined != initialChunkSize-scanned {
+			t.Errorf("Lost after scanning %d: %d nonces were mined again, expected %d", scanned, remined, initialChunkSize-scanned)
+		}
+		if reply == nil || reply.Hash != want || reply.Nonce != wantNonce {
+			t.Errorf("Lost after scanning %d: client got %v, expected %s", scanned, reply, bitcoin.NewResult(want, wantNonce))
+		}
+	}
+}
+
+func TestSchedulerAnswersAfterFullyScannedLoss(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.addMiner(1, "", 1, 0)
+	s.addMiner(2, "", 1, 0)
+	const upper = 2*initialChunkSize - 1
+	sends := s.addJob(10, "", "scanned", 0, upper)
+	lost, other := requestFor(t, sends, 1), requestFor(t, sends, 2)
+	clock.advance(time.Millisecond)
+	hash, nonce := mine(other)
+	if sends := s.result(2, answer(other, hash, nonce)); len(sends) != 0 {
+		t.Fatalf("Sent %v, expected nothing", sends)
+	}
+
+	// Miner 1 reports that it has scanned all of the last chunk, and is lost
+	// before its result arrives. The client gets its answer at once.
+	hash, nonce = mine(lost)
+	s.progress(1, report(lost, chunkSizeOf(lost), chunkSizeOf(lost), hash, nonce))
+	sends = s.removeMiner(1)
+	want, wantNonce := mine(bitcoin.NewRequest("scanned", 0, upper))
+	if len(sends) != 1 || sends[0].connID != 10 || sends[0].msg.Hash != want || sends[0].msg.Nonce != wantNonce {
+		t.Fatalf("Sent %v, expected %s to the client", sends, bitcoin.NewResult(want, wantNonce))
+	}
+}
+
+func TestSchedulerSplitsTheEndByHashRate(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.addMiner(1, "", 1, 0)
+	s.addMiner(2, "", 1, 0)
+	// Learn the miners' rates from a first job: 1M and 250K nonces/sec.
+	sends := s.addJob(10, "", "warm up", 0, 2*initialChunkSize-1)
+	clock.advance(time.Duration(initialChunkSize) * time.Microsecond)
+	warm1 := requestFor(t, sends, 1)
+	s.result(1, answer(warm1, 0, warm1.Lower))
+	clock.advance(3 * time.Duration(initialChunkSize) * time.Microsecond)
+	warm2 := requestFor(t, sends, 2)
+	s.result(2, answer(warm2, 0, warm2.Lower))
+
+	// 500K nonces takes the two of them 0.4 seconds, less than a chunk, so
+	// it should be split 4:1.
+	sends = s.addJob(11, "", "tail", 0, 500000-1)
+	size1, size2 := chunkSizeOf(requestFor(t, sends, 1)), chunkSizeOf(requestFor(t, sends, 2))
+	if size1 != 400000 {
+		t.Errorf("Miner 1 got %d nonces, expected 400000", size1)
+	}
+	if size2 < 99000 || size2 > 100000 {
+		t.Errorf("Miner 2 got %d nonces, expected about 100000", size2)
+	}
+}
+
+func TestSchedulerMergesMinimum(t *testing.T) {
+	s, clock := newTestScheduler()
+	miners := []int{1, 2, 3}
+	for _, m := range miners {
+		s.addMiner(m, "", 1, 0)
+	}
+	const upper = 60000
+	reply, _ := mineAll(s, clock, s.addJob(10, "", "merge", 0, upper), 10, func(m int) time.Duration {
+		return time.Duration(m) * time.Millisecond
+	})
+	hash, nonce := mine(bitcoin.NewRequest("merge", 0, upper))
+	if reply == nil || reply.Type != bitcoin.Result || reply.Hash != hash || reply.Nonce != nonce {
+		t.Fatalf("Client got %v, expected %s", reply, bitcoin.NewResult(hash, nonce))
+	}
+}
+
+func TestSchedulerPipelinesJobs(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.policy = &roundRobin{}
+	s.addMiner(1, "", 1, 0)
+	s.addMiner(2, "", 1, 0)
+	// One client sends three requests without waiting, the first of them
+	// much bigger than the others.
+	sizes := map[string]uint64{"big": 16 * initialChunkSize, "small": initialChunkSize, "medium": 3 * initialChunkSize}
+	var queue []send
+	for _, id := range []string{"big", "small", "medium"} {
+		queue = append(queue, s.addJob(10, id, "pipeline "+id, 0, sizes[id]-1)...)
+	}
+	var replies []*bitcoin.Message
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if next.connID == 10 {
+			replies = append(replies, next.msg)
+			continue
+		}
+		clock.advance(time.Millisecond)
+		hash, nonce := mine(next.msg)
+		queue = append(queue, s.result(next.connID, answer(next.msg, hash, nonce))...)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("Client got %v, expected three results", replies)
+	}
+	if replies[0].Job != "small" || replies[2].Job != "big" {
+		t.Errorf("Client got results for %s, %s and %s, expected small first and big last", replies[0].Job, replies[1].Job, replies[2].Job)
+	}
+	for _, reply := range replies {
+		hash, nonce := mine(bitcoin.NewRequest("pipeline "+reply.Job, 0, sizes[reply.Job]-1))
+		if reply.Hash != hash || reply.Nonce != nonce {
+			t.Errorf("Client got %s for job %s, expected %s", reply, reply.Job, bitcoin.NewResult(hash, nonce))
+		}
+	}
+}
+
+func TestSchedulerScopesJobIDsByClient(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.policy = &roundRobin{}
+	queue := append(s.addMiner(1, "", 1, 0), s.addMiner(2, "", 1, 0)...)
+	// Two clients use the same job ID at once, for different data.
+	for _, client := range []int{10, 20} {
+		queue = append(queue, s.addJob(client, "job", fmt.Sprintf("client %d", client), 0, 2*initialChunkSize-1)...)
+	}
+	replies := make(map[int]*bitcoin.Message)
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if next.msg.Type == bitcoin.Result {
+			if replies[next.connID] != nil {
+				t.Fatalf("Sent client %d a second result, %s", next.connID, next.msg)
+			}
+			replies[next.connID] = next.msg
+			continue
+		}
+		clock.advance(time.Millisecond)
+		hash, nonce := mine(next.msg)
+		queue = append(queue, s.result(next.connID, answer(next.msg, hash, nonce))...)
+	}
+	for _, client := range []int{10, 20} {
+		hash, nonce := mine(bitcoin.NewRequest(fmt.Sprintf("client %d", client), 0, 2*initialChunkSize-1))
+		if reply := replies[client]; reply == nil || reply.Hash != hash || reply.Nonce != nonce || reply.Job != "job" {
+			t.Errorf("Client %d got %v, expected %s", client, reply, bitcoin.NewResult(hash, nonce))
+		}
+	}
+}
+
+func TestSchedulerDropsClient(t *testing.T) {
+	s, _ := newTestScheduler()
+	s.addMiner(1, "", 1, 0)
+	first := requestFor(t, s.addJob(10, "", "dropped", 0, 1<<30), 1)
+	s.removeClient(10)
+	if sends := s.result(1, answer(first, 0, first.Lower)); len(sends) != 0 {
+		t.Fatalf("Sent %v after the client went away, expected nothing", sends)
+	}
+	if len(s.jobs) != 0 {
+		t.Fatalf("Scheduler still has %d jobs", len(s.jobs))
+	}
+}
+
+func TestSchedulerCancelsDroppedClient(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.addMiner(1, "", 1, 0)
+	s.addMiner(2, "", 1, 0)
+	sends := s.addJob(10, "", "dropped", 0, 1<<30)
+	old1, old2 := requestFor(t, sends, 1), requestFor(t, sends, 2)
+	s.addJob(11, "", "waiting", 0, 1<<20)
+
+	// Both miners are told to stop, and go straight on to the other client's
+	// request.
+	sends = s.removeClient(10)
+	for i, m := range []int{1, 2} {
+		if sends[i].connID != m || sends[i].msg.Type != bitcoin.Cancel {
+			t.Fatalf("Sent %v, expected cancels to miners 1 and 2 first", sends)
+		}
+	}
+	if sends[0].msg.Lower != old1.Lower || sends[1].msg.Upper != old2.Upper {
+		t.Fatalf("Sent %v, expected cancels of %s and %s", sends, old1, old2)
+	}
+	new1 := requestFor(t, sends[2:], 1)
+	if new1.Data != "waiting" || requestFor(t, sends[2:], 2).Data != "waiting" {
+		t.Fatalf("Sent %v, expected requests for the waiting job", sends)
+	}
+
+	// A result for the cancelled chunk that crossed with the cancel is
+	// ignored, and the new chunk is unaffected.
+	if sends := s.result(1, answer(old1, 0, old1.Lower)); len(sends) != 0 {
+		t.Fatalf("Sent %v for a cancelled chunk, expected nothing", sends)
+	}
+	clock.advance(10 * time.Millisecond)
+	hash, nonce := mine(new1)
+	sends = s.result(1, answer(new1, hash, nonce))
+	if next := requestFor(t, sends, 1); next.Data != "waiting" || next.Lower <= new1.Upper {
+		t.Fatalf("Miner 1 got %s after %s, expected the next chunk", next, new1)
+	}
+}
+
+func TestSchedulerReassignsLostChunk(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.addMiner(1, "", 1, 0)
+	s.addMiner(2, "", 1, 0)
+	const upper = 3*initialChunkSize - 1
+	sends := s.addJob(10, "", "lost", 0, upper)
+	lost := requestFor(t, sends, 1)
+	first2 := requestFor(t, sends, 2)
+
+	// Miner 1 is lost, so its chunk goes to miner 2 once it is done.
+	if sends := s.removeMiner(1); len(sends) != 0 {
+		t.Fatalf("Sent %v with no idle miners, expected nothing", sends)
+	}
+	clock.advance(10 * time.Millisecond)
+	hash, nonce := mine(first2)
+	sends = s.result(2, answer(first2, hash, nonce))
+	if again := requestFor(t, sends, 2); again.Lower != lost.Lower || again.Upper != lost.Upper {
+		t.Fatalf("Miner 2 got %s, expected miner 1's lost chunk %s", again, lost)
+	}
+
+	// A late result from the lost miner is ignored.
+	if sends := s.result(1, answer(lost, 0, 0)); len(sends) != 0 {
+		t.Fatalf("Sent %v for a lost miner's result, expected nothing", sends)
+	}
+
+	reply, _ := mineAll(s, clock, sends, 10, func(int) time.Duration { return 10 * time.Millisecond })
+	hash, nonce = mine(bitcoin.NewRequest("lost", 0, upper))
+	if reply == nil || reply.Hash != hash || reply.Nonce != nonce {
+		t.Fatalf("Client got %v, expected %s", reply, bitcoin.NewResult(hash, nonce))
+	}
+}
+
+func TestSchedulerSpeculatesStraggler(t *testing.T) {
+	s, clock := newTestScheduler()
+	s.addMiner(1, "", 1, 0)
+	s.addMiner(2, "", 1, 0)
+	sends := s.addJob(10, "", "straggler", 0, 2*initialChunkSize-1)
+	slow, fast := requestFor(t, sends, 1), requestFor(t, sends, 2)
+
+	// Miner 2 finishes its chunk in 10ms. Miner 1 has been going for only
+	// twice as long, so it isn't a straggler yet.
+	clock.advance(10 * time.Millisecond)
+	if sends := s.result(2, answer(fast, 5, fast.Lower)); len(sends) != 0 {
+		t.Fatalf("Sent %v, expected nothing", sends)
+	}
+	clock.advance(10 * time.Millisecond)
+	if sends := s.tick(); len(sends) != 0 {
+		t.Fatalf("Sent %v before miner 1 was a straggler, expected nothing", sends)
+	}
+	clock.advance(20 * time.Millisecond)
+	again := requestFor(t, s.tick(), 2)
+	if again.Lower != slow.Lower || again.Upper != slow.Upper {
+		t.Fatalf("Miner 2 got %s, expected miner 1's chunk %s", again, slow)
+	}
+	if sends := s.tick(); len(sends) != 0 {
+		t.Fatalf("Sent %v with no idle miners, expected nothing", sends)
+	}
+
+	// Miner 2 finishes first, so miner 1 is told to cancel, and the client
+	// gets its answer. Miner 1's result, if sent anyway, is ignored.
+	clock.advance(10 * time.Millisecond)
+	sends = s.result(2, answer(slow, 3, slow.Lower))
+	if len(sends) != 2 || sends[0].connID != 1 || sends[0].msg.Type != bitcoin.Cancel ||
+		sends[1].connID != 10 || sends[1].msg.Hash != 3 {
+		t.Fatalf("Sent %v, expected a cancel to miner 1 and a result of hash 3 to the client", sends)
+	}
+	if sends := s.result(1, answer(slow, 1, slow.Lower)); len(sends) != 0 {
+		t.Fatalf("Sent %v for a result already counted, expected nothing", sends)
+	}
+}
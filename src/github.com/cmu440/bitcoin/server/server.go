@@ -1,35 +1,156 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cmu440/bitcoin"
 	"github.com/cmu440/lsp"
 )
 
 type server struct {
 	lspServer lsp.Server
+	sched     *scheduler
+	clients   map[int]bool // Connection IDs of clients, as opposed to miners.
 }
 
+var (
+	policyName  = flag.String("policy", defaultPolicy, "scheduling policy: "+policyNames())
+	journalPath = flag.String("journal", "", "file to journal requests with job IDs to, and to recover them from on restart")
+)
+
 func startServer(port int) (*server, error) {
-	// TODO: implement this!
+	p, err := newPolicy(*policyName)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := newServer(port, lsp.NewParams(), p, defaultChunkTime)
+	if err != nil || *journalPath == "" {
+		return srv, err
+	}
+	jn, records, err := openJournal(*journalPath)
+	if err != nil {
+		srv.lspServer.Close()
+		return nil, err
+	}
+	srv.sched.journal = jn
+	srv.sched.restore(records)
+	return srv, nil
+}
+
+func newServer(port int, params *lsp.Params, p policy, chunkTime time.Duration) (*server, error) {
+	lspServer, err := lsp.NewServer(port, params)
+	if err != nil {
+		return nil, err
+	}
+	return &server{
+		lspServer: lspServer,
+		sched:     newScheduler(chunkTime, p, time.Now),
+		clients:   make(map[int]bool),
+	}, nil
+}
+
+type read struct {
+	connID  int
+	payload []byte
+	err     error
+}
 
-	return nil, nil
+// run handles messages from clients and miners until the server is closed.
+func (srv *server) run() {
+	reads := make(chan read)
+	go func() {
+		for {
+			connID, payload, err := srv.lspServer.Read()
+			reads <- read{connID, payload, err}
+			if err != nil && connID == 0 {
+				return
+			}
+		}
+	}()
+	// Stragglers are looked for a few times per chunk.
+	ticker := time.NewTicker(srv.sched.chunkTime / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			srv.send(srv.sched.tick())
+		case r := <-reads:
+			if r.err != nil && r.connID == 0 {
+				return
+			}
+			srv.handle(r)
+		}
+	}
 }
 
-var LOGF *log.Logger
+func (srv *server) handle(r read) {
+	if r.err != nil {
+		LOGF.Printf("Connection %d lost: %s", r.connID, r.err)
+		if srv.clients[r.connID] {
+			delete(srv.clients, r.connID)
+			srv.send(srv.sched.removeClient(r.connID))
+		} else {
+			srv.send(srv.sched.removeMiner(r.connID))
+		}
+		return
+	}
+	var msg bitcoin.Message
+	if err := json.Unmarshal(r.payload, &msg); err != nil {
+		LOGF.Printf("Bad message from connection %d: %s", r.connID, err)
+		return
+	}
+	LOGF.Printf("Read %s from connection %d", &msg, r.connID)
+	switch msg.Type {
+	case bitcoin.Join:
+		srv.send(srv.sched.addMiner(r.connID, msg.MinerID, msg.Workers, msg.Rate))
+	case bitcoin.Request:
+		srv.clients[r.connID] = true
+		srv.send(srv.sched.addJob(r.connID, msg.Job, msg.Data, msg.Lower, msg.Upper))
+	case bitcoin.Result:
+		srv.send(srv.sched.result(r.connID, &msg))
+	case bitcoin.Progress:
+		srv.send(srv.sched.progress(r.connID, &msg))
+		if m := srv.sched.miner(r.connID); m != nil && m.chunk != nil {
+			LOGF.Printf("Request from connection %d expected in %.1fs", m.chunk.job.client, srv.sched.eta(m.chunk.job))
+		}
+	}
+}
+
+// send writes messages, ignoring errors: lost connections are reported by
+// Read, and dealt with there.
+func (srv *server) send(sends []send) {
+	for _, s := range sends {
+		payload, err := json.Marshal(s.msg)
+		if err != nil {
+			continue
+		}
+		LOGF.Printf("Writing %s to connection %d", s.msg, s.connID)
+		srv.lspServer.Write(s.connID, payload)
+	}
+}
+
+// LOGF discards everything until main opens the log file.
+var LOGF = log.New(ioutil.Discard, "", 0)
 
 func main() {
+	flag.Parse()
+
 	// You may need a logger for debug purpose
 	const (
 		name = "serverLog.txt"
-		flag = os.O_RDWR | os.O_CREATE
+		mode = os.O_RDWR | os.O_CREATE
 		perm = os.FileMode(0666)
 	)
 
-	file, err := os.OpenFile(name, flag, perm)
+	file, err := os.OpenFile(name, mode, perm)
 	if err != nil {
 		return
 	}
@@ -38,13 +159,13 @@ func main() {
 	LOGF = log.New(file, "", log.Lshortfile|log.Lmicroseconds)
 	// Usage: LOGF.Println() or LOGF.Printf()
 
-	const numArgs = 2
-	if len(os.Args) != numArgs {
-		fmt.Printf("Usage: ./%s <port>", os.Args[0])
+	const numArgs = 1
+	if flag.NArg() != numArgs {
+		fmt.Printf("Usage: ./%s [-policy=%s] [-journal=file] <port>", os.Args[0], strings.ReplaceAll(policyNames(), ", ", "|"))
 		return
 	}
 
-	port, err := strconv.Atoi(os.Args[1])
+	port, err := strconv.Atoi(flag.Arg(0))
 	if err != nil {
 		fmt.Println("Port must be a number:", err)
 		return
@@ -58,6 +179,7 @@ func main() {
 	fmt.Println("Server listening on port", port)
 
 	defer srv.lspServer.Close()
+	defer srv.sched.journal.close()
 
-	// TODO: implement this!
+	srv.run()
 }
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/bitcoin"
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+// These tests run the server over LSP with simple miners, and cut miners off
+// partway through a request by isolating them in lspnet, so that the server
+// sees their connections time out.
+
+// testEpoch is the length of an epoch in testParams.
+const testEpoch = 100 * time.Millisecond
+
+func testParams() *lsp.Params {
+	return &lsp.Params{
+		EpochLimit:         5,
+		EpochMillis:        int(testEpoch / time.Millisecond),
+		WindowSize:         5,
+		MaxBackOffInterval: 0,
+		MaxUnackedMessages: 5,
+	}
+}
+
+type testSystem struct {
+	t        *testing.T
+	srv      *server
+	hostport string
+}
+
+func newTestSystem(t *testing.T) *testSystem {
+	var srv *server
+	var port int
+	var err error
+	for i := 0; i < 5 && srv == nil; i++ {
+		port = 3000 + rand.Intn(50000)
+		srv, err = newServer(port, testParams(), &roundRobin{}, 100*time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	go srv.run()
+	t.Cleanup(func() {
+		lspnet.Heal()
+		srv.lspServer.Close()
+	})
+	return &testSystem{t: t, srv: srv, hostport: lspnet.JoinHostPort("localhost", strconv.Itoa(port))}
+}
+
+func (ts *testSystem) dial() lsp.Client {
+	cli, err := lsp.NewClient(ts.hostport, rand.Intn(256), testParams())
+	if err != nil {
+		ts.t.Fatalf("Failed to connect to server: %s", err)
+	}
+	return cli
+}
+
+func (ts *testSystem) write(cli lsp.Client, msg *bitcoin.Message) {
+	payload, _ := json.Marshal(msg)
+	if err := cli.Write(payload); err != nil {
+		ts.t.Fatalf("Failed to write %s: %s", msg, err)
+	}
+}
+
+// startMiner starts a miner that mines every request it reads, and returns
+// its local address.
+func (ts *testSystem) startMiner() string {
+	before := make(map[string]bool)
+	for _, addr := range lspnet.ClientAddrs() {
+		before[addr] = true
+	}
+	cli := ts.dial()
+	var addr string
+	for _, a := range lspnet.ClientAddrs() {
+		if !before[a] {
+			addr = a
+		}
+	}
+	ts.write(cli, bitcoin.NewJoinWithInfo(addr, 1, 0))
+	go func() {
+		defer cli.Close()
+		for {
+			payload, err := cli.Read()
+			if err != nil {
+				return
+			}
+			var msg bitcoin.Message
+			json.Unmarshal(payload, &msg)
+			if msg.Type != bitcoin.Request {
+				// Cancels arrive after the request has been mined.
+				continue
+			}
+			hash, nonce := mine(&msg)
+			payload, _ = json.Marshal(answer(&msg, hash, nonce))
+			if cli.Write(payload) != nil {
+				return
+			}
+		}
+	}()
+	return addr
+}
+
+// request sends a request from a new client, and returns a channel on which
+// the answer (or nil, if the connection is lost) is sent.
+func (ts *testSystem) request(data string, upper uint64) <-chan *bitcoin.Message {
+	cli := ts.dial()
+	ts.t.Cleanup(func() { cli.Close() })
+	ts.write(cli, bitcoin.NewRequest(data, 0, upper))
+	got := make(chan *bitcoin.Message, 1)
+	go func() {
+		payload, err := cli.Read()
+		if err != nil {
+			got <- nil
+			return
+		}
+		var msg bitcoin.Message
+		json.Unmarshal(payload, &msg)
+		got <- &msg
+	}()
+	return got
+}
+
+// expect checks the answer to a request.
+func (ts *testSystem) expect(got <-chan *bitcoin.Message, data string, upper uint64, timeout time.Duration) {
+	hash, nonce := mine(bitcoin.NewRequest(data, 0, upper))
+	select {
+	case msg := <-got:
+		if msg == nil || msg.Type != bitcoin.Result || msg.Hash != hash || msg.Nonce != nonce {
+			ts.t.Fatalf("Client got %v, expected %s", msg, bitcoin.NewResult(hash, nonce))
+		}
+	case <-time.After(timeout):
+		ts.t.Fatalf("Client got no answer within %s", timeout)
+	}
+}
+
+func TestServerPipelinedJobs(t *testing.T) {
+	ts := newTestSystem(t)
+	ts.startMiner()
+	ts.startMiner()
+	cli := ts.dial()
+	t.Cleanup(func() { cli.Close() })
+	uppers := map[string]uint64{"first": 400000, "second": 20000, "third": 100000}
+	for _, job := range []string{"first", "second", "third"} {
+		req := bitcoin.NewRequest("pipelined "+job, 0, uppers[job])
+		req.Job = job
+		ts.write(cli, req)
+	}
+	for range uppers {
+		payload, err := cli.Read()
+		if err != nil {
+			t.Fatalf("Client lost its connection: %s", err)
+		}
+		var msg bitcoin.Message
+		json.Unmarshal(payload, &msg)
+		upper, ok := uppers[msg.Job]
+		if !ok {
+			t.Fatalf("Client got %s for job %q, expected one of the outstanding jobs", &msg, msg.Job)
+		}
+		delete(uppers, msg.Job)
+		hash, nonce := mine(bitcoin.NewRequest("pipelined "+msg.Job, 0, upper))
+		if msg.Hash != hash || msg.Nonce != nonce {
+			t.Errorf("Client got %s for job %s, expected %s", &msg, msg.Job, bitcoin.NewResult(hash, nonce))
+		}
+	}
+}
+
+func TestServerMinerLost(t *testing.T) {
+	ts := newTestSystem(t)
+	victim := ts.startMiner()
+	ts.startMiner()
+	ts.startMiner()
+	lspnet.RunSchedule(testEpoch, lspnet.Step{Epochs: 2, Do: func() { lspnet.Isolate(victim) }})
+	ts.expect(ts.request("miner lost", 1500000), "miner lost", 1500000, 20*time.Second)
+}
+
+func TestServerAllMinersLost(t *testing.T) {
+	ts := newTestSystem(t)
+	first, second := ts.startMiner(), ts.startMiner()
+	lspnet.RunSchedule(testEpoch, lspnet.Step{Epochs: 2, Do: func() {
+		lspnet.Isolate(first)
+		lspnet.Isolate(second)
+	}})
+	got := ts.request("all miners lost", 1000000)
+	// Once both connections have timed out, a new miner finishes the job.
+	time.Sleep(1500 * time.Millisecond)
+	ts.startMiner()
+	ts.expect(got, "all miners lost", 1000000, 20*time.Second)
+}
+
+// The tests below drive the server one message at a time over a fake LSP
+// server, as the scheduler tests do, so that a miner is lost at exactly the
+// moment the test chooses.
+
+// fakeLSPServer records what the server writes, and reads nothing: the tests
+// hand messages to the server's handle method themselves.
+type fakeLSPServer struct {
+	written []send
+}
+
+func (f *fakeLSPServer) Read() (int, []byte, error) {
+	return 0, nil, errors.New("fake server has nothing to read")
+}
+
+func (f *fakeLSPServer) Write(connID int, payload []byte) error {
+	msg := new(bitcoin.Message)
+	if err := json.Unmarshal(payload, msg); err != nil {
+		return err
+	}
+	f.written = append(f.written, send{connID, msg})
+	return nil
+}
+
+func (f *fakeLSPServer) CloseConn(connID int) error { return nil }
+
+func (f *fakeLSPServer) Close() error { return nil }
+
+// newFakeServer returns a server over a fake LSP server, scheduling with a
+// fake clock.
+func newFakeServer() (*server, *fakeLSPServer, *fakeClock) {
+	sched, clock := newTestScheduler()
+	fake := new(fakeLSPServer)
+	return &server{lspServer: fake, sched: sched, clients: make(map[int]bool)}, fake, clock
+}
+
+// deliver hands msg from connID to srv, and returns what srv wrote as a result.
+func deliver(srv *server, fake *fakeLSPServer, connID int, msg *bitcoin.Message) []send {
+	payload, _ := json.Marshal(msg)
+	srv.handle(read{connID: connID, payload: payload})
+	written := fake.written
+	fake.written = nil
+	return written
+}
+
+// lose tells srv that connID's connection has been lost, and returns what srv
+// wrote as a result.
+func lose(srv *server, fake *fakeLSPServer, connID int) []send {
+	srv.handle(read{connID: connID, err: errors.New("connection lost")})
+	written := fake.written
+	fake.written = nil
+	return written
+}
+
+// mineWritten mines every request in queue, and the requests that follow,
+// and returns the reply written to client.
+func mineWritten(srv *server, fake *fakeLSPServer, clock *fakeClock, queue []send, client int) *bitcoin.Message {
+	var reply *bitcoin.Message
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if next.connID == client {
+			reply = next.msg
+		} else if next.msg.Type == bitcoin.Request {
+			clock.advance(time.Millisecond)
+			hash, nonce := mine(next.msg)
+			queue = append(queue, deliver(srv, fake, next.connID, answer(next.msg, hash, nonce))...)
+		}
+	}
+	return reply
+}
+
+func TestServerRequeuesLostMinersChunk(t *testing.T) {
+	srv, fake, clock := newFakeServer()
+	deliver(srv, fake, 1, bitcoin.NewJoin())
+	deliver(srv, fake, 2, bitcoin.NewJoin())
+	const upper = 3*initialChunkSize - 1
+	sends := deliver(srv, fake, 10, bitcoin.NewRequest("requeued", 0, upper))
+	lost, first2 := requestFor(t, sends, 1), requestFor(t, sends, 2)
+
+	// Miner 1's connection is lost, so its chunk is mined by miner 2 once
+	// it is free.
+	if sends := lose(srv, fake, 1); len(sends) != 0 {
+		t.Fatalf("Wrote %v with no idle miners, expected nothing", sends)
+	}
+	clock.advance(time.Millisecond)
+	hash, nonce := mine(first2)
+	sends = deliver(srv, fake, 2, answer(first2, hash, nonce))
+	if again := requestFor(t, sends, 2); again.Lower != lost.Lower || again.Upper != lost.Upper {
+		t.Fatalf("Miner 2 got %s, expected miner 1's lost chunk %s", again, lost)
+	}
+	want, wantNonce := mine(bitcoin.NewRequest("requeued", 0, upper))
+	if reply := mineWritten(srv, fake, clock, sends, 10); reply == nil || reply.Hash != want || reply.Nonce != wantNonce {
+		t.Fatalf("Client got %v, expected %s", reply, bitcoin.NewResult(want, wantNonce))
+	}
+}
+
+func TestServerRequeuesChunksOfAllLostMiners(t *testing.T) {
+	srv, fake, clock := newFakeServer()
+	deliver(srv, fake, 1, bitcoin.NewJoin())
+	deliver(srv, fake, 2, bitcoin.NewJoin())
+	const upper = 3*initialChunkSize - 1
+	sends := deliver(srv, fake, 10, bitcoin.NewRequest("all lost", 0, upper))
+	lost1, lost2 := requestFor(t, sends, 1), requestFor(t, sends, 2)
+
+	// With every miner gone, the lost chunks wait for a new one, which
+	// mines them before the rest of the job.
+	lose(srv, fake, 1)
+	lose(srv, fake, 2)
+	sends = deliver(srv, fake, 3, bitcoin.NewJoin())
+	lostChunks := map[uint64]uint64{lost1.Lower: lost1.Upper, lost2.Lower: lost2.Upper}
+	for i := 0; i < 2; i++ {
+		next := requestFor(t, sends, 3)
+		if upper, ok := lostChunks[next.Lower]; !ok || upper != next.Upper {
+			t.Fatalf("New miner got %s, expected one of the lost chunks %s and %s", next, lost1, lost2)
+		}
+		delete(lostChunks, next.Lower)
+		clock.advance(time.Millisecond)
+		hash, nonce := mine(next)
+		sends = deliver(srv, fake, 3, answer(next, hash, nonce))
+	}
+	want, wantNonce := mine(bitcoin.NewRequest("all lost", 0, upper))
+	if reply := mineWritten(srv, fake, clock, sends, 10); reply == nil || reply.Hash != want || reply.Nonce != wantNonce {
+		t.Fatalf("Client got %v, expected %s", reply, bitcoin.NewResult(want, wantNonce))
+	}
+}
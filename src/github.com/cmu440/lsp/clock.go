@@ -0,0 +1,51 @@
+// DO NOT MODIFY THIS FILE!
+
+package lsp
+
+import (
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+// FakeClock is a virtual clock measured in epochs. Time only passes when a
+// test calls AdvanceEpoch, so epoch-exact behavior (retransmissions,
+// exponential backoff, connection timeouts) can be checked without sleeping
+// through the epochs.
+//
+// AdvanceEpoch returns once every epoch ticker has taken its tick, so that
+// each epoch starts in order even if the implementation is slow to read its
+// ticker.
+type FakeClock struct {
+	*lspnet.VirtualClock
+	epoch time.Duration
+}
+
+// NewFakeClock returns a FakeClock whose epochs are params.EpochMillis long,
+// and installs it as params.Clock.
+func NewFakeClock(params *Params) *FakeClock {
+	c := &FakeClock{
+		VirtualClock: lspnet.NewVirtualClock(time.Unix(0, 0)),
+		epoch:        time.Duration(params.EpochMillis) * time.Millisecond,
+	}
+	params.Clock = c
+	return c
+}
+
+// tickWait bounds how long AdvanceEpoch waits for a ticker that is never read,
+// such as one that a closed client or server forgot to stop.
+const tickWait = time.Second
+
+// AdvanceEpoch moves the clock forward by exactly one epoch, and waits for the
+// epoch tickers to take their ticks.
+func (c *FakeClock) AdvanceEpoch() {
+	c.Advance(c.epoch)
+	c.AwaitTicks(tickWait)
+}
+
+// AdvanceEpochs moves the clock forward by n epochs, one at a time.
+func (c *FakeClock) AdvanceEpochs(n int) {
+	for i := 0; i < n; i++ {
+		c.AdvanceEpoch()
+	}
+}
@@ -0,0 +1,154 @@
+// Leak checking for the test systems.
+
+// Client.Close and Server.Close promise that all of the goroutines running
+// in the background exit once they return. A leakChecker takes a snapshot of
+// the running goroutines and open lspnet sockets when a test starts, and
+// fails the test if, once everything has been closed, any goroutine started
+// by the LSP implementation is still running or any socket is still open.
+
+package lsp
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+// lspDir is the directory holding the LSP implementation. A goroutine with a
+// frame in one of its non-test files belongs to the implementation.
+var lspDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Dir(file)
+}()
+
+type leakChecker struct {
+	t          *testing.T
+	goroutines map[int]bool // IDs of the goroutines running at the start.
+	sockets    map[string]bool
+}
+
+func newLeakChecker(t *testing.T) *leakChecker {
+	lc := &leakChecker{
+		t:          t,
+		goroutines: make(map[int]bool),
+		sockets:    openSockets(),
+	}
+	for _, g := range goroutineStacks() {
+		lc.goroutines[g.id] = true
+	}
+	return lc
+}
+
+// check fails the test if any goroutine started by the implementation since
+// the snapshot is still running, or any socket opened since then is still
+// open, after waiting up to wait for them to go away. It does nothing if the
+// test has already failed, since a failed test may well leave things running.
+func (lc *leakChecker) check(wait time.Duration) {
+	if lc.t.Failed() {
+		return
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		leaked, sockets := lc.leakedGoroutines(), lc.leakedSockets()
+		if len(leaked) == 0 && len(sockets) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			if len(leaked) > 0 {
+				lc.t.Errorf("%d LSP goroutines still running after Close:\n\n%s",
+					len(leaked), strings.Join(leaked, "\n\n"))
+			}
+			if len(sockets) > 0 {
+				lc.t.Errorf("%d UDP sockets never closed: %s", len(sockets), strings.Join(sockets, ", "))
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (lc *leakChecker) leakedGoroutines() []string {
+	var leaked []string
+	for _, g := range goroutineStacks() {
+		if !lc.goroutines[g.id] && g.isLSP() {
+			leaked = append(leaked, g.stack)
+		}
+	}
+	return leaked
+}
+
+func (lc *leakChecker) leakedSockets() []string {
+	var leaked []string
+	for addr := range openSockets() {
+		if !lc.sockets[addr] {
+			leaked = append(leaked, addr)
+		}
+	}
+	sort.Strings(leaked)
+	return leaked
+}
+
+func openSockets() map[string]bool {
+	sockets := make(map[string]bool)
+	for _, addr := range append(lspnet.ServerAddrs(), lspnet.ClientAddrs()...) {
+		sockets[addr] = true
+	}
+	return sockets
+}
+
+type goroutineStack struct {
+	id    int
+	stack string
+}
+
+func goroutineStacks() []goroutineStack {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var gs []goroutineStack
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		var id int
+		if _, err := fmt.Sscanf(stack, "goroutine %d ", &id); err == nil {
+			gs = append(gs, goroutineStack{id, stack})
+		}
+	}
+	return gs
+}
+
+// isLSP reports whether the goroutine is running code in the implementation,
+// and was not started by a test. Goroutines started by the tests (to call
+// Read, for example) may legitimately block forever once the implementation
+// is closed.
+func (g goroutineStack) isLSP() bool {
+	lines := strings.Split(g.stack, "\n")
+	inLSP := false
+	for i := 1; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "\t") {
+			continue
+		}
+		file := strings.Fields(lines[i])[0]
+		file = file[:strings.LastIndex(file, ":")]
+		if strings.HasSuffix(file, "_test.go") {
+			if strings.HasPrefix(lines[i-1], "created by ") {
+				return false
+			}
+			continue
+		}
+		if filepath.Dir(file) == lspDir {
+			inLSP = true
+		}
+	}
+	return inLSP
+}
@@ -0,0 +1,223 @@
+// LSP benchmarks.
+
+// Each benchmark streams messages from one or more clients to a server and
+// varies one setting (window size, maximum unacked messages, payload size,
+// number of clients or packet loss) while keeping the rest at their
+// defaults. An op is a single message, so allocs/op is the number of
+// allocations per message; the benchmarks also report messages/sec, MB/s
+// and the median and 99th percentile delivery latency (from Write to the
+// server's Read). Sub-benchmarks are named key=value so that benchstat can
+// compare runs, for example:
+//
+//	go test -run=XXX -bench=. -count=10 > old.txt
+//	... change the implementation ...
+//	go test -run=XXX -bench=. -count=10 > new.txt
+//	benchstat old.txt new.txt
+
+package lsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+const benchEpochMillis = 20
+
+// How long a benchmark waits for the server to read another message before
+// failing.
+const benchStallTimeout = 10 * time.Second
+
+type benchConfig struct {
+	window  int
+	unacked int
+	size    int // Payload size in bytes.
+	clients int
+	loss    int // Write drop percent.
+}
+
+var defaultBenchConfig = benchConfig{window: 8, unacked: 8, size: 64, clients: 1, loss: 0}
+
+// A benchmark message carries the sending client's index and the time it was
+// written, padded out to the payload size.
+const benchHeaderLen = 2 + 8
+
+func BenchmarkWindowSize(b *testing.B) {
+	for _, w := range []int{1, 4, 16, 64} {
+		cfg := defaultBenchConfig
+		cfg.window, cfg.unacked = w, w
+		b.Run(fmt.Sprintf("window=%d", w), func(b *testing.B) { runBenchmark(b, cfg) })
+	}
+}
+
+func BenchmarkMaxUnacked(b *testing.B) {
+	for _, u := range []int{1, 4, 16, 64} {
+		cfg := defaultBenchConfig
+		cfg.window, cfg.unacked = 64, u
+		b.Run(fmt.Sprintf("unacked=%d", u), func(b *testing.B) { runBenchmark(b, cfg) })
+	}
+}
+
+func BenchmarkPayloadSize(b *testing.B) {
+	for _, size := range []int{16, 128, 512, 1000} {
+		cfg := defaultBenchConfig
+		cfg.size = size
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) { runBenchmark(b, cfg) })
+	}
+}
+
+func BenchmarkClients(b *testing.B) {
+	for _, n := range []int{1, 4, 16} {
+		cfg := defaultBenchConfig
+		cfg.clients = n
+		b.Run(fmt.Sprintf("clients=%d", n), func(b *testing.B) { runBenchmark(b, cfg) })
+	}
+}
+
+func BenchmarkLoss(b *testing.B) {
+	for _, loss := range []int{0, 5, 20} {
+		cfg := defaultBenchConfig
+		cfg.loss = loss
+		b.Run(fmt.Sprintf("loss=%d", loss), func(b *testing.B) { runBenchmark(b, cfg) })
+	}
+}
+
+func runBenchmark(b *testing.B, cfg benchConfig) {
+	if cfg.size < benchHeaderLen {
+		b.Fatalf("Payload size %d is too small to hold the header", cfg.size)
+	}
+	params := makeParamsWithBackOff(1000, benchEpochMillis, cfg.window, 1, cfg.unacked)
+	var srv Server
+	var port int
+	var err error
+	for i := 0; i < 5 && srv == nil; i++ {
+		port = 3000 + rand.Intn(50000)
+		srv, err = NewServer(port, params)
+	}
+	if err != nil {
+		b.Fatalf("Failed to start server: %s", err)
+	}
+	defer srv.Close()
+	clients := make([]Client, cfg.clients)
+	for i := range clients {
+		clients[i], err = NewClient(lspnet.JoinHostPort("localhost", strconv.Itoa(port)), rand.Intn(256), params)
+		if err != nil {
+			b.Fatalf("Client failed to connect: %s", err)
+		}
+		defer clients[i].Close()
+	}
+	lspnet.SetWriteDropPercent(cfg.loss)
+	defer lspnet.ResetDropPercent()
+
+	// Each client keeps up to twice its window of messages in flight, so
+	// that the latency measured is that of the protocol rather than of an
+	// ever-growing queue of unsent messages.
+	tokens := make([]chan struct{}, cfg.clients)
+	for i := range tokens {
+		tokens[i] = make(chan struct{}, 2*cfg.window)
+		for j := 0; j < cap(tokens[i]); j++ {
+			tokens[i] <- struct{}{}
+		}
+	}
+	// The payloads are made up front, so that allocs/op counts only the
+	// implementation's allocations. Write may keep the slice it is given,
+	// so none is reused.
+	counts := make([]int, cfg.clients)
+	payloads := make([][][]byte, cfg.clients)
+	for i := range clients {
+		counts[i] = b.N / cfg.clients
+		if i < b.N%cfg.clients {
+			counts[i]++
+		}
+		buf := make([]byte, counts[i]*cfg.size)
+		payloads[i] = make([][]byte, counts[i])
+		for j := range payloads[i] {
+			payloads[i][j] = buf[j*cfg.size : (j+1)*cfg.size : (j+1)*cfg.size]
+			binary.BigEndian.PutUint16(payloads[i][j], uint16(i))
+		}
+	}
+	latencies := make([]time.Duration, 0, b.N)
+	var numRead int64
+	done := make(chan error, 1+cfg.clients)
+	b.SetBytes(int64(cfg.size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+
+	go func() {
+		for len(latencies) < b.N {
+			_, payload, err := srv.Read()
+			if err != nil {
+				done <- fmt.Errorf("server failed to read: %s", err)
+				return
+			}
+			if len(payload) != cfg.size || int(binary.BigEndian.Uint16(payload)) >= cfg.clients {
+				done <- fmt.Errorf("server read malformed %d byte payload", len(payload))
+				return
+			}
+			now := time.Now()
+			client := int(binary.BigEndian.Uint16(payload))
+			sent := int64(binary.BigEndian.Uint64(payload[2:]))
+			latencies = append(latencies, now.Sub(time.Unix(0, sent)))
+			atomic.AddInt64(&numRead, 1)
+			select {
+			case tokens[client] <- struct{}{}:
+			default:
+			}
+		}
+		done <- nil
+	}()
+	for i, cli := range clients {
+		go func(i int, cli Client) {
+			for _, payload := range payloads[i] {
+				<-tokens[i]
+				binary.BigEndian.PutUint64(payload[2:], uint64(time.Now().UnixNano()))
+				if err := cli.Write(payload); err != nil {
+					done <- fmt.Errorf("client %d failed to write: %s", i, err)
+					return
+				}
+			}
+		}(i, cli)
+	}
+	// Give up if no message is read for a whole stall timeout, since one of
+	// them must then have been lost for good.
+	ticker := time.NewTicker(benchStallTimeout)
+	defer ticker.Stop()
+	for lastRead := int64(-1); ; {
+		select {
+		case err = <-done:
+		case <-ticker.C:
+			if n := atomic.LoadInt64(&numRead); n != lastRead {
+				lastRead = n
+				continue
+			}
+			err = fmt.Errorf("no message read for %v", benchStallTimeout)
+		}
+		break
+	}
+	if err != nil {
+		b.Fatalf("Benchmark failed: %s", err)
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "msgs/s")
+	b.ReportMetric(float64(percentile(latencies, 50)), "p50-ns")
+	b.ReportMetric(float64(percentile(latencies, 99)), "p99-ns")
+}
+
+// percentile returns the pth percentile of the sorted durations ds.
+func percentile(ds []time.Duration, p int) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	return ds[(len(ds)-1)*p/100]
+}
@@ -13,9 +13,11 @@ package lsp
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"math"
 	"math/rand"
+	"os"
 	"strconv"
 	"testing"
 	"time"
@@ -23,6 +25,40 @@ import (
 	"github.com/cmu440/lspnet"
 )
 
+var simnet = flag.Bool("simnet", false, "run over an in-memory lspnet network instead of real UDP sockets")
+
+// simnetStep is how often the simulated network's clock is advanced.
+const simnetStep = time.Millisecond
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !*simnet {
+		os.Exit(m.Run())
+	}
+	// The network runs on a virtual clock, so that its timers fire one at a
+	// time and in order, which is kept in step with the wall clock.
+	clock := lspnet.NewVirtualClock(time.Now())
+	lspnet.SetTransport(lspnet.NewSimNetwork(clock))
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(simnetStep)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case now := <-ticker.C:
+				clock.Advance(now.Sub(last))
+				last = now
+			case <-stop:
+				return
+			}
+		}
+	}()
+	code := m.Run()
+	close(stop)
+	os.Exit(code)
+}
+
 type testSystem struct {
 	t              *testing.T
 	server         Server
@@ -34,6 +70,7 @@ type testSystem struct {
 	desc           string
 	dropPercent    int
 	params         *Params
+	leaks          *leakChecker
 }
 
 func (ts *testSystem) setMaxSleepMillis(ms int) *testSystem {
@@ -59,6 +96,7 @@ func (ts *testSystem) setDropPercent(p int) *testSystem {
 func newTestSystem(t *testing.T, numClients int, params *Params) *testSystem {
 	ts := new(testSystem)
 	ts.t = t
+	ts.leaks = newLeakChecker(t)
 	ts.params = params
 	ts.numClients = numClients
 	ts.exitChan = make(chan struct{})
@@ -91,6 +129,7 @@ func newTestSystem(t *testing.T, numClients int, params *Params) *testSystem {
 		}
 	}
 	t.Logf("Started %d clients.", numClients)
+	t.Cleanup(ts.checkLeaks)
 	return ts
 }
 
@@ -193,13 +232,43 @@ func (ts *testSystem) runTest(timeout int) {
 	close(ts.exitChan)
 }
 
+// checkLeaks runs once a test that passed has finished and restored the
+// network. It closes the clients and then the server, which the tests
+// otherwise leave open, and checks that their background goroutines exit.
+// If Close never returns, that is reported instead, since the goroutines
+// blocked in it would be sure to show up as leaks.
+func (ts *testSystem) checkLeaks() {
+	if ts.t.Failed() {
+		return
+	}
+	closed := make(chan struct{})
+	go func() {
+		for _, cli := range ts.clients {
+			cli.Close()
+		}
+		ts.server.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Duration(2*(ts.params.EpochLimit+1)*ts.params.EpochMillis) * time.Millisecond):
+		ts.t.Errorf("Close did not return after the test finished.")
+		return
+	}
+	ts.leaks.check(time.Duration(2*ts.params.EpochMillis) * time.Millisecond)
+}
+
 func makeParams(epochLimit, epochMillis, windowSize, maxUnackedMessages int) *Params {
+	return makeParamsWithBackOff(epochLimit, epochMillis, windowSize, 0, maxUnackedMessages)
+}
+
+func makeParamsWithBackOff(epochLimit, epochMillis, windowSize, maxBackOffInterval, maxUnackedMessages int) *Params {
 	return &Params{
 		EpochLimit:         epochLimit,
 		EpochMillis:        epochMillis,
 		WindowSize:         windowSize,
 		MaxUnackedMessages: maxUnackedMessages,
-		MaxBackOffInterval: 0,
+		MaxBackOffInterval: maxBackOffInterval,
 	}
 }
 
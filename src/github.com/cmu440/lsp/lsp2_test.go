@@ -6,6 +6,8 @@
 // by Read in the order they were sent (i.e. in order of their sequence numbers).
 // Specifically, if messages 1-5 are dropped and messages 6-10 are received, then
 // the latter 5 should not be returned by Read until the first 5 are received.
+// TestMaxUnackedMessages1-6 and TestExpBackOffVirtual1-2 run on a FakeClock,
+// so that epochs pass when the test steps them rather than in real time.
 
 package lsp
 
@@ -28,12 +30,14 @@ const (
 	doOutOfWindowMsgs
 	doMessageOrder
 	doExponentialBackOff
+	doVirtualExponentialBackOff
 )
 
 type windowTestSystem struct {
 	t                  *testing.T
 	server             Server
 	params             *Params
+	clock              *FakeClock // Or nil, if epochs pass in real time.
 	mode               windowTestMode
 	desc               string
 	numClients         int
@@ -61,6 +65,7 @@ func newWindowTestSystem(t *testing.T, mode windowTestMode, numClients, numMsgs
 	ts.serverReadMsgs = make(map[int][]string)
 	ts.clientReadMsgs = make(map[int][]string)
 	ts.params = params
+	ts.clock, _ = params.Clock.(*FakeClock)
 	ts.numClients = numClients
 	ts.numMsgs = numMsgs
 	ts.mode = mode
@@ -243,36 +248,80 @@ func (ts *windowTestSystem) readFromAllClients(totalMsgs int, checkpoints ...int
 	ts.t.Logf("Server finished reading %d total messages from clients.", totalMsgs)
 }
 
+// Real time a test with a FakeClock waits for something to happen before it
+// lets another epoch pass.
+const fakeEpochIdleMillis = 10
+
 func (ts *windowTestSystem) waitForServer() {
 	ts.t.Log("Waiting for server...")
-	select {
-	case <-ts.timeoutChan:
-		close(ts.exitChan)
-		ts.t.Fatalf("Test timed out after %.2f secs", float64(ts.timeout)/1000.0)
-	case ok := <-ts.serverDoneChan:
-		if !ok {
-			close(ts.exitChan)
-			ts.t.Fatal("Server failed due to an error.")
-		}
-	}
+	ts.await(ts.serverDoneChan, "Server", false)
 	ts.t.Log("Done waiting for server.")
 }
 
 func (ts *windowTestSystem) waitForClients() {
 	ts.t.Log("Waiting for clients...")
 	for i := 0; i < ts.numClients; i++ {
+		ts.await(ts.clientDoneChan, "Client", false)
+	}
+	ts.t.Log("Done waiting for clients.")
+}
+
+// Same as waitForServer, but for something that takes epochs, such as
+// retransmissions. With a FakeClock, epochs are let pass while waiting.
+func (ts *windowTestSystem) waitForServerOverEpochs() {
+	ts.t.Log("Waiting for server...")
+	ts.await(ts.serverDoneChan, "Server", true)
+	ts.t.Log("Done waiting for server.")
+}
+
+// Same as waitForClients, but for something that takes epochs.
+func (ts *windowTestSystem) waitForClientsOverEpochs() {
+	ts.t.Log("Waiting for clients...")
+	for i := 0; i < ts.numClients; i++ {
+		ts.await(ts.clientDoneChan, "Client", true)
+	}
+	ts.t.Log("Done waiting for clients.")
+}
+
+// await waits for a signal on done. If epochs is true and the test has a
+// FakeClock, the clock is advanced an epoch at a time until it comes.
+func (ts *windowTestSystem) await(done chan bool, who string, epochs bool) {
+	var idle <-chan time.Time
+	for {
+		if epochs && ts.clock != nil {
+			idle = time.After(fakeEpochIdleMillis * time.Millisecond)
+		}
 		select {
 		case <-ts.timeoutChan:
 			close(ts.exitChan)
 			ts.t.Fatalf("Test timed out after %.2f secs", float64(ts.timeout)/1000.0)
-		case ok := <-ts.clientDoneChan:
+		case ok := <-done:
 			if !ok {
 				close(ts.exitChan)
-				ts.t.Fatal("Client failed due to an error.")
+				ts.t.Fatalf("%s failed due to an error.", who)
 			}
+			return
+		case <-idle:
+			ts.clock.AdvanceEpoch()
 		}
 	}
-	ts.t.Log("Done waiting for clients.")
+}
+
+// settle gives the implementation a chance to act on what the test has just
+// done (or to wrongly do more) before the result is checked, by sleeping for
+// millis. No epoch is started, even with a FakeClock, just as none would pass
+// in that time with real epochs.
+func (ts *windowTestSystem) settle(millis int) {
+	time.Sleep(time.Duration(millis) * time.Millisecond)
+}
+
+// passEpochs lets n epochs go by.
+func (ts *windowTestSystem) passEpochs(n int) {
+	if ts.clock != nil {
+		ts.clock.AdvanceEpochs(n)
+		return
+	}
+	time.Sleep(time.Duration(n*ts.params.EpochMillis) * time.Millisecond)
 }
 
 func (ts *windowTestSystem) checkServerReadMsgs(sentMsgs []string) {
@@ -333,6 +382,8 @@ func (ts *windowTestSystem) runTest() {
 		ts.runMessageOrderTest()
 	case doExponentialBackOff:
 		ts.runExponentialBackOffTest()
+	case doVirtualExponentialBackOff:
+		ts.runVirtualExponentialBackOffTest()
 	}
 }
 
@@ -369,7 +420,7 @@ func (ts *windowTestSystem) runMaxCapacityTest() {
 
 	ts.waitForClients() // Wait for clients to finish writing messages to the server.
 	ts.waitForServer()  // Wait for the server to read the messages from the clients.
-	time.Sleep(50 * time.Millisecond)
+	ts.settle(50)
 
 	// Confirm that the server received the expected messages from the client.
 	ts.checkServerReadMsgs(ts.clientSendMsgs[0:msgSendSize])
@@ -378,8 +429,8 @@ func (ts *windowTestSystem) runMaxCapacityTest() {
 	// rest of its messages at the next epoch event.
 	ts.setServerWriteDropPercent(0)
 
-	ts.waitForServer() // Wait for the server to read the rest of the client's messages.
-	time.Sleep(50 * time.Millisecond)
+	ts.waitForServerOverEpochs() // Wait for the server to read the rest of the client's messages.
+	ts.settle(50)
 
 	// Confirm that the server received all of the expected messages from the client.
 	ts.checkServerReadMsgs(ts.clientSendMsgs)
@@ -396,15 +447,15 @@ func (ts *windowTestSystem) runMaxCapacityTest() {
 		ts.waitForServer() // Wait for the server to finish writing messages to each client.
 	}
 	ts.waitForClients() // Wait for clients to read messages from the server.
-	time.Sleep(50 * time.Millisecond)
+	ts.settle(50)
 
 	// Confirm that the client read the expected messages from the server.
 	ts.checkClientReadMsgs(ts.serverSendMsgs[0:msgSendSize])
 
 	ts.setClientWriteDropPercent(0) // Let clients send acks.
 
-	ts.waitForClients() // Wait for client to read messages from the server.
-	time.Sleep(50 * time.Millisecond)
+	ts.waitForClientsOverEpochs() // Wait for client to read messages from the server.
+	ts.settle(50)
 
 	// Confirm that the client read the expected messages from the server.
 	ts.checkClientReadMsgs(ts.serverSendMsgs)
@@ -509,7 +560,7 @@ func (ts *windowTestSystem) runWindowBiggerThanUnackTest() {
 	ts.waitForClients() // Wait for clients to finish writing messages to the server.
 
 	// now we wait till expbackoff goes up so the messages are not being re-sent
-	time.Sleep(2000 * time.Millisecond)
+	ts.passEpochs(2000 / ts.params.EpochMillis)
 
 	ts.setServerWriteDropPercent(0) // Let server send back acks
 	for connID, cli := range ts.clientMap {
@@ -517,7 +568,7 @@ func (ts *windowTestSystem) runWindowBiggerThanUnackTest() {
 		go ts.streamToServer(connID, cli, ts.clientSendMsgs[numMsgs/4:2*numMsgs/4])
 	}
 	ts.waitForClients() // Wait for clients to finish writing messages to the server.
-	time.Sleep(200 * time.Millisecond)
+	ts.settle(200)
 
 	ts.setServerWriteDropPercent(100) // Don't let server send acks.
 	for connID, cli := range ts.clientMap {
@@ -532,7 +583,7 @@ func (ts *windowTestSystem) runWindowBiggerThanUnackTest() {
 	// In order to test whether the window is correct, give the server enough time to
 	// Read additional messages that it is not allowed to deliver until the network
 	// is unblocked
-	time.Sleep(500 * time.Millisecond)
+	ts.settle(500)
 
 	// Confirm that the server received all of the expected messages from the client.
 	ts.checkServerReadMsgs(ts.clientSendMsgs[:3*numMsgs/4])
@@ -542,7 +593,7 @@ func (ts *windowTestSystem) runWindowBiggerThanUnackTest() {
 	// Confirm that the remaining messages are successfully read
 	// Note: if you do not consume all of the checkpoint signals before
 	// the test function returns, it is a race condition
-	ts.waitForServer()
+	ts.waitForServerOverEpochs()
 
 	// (2) server to client
 	ts.t.Logf("Testing server to client...")
@@ -556,7 +607,7 @@ func (ts *windowTestSystem) runWindowBiggerThanUnackTest() {
 		ts.waitForServer() // Wait for the server to finish writing messages to each client.
 	}
 
-	time.Sleep(2000 * time.Millisecond)
+	ts.passEpochs(2000 / ts.params.EpochMillis)
 
 	ts.setClientWriteDropPercent(0) // Let client send back acks
 	for connID := range ts.clientMap {
@@ -565,13 +616,13 @@ func (ts *windowTestSystem) runWindowBiggerThanUnackTest() {
 	for i := 0; i < numClients; i++ {
 		ts.waitForServer() // Wait for the server to finish writing messages to each client.
 	}
-	time.Sleep(200 * time.Millisecond)
+	ts.settle(200)
 
 	ts.setClientWriteDropPercent(100) // Don't let clients send back acks
 	for connID := range ts.clientMap {
 		go ts.streamToClient(connID, ts.serverSendMsgs[2*numMsgs/4:]) // Start streaming messages to each client.
 	}
-	time.Sleep(200 * time.Millisecond)
+	ts.settle(200)
 
 	for i := 0; i < numClients; i++ {
 		ts.waitForServer() // Wait for the server to finish writing messages to each client.
@@ -584,7 +635,7 @@ func (ts *windowTestSystem) runWindowBiggerThanUnackTest() {
 	ts.waitForClients() // Wait for clients to read messages from the server.
 	// In order to test whether the window is correct, give the client enough time to
 	// Read additional messages that it is not allowed to deliver until the network is unblocked
-	time.Sleep(500 * time.Millisecond)
+	ts.settle(500)
 
 	// Confirm that the server received all of the expected messages from the client.
 	ts.checkClientReadMsgs(ts.serverSendMsgs[:3*numMsgs/4])
@@ -592,7 +643,7 @@ func (ts *windowTestSystem) runWindowBiggerThanUnackTest() {
 	ts.setClientWriteDropPercent(0) // Let client send back acks
 
 	// Confirm that the remaining messages are successfully read by each client
-	ts.waitForClients() // Wait for clients to read all messages from the server.
+	ts.waitForClientsOverEpochs() // Wait for clients to read all messages from the server.
 }
 
 func (ts *windowTestSystem) runMessageOrderTest() {
@@ -651,99 +702,227 @@ func (ts *windowTestSystem) runExponentialBackOffTest() {
 	ts.setServerWriteDropPercent(0)
 }
 
+// Epochs (counting the initial transmission as epoch 0) in which a data
+// message that is never acknowledged is sent, given a MaxBackOffInterval
+// of 4. The gaps between transmissions are 0, 1, 2, 4, 4, ... epochs.
+var virtualExpBackOffSchedule = []int{0, 1, 3, 6, 11, 16, 21}
+
+// Real time the implementation is given to send the data messages due in an
+// epoch, once it has taken the epoch's tick.
+const virtualEpochSendMillis = 1000
+
+// A middlebox that counts the data messages sent, without interfering.
+type dataCounterMiddlebox struct {
+	lock    sync.Mutex
+	numData int
+	sent    chan struct{} // Signalled when a data message is counted.
+}
+
+func newDataCounterMiddlebox() *dataCounterMiddlebox {
+	return &dataCounterMiddlebox{sent: make(chan struct{}, 1)}
+}
+
+func (m *dataCounterMiddlebox) Run(msg *lspnet.TemporaryMessage) lspnet.MiddleboxOutput {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if msg.Type == lspnet.TypeMsgData {
+		m.numData++
+		select {
+		case m.sent <- struct{}{}:
+		default:
+		}
+	}
+	return lspnet.MiddleboxOutput{SendMsg: true}
+}
+
+func (m *dataCounterMiddlebox) count() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.numData
+}
+
+// await waits until at least n data messages have been counted, or until
+// timeout, and returns the count.
+func (m *dataCounterMiddlebox) await(n int, timeout time.Duration) int {
+	deadline := time.After(timeout)
+	for {
+		if count := m.count(); count >= n {
+			return count
+		}
+		select {
+		case <-m.sent:
+		case <-deadline:
+			return m.count()
+		}
+	}
+}
+
+// Same as runExponentialBackOffTest, but steps a FakeClock one epoch at a
+// time and checks the exact epoch of every retransmission.
+func (ts *windowTestSystem) runVirtualExponentialBackOffTest() {
+	numClients := ts.numClients
+	clock, ok := ts.params.Clock.(*FakeClock)
+	if !ok {
+		ts.t.Fatal("Params must use a FakeClock.")
+	}
+	if ts.params.MaxBackOffInterval != 4 {
+		ts.t.Fatal("MaxBackOffInterval must be 4.")
+	}
+	if ts.numMsgs > ts.params.WindowSize || ts.numMsgs > ts.params.MaxUnackedMessages {
+		ts.t.Fatal("All messages must fit in the window.")
+	}
+
+	ts.t.Logf("Testing client to server...")
+	ts.setServerWriteDropPercent(100) // Don't let server send acks.
+	counter := newDataCounterMiddlebox()
+	lspnet.StartMiddlebox(counter)
+	defer lspnet.StopMiddlebox()
+	for connID, cli := range ts.clientMap {
+		go ts.streamToServer(connID, cli, ts.clientSendMsgs)
+	}
+	ts.waitForClients()
+
+	lastEpoch := virtualExpBackOffSchedule[len(virtualExpBackOffSchedule)-1]
+	for epoch, sent := 0, 0; epoch <= lastEpoch; epoch++ {
+		if epoch > 0 {
+			clock.AdvanceEpoch()
+		}
+		for sent < len(virtualExpBackOffSchedule) && virtualExpBackOffSchedule[sent] <= epoch {
+			sent++
+		}
+		expected := sent * ts.numMsgs * numClients
+		if actual := counter.await(expected, virtualEpochSendMillis*time.Millisecond); actual != expected {
+			ts.t.Fatalf("Expected %d data messages to be sent by epoch %d, got %d",
+				expected, epoch, actual)
+		}
+	}
+	ts.setServerWriteDropPercent(0)
+	close(ts.exitChan)
+}
+
 func TestExpBackOff1(t *testing.T) {
-	newWindowTestSystem(t, doExponentialBackOff, 1, 10, &Params{100, 2000, 5, 4, 5}).
+	newWindowTestSystem(t, doExponentialBackOff, 1, 10, makeParamsWithBackOff(100, 2000, 5, 4, 5)).
 		setDescription("TestExpBackOff1: 1 clients, backoff test").
 		setMaxEpochs(ExponentialBackOffTestEpochToListen + 5).
 		runTest()
 }
 
 func TestExpBackOff2(t *testing.T) {
-	newWindowTestSystem(t, doExponentialBackOff, 10, 15, &Params{100, 2000, 5, 4, 5}).
+	newWindowTestSystem(t, doExponentialBackOff, 10, 15, makeParamsWithBackOff(100, 2000, 5, 4, 5)).
 		setDescription("TestExpBackOff2: 10 clients, backoff test").
 		setMaxEpochs(ExponentialBackOffTestEpochToListen + 5).
 		runTest()
 }
 
+func TestExpBackOffVirtual1(t *testing.T) {
+	params := makeParamsWithBackOff(100, 2000, 1, 4, 1)
+	NewFakeClock(params)
+	newWindowTestSystem(t, doVirtualExponentialBackOff, 1, 1, params).
+		setDescription("TestExpBackOffVirtual1: 1 client, epoch-exact backoff test").
+		setMaxEpochs(ExponentialBackOffTestEpochToListen + 5).
+		runTest()
+}
+
+func TestExpBackOffVirtual2(t *testing.T) {
+	params := makeParamsWithBackOff(100, 2000, 5, 4, 5)
+	NewFakeClock(params)
+	newWindowTestSystem(t, doVirtualExponentialBackOff, 10, 5, params).
+		setDescription("TestExpBackOffVirtual2: 10 clients, epoch-exact backoff test").
+		setMaxEpochs(ExponentialBackOffTestEpochToListen + 5).
+		runTest()
+}
+
 func TestWindow1(t *testing.T) {
-	newWindowTestSystem(t, doMaxCapacity, 1, 10, &Params{3, 500, 5, 0, 50}).
+	newWindowTestSystem(t, doMaxCapacity, 1, 10, makeParams(3, 500, 5, 50)).
 		setDescription("TestWindow1: 1 client, max capacity").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestWindow2(t *testing.T) {
-	newWindowTestSystem(t, doMaxCapacity, 5, 25, &Params{3, 500, 10, 0, 50}).
+	newWindowTestSystem(t, doMaxCapacity, 5, 25, makeParams(3, 500, 10, 50)).
 		setDescription("TestWindow2: 5 clients, max capacity").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestWindow3(t *testing.T) {
-	newWindowTestSystem(t, doMaxCapacity, 10, 25, &Params{3, 500, 10, 0, 50}).
+	newWindowTestSystem(t, doMaxCapacity, 10, 25, makeParams(3, 500, 10, 50)).
 		setDescription("TestWindow3: 10 clients, max capacity").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestWindow4(t *testing.T) {
-	newWindowTestSystem(t, doScatteredMsgs, 1, 10, &Params{3, 1000, 20, 0, 20}).
+	newWindowTestSystem(t, doScatteredMsgs, 1, 10, makeParams(3, 1000, 20, 20)).
 		setDescription("TestWindow4: 1 client, scattered msgs").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestWindow5(t *testing.T) {
-	newWindowTestSystem(t, doScatteredMsgs, 5, 10, &Params{3, 1000, 20, 0, 20}).
+	newWindowTestSystem(t, doScatteredMsgs, 5, 10, makeParams(3, 1000, 20, 20)).
 		setDescription("TestWindow5: 5 clients, scattered msgs").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestWindow6(t *testing.T) {
-	newWindowTestSystem(t, doScatteredMsgs, 10, 10, &Params{3, 1000, 20, 0, 20}).
+	newWindowTestSystem(t, doScatteredMsgs, 10, 10, makeParams(3, 1000, 20, 20)).
 		setDescription("TestWindow6: 10 clients, scattered msgs").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestMaxUnackedMessages1(t *testing.T) {
-	newWindowTestSystem(t, doMaxCapacity, 1, 10, &Params{3, 500, 50, 0, 5}).
+	params := makeParams(3, 500, 50, 5)
+	NewFakeClock(params)
+	newWindowTestSystem(t, doMaxCapacity, 1, 10, params).
 		setDescription("TestMaxUnackedMessages1: 1 client, max capacity").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestMaxUnackedMessages2(t *testing.T) {
-	newWindowTestSystem(t, doMaxCapacity, 5, 25, &Params{3, 500, 50, 0, 10}).
+	params := makeParams(3, 500, 50, 10)
+	NewFakeClock(params)
+	newWindowTestSystem(t, doMaxCapacity, 5, 25, params).
 		setDescription("TestMaxUnackedMessages2: 5 clients, max capacity").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestMaxUnackedMessages3(t *testing.T) {
-	newWindowTestSystem(t, doMaxCapacity, 10, 25, &Params{3, 500, 50, 0, 10}).
+	params := makeParams(3, 500, 50, 10)
+	NewFakeClock(params)
+	newWindowTestSystem(t, doMaxCapacity, 10, 25, params).
 		setDescription("TestMaxUnackedMessages3: 10 clients, max capacity").
 		setMaxEpochs(5).
 		runTest()
 }
 
 func TestMaxUnackedMessages4(t *testing.T) {
-	newWindowTestSystem(t, doOutOfWindowMsgs, 1, 20, &Params{100, 1000, 20, 10, 10}).
+	params := makeParamsWithBackOff(100, 1000, 20, 10, 10)
+	NewFakeClock(params)
+	newWindowTestSystem(t, doOutOfWindowMsgs, 1, 20, params).
 		setDescription("TestMaxUnackedMessages4: 1 client, window and max unacked msgs").
 		setMaxEpochs(10).
 		runTest()
 }
 
 func TestMaxUnackedMessages5(t *testing.T) {
-	newWindowTestSystem(t, doOutOfWindowMsgs, 5, 20, &Params{100, 1000, 15, 10, 10}).
+	params := makeParamsWithBackOff(100, 1000, 15, 10, 10)
+	NewFakeClock(params)
+	newWindowTestSystem(t, doOutOfWindowMsgs, 5, 20, params).
 		setDescription("TestMaxUnackedMessages5: 5 clients, window and max unacked msgs").
 		setMaxEpochs(10).
 		runTest()
 }
 
 func TestMaxUnackedMessages6(t *testing.T) {
-	newWindowTestSystem(t, doOutOfWindowMsgs, 5, 20, &Params{100, 1000, 20, 10, 10}).
+	params := makeParamsWithBackOff(100, 1000, 20, 10, 10)
+	NewFakeClock(params)
+	newWindowTestSystem(t, doOutOfWindowMsgs, 5, 20, params).
 		setDescription("TestMaxUnackedMessages6: 5 clients, window and max unacked msgs").
 		setMaxEpochs(10).
 		runTest()
@@ -752,7 +931,7 @@ func TestMaxUnackedMessages6(t *testing.T) {
 func TestOutOfOrderMsg1(t *testing.T) {
 	lspnet.SetDelayMessagePercent(50)
 	defer lspnet.SetDelayMessagePercent(0)
-	newWindowTestSystem(t, doMessageOrder, 1, 10, &Params{3, 5000, 30, 0, 30}).
+	newWindowTestSystem(t, doMessageOrder, 1, 10, makeParams(3, 5000, 30, 30)).
 		setDescription("TestOutOfOrderMsg1: 1 client, out-of-order test").
 		setMaxEpochs(5).
 		runTest()
@@ -761,7 +940,7 @@ func TestOutOfOrderMsg1(t *testing.T) {
 func TestOutOfOrderMsg2(t *testing.T) {
 	lspnet.SetDelayMessagePercent(50)
 	defer lspnet.SetDelayMessagePercent(0)
-	newWindowTestSystem(t, doMessageOrder, 5, 25, &Params{3, 5000, 30, 0, 30}).
+	newWindowTestSystem(t, doMessageOrder, 5, 25, makeParams(3, 5000, 30, 30)).
 		setDescription("TestOutOfOrderMsg2: 5 clients, out-of-order test").
 		setMaxEpochs(5).
 		runTest()
@@ -770,7 +949,7 @@ func TestOutOfOrderMsg2(t *testing.T) {
 func TestOutOfOrderMsg3(t *testing.T) {
 	lspnet.SetDelayMessagePercent(50)
 	defer lspnet.SetDelayMessagePercent(0)
-	newWindowTestSystem(t, doMessageOrder, 10, 25, &Params{3, 5000, 30, 0, 30}).
+	newWindowTestSystem(t, doMessageOrder, 10, 25, makeParams(3, 5000, 30, 30)).
 		setDescription("TestOutOfOrderMsg3: 10 clients, out-of-order test").
 		setMaxEpochs(5).
 		runTest()
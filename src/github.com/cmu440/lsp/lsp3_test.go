@@ -56,11 +56,13 @@ type closeTestSystem struct {
 	desc           string
 	maxEpochs      int
 	delayEpochs    int
+	leaks          *leakChecker
 }
 
 func newCloseTestSystem(t *testing.T, mode closeTestMode) *closeTestSystem {
 	ts := new(closeTestSystem)
 	ts.t = t
+	ts.leaks = newLeakChecker(t)
 	ts.mode = mode
 	ts.clientDoneChan = make(chan clientTermStatus)
 	ts.serverDoneChan = make(chan bool)
@@ -165,6 +167,11 @@ func (ts *closeTestSystem) runTest() {
 		}
 	}
 	close(ts.exitChan)
+	if ts.mode == doSlowStart || ts.mode == doServerCloseConns {
+		// The server is left open in these modes.
+		ts.server.Close()
+	}
+	ts.leaks.check(time.Duration(2*ts.params.EpochMillis) * time.Millisecond)
 }
 
 func (ts *closeTestSystem) createServer() error {
@@ -482,3 +489,121 @@ func TestClientClose2(t *testing.T) {
 		setParams(5, 500, 1, 1).
 		runTest()
 }
+
+// Isolates the first of several clients from the rest of the network once
+// every client has completed an echo. The server should report that client's
+// connection as lost within the epoch limit, the isolated client should give
+// up on the server, and the remaining clients should be unaffected.
+func runIsolationTest(t *testing.T, desc string, numClients int, params *Params) {
+	fmt.Printf("=== %s (%d clients, %d epoch limit, %d window size, %d max unacked messages)\n",
+		desc, numClients, params.EpochLimit, params.WindowSize, params.MaxUnackedMessages)
+	defer lspnet.Heal()
+
+	port := 2000 + rand.Intn(50000)
+	srv, err := NewServer(port, params)
+	if err != nil {
+		t.Fatalf("Couldn't create server on port %d: %s", port, err)
+	}
+	defer srv.Close()
+
+	// Create the clients one at a time so we can tell which address is whose.
+	clients := make([]Client, numClients)
+	var victimAddr string
+	for i := range clients {
+		before := make(map[string]bool)
+		for _, addr := range lspnet.ClientAddrs() {
+			before[addr] = true
+		}
+		clients[i], err = NewClient(lspnet.JoinHostPort("localhost", strconv.Itoa(port)), 0, params)
+		if err != nil {
+			t.Fatalf("Failed to create client %d on port %d: %s", i, port, err)
+		}
+		for _, addr := range lspnet.ClientAddrs() {
+			if i == 0 && !before[addr] {
+				victimAddr = addr
+			}
+		}
+	}
+	if victimAddr == "" {
+		t.Fatalf("Couldn't determine the address of client %d", clients[0].ConnID())
+	}
+
+	// Echo everything back, and report lost connections until the server is
+	// closed. closed is closed before the deferred srv.Close runs.
+	lostChan := make(chan int, numClients)
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		for {
+			id, data, err := srv.Read()
+			if err != nil {
+				select {
+				case <-closed:
+					return
+				default:
+				}
+				select {
+				case lostChan <- id:
+				case <-closed:
+					return
+				}
+				continue
+			}
+			srv.Write(id, data)
+		}
+	}()
+	echo := func(cli Client) error {
+		if err := cli.Write([]byte(strconv.Itoa(cli.ConnID()))); err != nil {
+			return err
+		}
+		_, err := cli.Read()
+		return err
+	}
+	for _, cli := range clients {
+		if err := echo(cli); err != nil {
+			t.Fatalf("Client %d failed to echo: %s", cli.ConnID(), err)
+		}
+	}
+
+	t.Logf("Isolating client %d at %s", clients[0].ConnID(), victimAddr)
+	lspnet.Isolate(victimAddr)
+	victimChan := make(chan error, 1)
+	go func() {
+		_, err := clients[0].Read()
+		victimChan <- err
+	}()
+
+	millis := (params.EpochLimit + 2) * params.EpochMillis
+	timeoutChan := time.After(time.Duration(millis) * time.Millisecond)
+	select {
+	case id := <-lostChan:
+		if id != clients[0].ConnID() {
+			t.Fatalf("Server reported client %d lost, expected %d", id, clients[0].ConnID())
+		}
+	case <-timeoutChan:
+		t.Fatalf("Server didn't report isolated client %d lost", clients[0].ConnID())
+	}
+	select {
+	case err := <-victimChan:
+		if err == nil {
+			t.Fatalf("Isolated client %d read data from the server", clients[0].ConnID())
+		}
+	case <-timeoutChan:
+		t.Fatalf("Isolated client %d didn't detect the lost server", clients[0].ConnID())
+	}
+
+	for _, cli := range clients[1:] {
+		if err := echo(cli); err != nil {
+			t.Fatalf("Client %d failed to echo after isolation: %s", cli.ConnID(), err)
+		}
+		cli.Close()
+	}
+}
+
+func TestClientIsolated1(t *testing.T) {
+	runIsolationTest(t, "TestClientIsolated1: Isolated client is detected as lost", 1, makeParams(5, 500, 1, 1))
+}
+
+func TestClientIsolated2(t *testing.T) {
+	runIsolationTest(t, "TestClientIsolated2: Isolated client doesn't affect others", 3, makeParams(5, 500, 1, 1))
+}
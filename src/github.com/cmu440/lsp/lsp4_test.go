@@ -1,8 +1,8 @@
 // LSP advanced buffering/synchronization tests.
 
 // These tests are advanced in nature. Messages are "streamed" in large
-// batches and the network is toggled on/off (i.e. drop percent is set to
-// either 0% or 100%) throughout. The server/client Close methods are
+// batches and the network is toggled on/off (i.e. the server is partitioned
+// from its clients, then healed) throughout. The server/client Close methods are
 // also tested in the presence of a unreliable network.
 
 package lsp
@@ -51,11 +51,13 @@ type syncTestSystem struct {
 	masterToNetworkChan chan struct{}
 	exitChan            chan struct{}
 	errChan             chan error
+	leaks               *leakChecker
 }
 
 func newSyncTestSystem(t *testing.T, numClients, numMsgs int, mode syncTestMode, params *Params) *syncTestSystem {
 	ts := new(syncTestSystem)
 	ts.t = t
+	ts.leaks = newLeakChecker(t)
 	ts.mode = mode
 	ts.params = params
 	ts.numClients = numClients
@@ -94,7 +96,7 @@ func (ts *syncTestSystem) setMaxEpochs(maxEpochs int) *syncTestSystem {
 }
 
 func (ts *syncTestSystem) runTest() {
-	defer lspnet.ResetDropPercent()
+	defer lspnet.Heal()
 	fmt.Printf("=== %s (%d clients, %d msgs/client, %d max epochs, %d window size, %d max unacked messages)\n",
 		ts.desc, ts.numClients, ts.numMsgs, ts.maxEpochs, ts.params.WindowSize, ts.params.MaxUnackedMessages)
 	go ts.runNetwork()
@@ -106,15 +108,17 @@ func (ts *syncTestSystem) runTest() {
 	ts.timeoutChan = time.After(time.Duration(ts.maxEpochs*ts.params.EpochMillis) * time.Millisecond)
 	ts.master()
 	close(ts.exitChan)
+	ts.leaks.check(time.Duration(2*ts.params.EpochMillis) * time.Millisecond)
 }
 
-// Alternates between turning network writes on and off in a loop.
-// Runs in a background goroutine and is started once at the very beginning of a test.
+// Alternates between partitioning the server from its clients and healing
+// the network in a loop. Runs in a background goroutine and is started once
+// at the very beginning of a test.
 func (ts *syncTestSystem) runNetwork() {
 	t := ts.t
 	// Network initially on
-	t.Log("Setting global write drop percent to 0%")
-	lspnet.SetWriteDropPercent(0)
+	t.Log("Healing network")
+	lspnet.Heal()
 	for {
 		select {
 		case <-ts.exitChan:
@@ -123,14 +127,14 @@ func (ts *syncTestSystem) runNetwork() {
 		default:
 			t.Log("Waiting for master...")
 			<-ts.masterToNetworkChan
-			t.Log("Setting global write drop percent to 100%")
-			lspnet.SetWriteDropPercent(100)
+			t.Log("Partitioning server from all clients")
+			lspnet.Partition([]string{":" + strconv.Itoa(ts.port)}, lspnet.ClientAddrs())
 			ts.networkToMasterChan <- struct{}{}
 
 			t.Log("Waiting for master...")
 			<-ts.masterToNetworkChan
-			t.Log("Setting global write drop percent to 0%")
-			lspnet.SetWriteDropPercent(0)
+			t.Log("Healing network")
+			lspnet.Heal()
 			ts.networkToMasterChan <- struct{}{}
 			t.Logf("Sleeping for %d ms", 2*ts.params.EpochMillis)
 			time.Sleep(time.Duration(2*ts.params.EpochMillis) * time.Millisecond)
@@ -445,84 +449,84 @@ func (ts *syncTestSystem) master() {
 }
 
 func TestServerFastClose1(t *testing.T) {
-	newSyncTestSystem(t, 1, 10, doServerFastClose, &Params{5, 500, 1, 0, 1}).
+	newSyncTestSystem(t, 1, 10, doServerFastClose, makeParams(5, 500, 1, 1)).
 		setDescription("TestServerFastClose1: Fast close of server").
 		setMaxEpochs(12).
 		runTest()
 }
 
 func TestServerFastClose2(t *testing.T) {
-	newSyncTestSystem(t, 3, 10, doServerFastClose, &Params{5, 500, 1, 0, 1}).
+	newSyncTestSystem(t, 3, 10, doServerFastClose, makeParams(5, 500, 1, 1)).
 		setDescription("TestServerFastClose2: Fast close of server").
 		setMaxEpochs(12).
 		runTest()
 }
 
 func TestServerFastClose3(t *testing.T) {
-	newSyncTestSystem(t, 5, 500, doServerFastClose, &Params{5, 2000, 1, 0, 1}).
+	newSyncTestSystem(t, 5, 500, doServerFastClose, makeParams(5, 2000, 1, 1)).
 		setDescription("TestServerFastClose3: Fast close of server").
 		setMaxEpochs(20).
 		runTest()
 }
 
 func TestServerToClient1(t *testing.T) {
-	newSyncTestSystem(t, 1, 10, doServerToClient, &Params{5, 500, 1, 0, 1}).
+	newSyncTestSystem(t, 1, 10, doServerToClient, makeParams(5, 500, 1, 1)).
 		setDescription("TestServerToClient1: Stream from server to client").
 		setMaxEpochs(12).
 		runTest()
 }
 
 func TestServerToClient2(t *testing.T) {
-	newSyncTestSystem(t, 3, 10, doServerToClient, &Params{5, 500, 1, 0, 1}).
+	newSyncTestSystem(t, 3, 10, doServerToClient, makeParams(5, 500, 1, 1)).
 		setDescription("TestServerToClient2: Stream from server to client").
 		setMaxEpochs(12).
 		runTest()
 }
 
 func TestServerToClient3(t *testing.T) {
-	newSyncTestSystem(t, 5, 500, doServerToClient, &Params{5, 2000, 1, 0, 1}).
+	newSyncTestSystem(t, 5, 500, doServerToClient, makeParams(5, 2000, 1, 1)).
 		setDescription("TestServerToClient3: Stream from server to client").
 		setMaxEpochs(20).
 		runTest()
 }
 
 func TestClientToServer1(t *testing.T) {
-	newSyncTestSystem(t, 1, 10, doClientToServer, &Params{5, 500, 1, 0, 1}).
+	newSyncTestSystem(t, 1, 10, doClientToServer, makeParams(5, 500, 1, 1)).
 		setDescription("TestClientToServer1: Stream from client to server").
 		setMaxEpochs(12).
 		runTest()
 }
 
 func TestClientToServer2(t *testing.T) {
-	newSyncTestSystem(t, 3, 10, doClientToServer, &Params{5, 500, 1, 0, 1}).
+	newSyncTestSystem(t, 3, 10, doClientToServer, makeParams(5, 500, 1, 1)).
 		setDescription("TestClientToServer2: Stream from client to server").
 		setMaxEpochs(12).
 		runTest()
 }
 
 func TestClientToServer3(t *testing.T) {
-	newSyncTestSystem(t, 5, 500, doClientToServer, &Params{5, 2000, 1, 0, 1}).
+	newSyncTestSystem(t, 5, 500, doClientToServer, makeParams(5, 2000, 1, 1)).
 		setDescription("TestClientToServer3: Stream from client to server").
 		setMaxEpochs(20).
 		runTest()
 }
 
 func TestRoundTrip1(t *testing.T) {
-	newSyncTestSystem(t, 1, 10, doRoundTrip, &Params{5, 500, 1, 0, 1}).
+	newSyncTestSystem(t, 1, 10, doRoundTrip, makeParams(5, 500, 1, 1)).
 		setDescription("TestRoundTrip1: Buffered msgs in client and server").
 		setMaxEpochs(12).
 		runTest()
 }
 
 func TestRoundTrip2(t *testing.T) {
-	newSyncTestSystem(t, 3, 10, doRoundTrip, &Params{5, 500, 1, 0, 1}).
+	newSyncTestSystem(t, 3, 10, doRoundTrip, makeParams(5, 500, 1, 1)).
 		setDescription("TestRoundTrip2: Buffered msgs in client and server").
 		setMaxEpochs(12).
 		runTest()
 }
 
 func TestRoundTrip3(t *testing.T) {
-	newSyncTestSystem(t, 5, 500, doRoundTrip, &Params{5, 2000, 1, 0, 1}).
+	newSyncTestSystem(t, 5, 500, doRoundTrip, makeParams(5, 2000, 1, 1)).
 		setDescription("TestRoundTrip3: Buffered msgs in client and server").
 		setMaxEpochs(20).
 		runTest()
@@ -0,0 +1,353 @@
+// Adversarial tests. A scripted peer from the lsptest package sends
+// malformed, out of place or hostile messages to a real client or server,
+// which must neither panic, deadlock nor deliver anything it shouldn't.
+
+package lsp_test
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+	"github.com/cmu440/lsptest"
+)
+
+const adversaryEpochMillis = 100
+
+func adversaryParams(windowSize, maxUnackedMessages int) *lsp.Params {
+	return &lsp.Params{
+		EpochLimit:         5,
+		EpochMillis:        adversaryEpochMillis,
+		WindowSize:         windowSize,
+		MaxUnackedMessages: maxUnackedMessages,
+	}
+}
+
+func epochs(n int) time.Duration {
+	return time.Duration(n*adversaryEpochMillis) * time.Millisecond
+}
+
+type serverRead struct {
+	connID  int
+	payload []byte
+	err     error
+}
+
+type adversaryTestSystem struct {
+	t        *testing.T
+	server   lsp.Server
+	hostport string
+	reads    chan serverRead
+}
+
+func newAdversaryTestSystem(t *testing.T, desc string, params *lsp.Params) *adversaryTestSystem {
+	fmt.Printf("=== %s (%d window size, %d max unacked messages)\n",
+		desc, params.WindowSize, params.MaxUnackedMessages)
+	ts := &adversaryTestSystem{t: t, reads: make(chan serverRead, 1000)}
+	var err error
+	for i := 0; i < 5 && ts.server == nil; i++ {
+		port := 3000 + rand.Intn(50000)
+		ts.hostport = lspnet.JoinHostPort("localhost", strconv.Itoa(port))
+		ts.server, err = lsp.NewServer(port, params)
+	}
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	// closed is closed just before the server, so that the reader below
+	// stops at the first error Close causes.
+	closed := make(chan struct{})
+	t.Cleanup(func() {
+		close(closed)
+		ts.server.Close()
+	})
+	go func() {
+		for {
+			connID, payload, err := ts.server.Read()
+			if err != nil {
+				select {
+				case <-closed:
+					return
+				default:
+				}
+			}
+			select {
+			case ts.reads <- serverRead{connID, payload, err}:
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return ts
+}
+
+// dial returns a peer that has connected to the server with the given ISN.
+func (ts *adversaryTestSystem) dial(isn int) (*lsptest.Peer, int) {
+	peer, err := lsptest.Dial(ts.hostport)
+	if err != nil {
+		ts.t.Fatalf("Failed to dial server: %s", err)
+	}
+	ts.t.Cleanup(func() { peer.Close() })
+	connID, err := peer.Connect(isn, epochs(5))
+	if err != nil {
+		ts.t.Fatalf("Server did not accept the connection: %s", err)
+	}
+	return peer, connID
+}
+
+func (ts *adversaryTestSystem) expectRead(connID int, payload string) {
+	select {
+	case r := <-ts.reads:
+		if r.err != nil || r.connID != connID || string(r.payload) != payload {
+			ts.t.Fatalf("Server read (%d, %q, %v), expected (%d, %q, <nil>)",
+				r.connID, r.payload, r.err, connID, payload)
+		}
+	case <-time.After(epochs(10)):
+		ts.t.Fatalf("Server did not read %q from client %d", payload, connID)
+	}
+}
+
+func (ts *adversaryTestSystem) expectNoRead(d time.Duration) {
+	select {
+	case r := <-ts.reads:
+		ts.t.Fatalf("Server unexpectedly read (%d, %q, %v)", r.connID, r.payload, r.err)
+	case <-time.After(d):
+	}
+}
+
+// write calls Write on the server, failing if it blocks.
+func (ts *adversaryTestSystem) write(connID int, payload string) {
+	done := make(chan error, 1)
+	go func() { done <- ts.server.Write(connID, []byte(payload)) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			ts.t.Fatalf("Server failed to write to client %d: %s", connID, err)
+		}
+	case <-time.After(epochs(5)):
+		ts.t.Fatalf("Server Write blocked")
+	}
+}
+
+func expectPayload(t *testing.T, peer *lsptest.Peer, payload string) *lsp.Message {
+	msg, err := peer.Expect(epochs(10), func(m *lsp.Message) bool {
+		return m.Type == lsp.MsgData && string(m.Payload) == payload
+	})
+	if err != nil {
+		t.Fatalf("Peer never received %q: %s", payload, err)
+	}
+	return msg
+}
+
+func TestAdversaryAckUnsent(t *testing.T) {
+	ts := newAdversaryTestSystem(t, "TestAdversaryAckUnsent: Acks for unsent messages are ignored", adversaryParams(1, 1))
+	peer, connID := ts.dial(10)
+	peer.Send(lsp.NewAck(connID, 1000))
+	peer.Send(lsp.NewCAck(connID, 1000))
+	peer.Send(lsp.NewAck(connID, -1))
+
+	// The bogus acks must not count as acks for the message sent next, so
+	// it is retransmitted until the peer really acks it.
+	ts.write(connID, "x")
+	first := expectPayload(t, peer, "x")
+	expectPayload(t, peer, "x")
+	peer.Send(lsp.NewAck(connID, first.SeqNum))
+
+	peer.Send(lsptest.Data(connID, 11, []byte("y")))
+	ts.expectRead(connID, "y")
+}
+
+func TestAdversaryBogusConnID(t *testing.T) {
+	ts := newAdversaryTestSystem(t, "TestAdversaryBogusConnID: Data for unknown connections is not delivered", adversaryParams(1, 1))
+	peer, connID := ts.dial(10)
+	peer.Send(lsptest.Data(connID+100, 11, []byte("bogus")))
+	peer.Send(lsptest.Data(-1, 11, []byte("bogus")))
+	ts.expectNoRead(epochs(2))
+	peer.Send(lsptest.Data(connID, 11, []byte("real")))
+	ts.expectRead(connID, "real")
+	ts.expectNoRead(epochs(2))
+}
+
+func TestAdversaryCAckBackwards(t *testing.T) {
+	ts := newAdversaryTestSystem(t, "TestAdversaryCAckBackwards: A stale CAck does not undo a newer one", adversaryParams(3, 3))
+	peer, connID := ts.dial(10)
+	var last int
+	for _, payload := range []string{"a", "b", "c"} {
+		ts.write(connID, payload)
+		last = expectPayload(t, peer, payload).SeqNum
+	}
+	peer.Send(lsp.NewCAck(connID, last))
+	peer.Send(lsp.NewCAck(connID, last-2))
+	// Retransmissions may already be on their way before the CAck arrives.
+	peer.Collect(epochs(1))
+	for _, msg := range peer.Collect(epochs(4)) {
+		if msg.Type == lsp.MsgData {
+			t.Fatalf("Server retransmitted %s after it was acked", msg)
+		}
+	}
+	ts.write(connID, "d")
+	msg := expectPayload(t, peer, "d")
+	peer.Send(lsp.NewAck(connID, msg.SeqNum))
+}
+
+func TestAdversarySizeTooLarge(t *testing.T) {
+	ts := newAdversaryTestSystem(t, "TestAdversarySizeTooLarge: Messages shorter than their Size are dropped", adversaryParams(1, 1))
+	peer, connID := ts.dial(10)
+	payload := []byte("short")
+	size := len(payload) + 5
+	peer.Send(lsp.NewData(connID, 11, size, payload, lsp.CalculateChecksum(connID, 11, size, payload)))
+	ts.expectNoRead(epochs(2))
+	peer.Send(lsptest.Data(connID, 11, []byte("ok")))
+	ts.expectRead(connID, "ok")
+}
+
+func TestAdversaryConnectFlood(t *testing.T) {
+	ts := newAdversaryTestSystem(t, "TestAdversaryConnectFlood: Many simultaneous connects", adversaryParams(1, 1))
+	const numPeers = 50
+	type conn struct {
+		peer   *lsptest.Peer
+		isn    int
+		connID int
+		err    error
+	}
+	conns := make(chan conn, numPeers)
+	for i := 0; i < numPeers; i++ {
+		peer, err := lsptest.Dial(ts.hostport)
+		if err != nil {
+			t.Fatalf("Failed to dial server: %s", err)
+		}
+		defer peer.Close()
+		go func(peer *lsptest.Peer, isn int) {
+			connID, err := peer.Connect(isn, epochs(5))
+			conns <- conn{peer, isn, connID, err}
+		}(peer, i+1)
+	}
+	seen := make(map[int]bool)
+	for i := 0; i < numPeers; i++ {
+		c := <-conns
+		if c.err != nil {
+			t.Fatalf("Server did not accept connection %d: %s", i, c.err)
+		}
+		if seen[c.connID] {
+			t.Fatalf("Connection ID %d was handed out twice", c.connID)
+		}
+		seen[c.connID] = true
+		c.peer.Send(lsptest.Data(c.connID, c.isn+1, []byte(strconv.Itoa(c.connID))))
+	}
+	for i := 0; i < numPeers; i++ {
+		select {
+		case r := <-ts.reads:
+			if r.err != nil || string(r.payload) != strconv.Itoa(r.connID) || !seen[r.connID] {
+				t.Fatalf("Server read (%d, %q, %v)", r.connID, r.payload, r.err)
+			}
+			delete(seen, r.connID)
+		case <-time.After(epochs(10)):
+			t.Fatalf("Server read only %d of %d messages", i, numPeers)
+		}
+	}
+}
+
+func TestAdversaryDuplicateConnect(t *testing.T) {
+	ts := newAdversaryTestSystem(t, "TestAdversaryDuplicateConnect: Repeated connects make one connection", adversaryParams(1, 1))
+	peer, err := lsptest.Dial(ts.hostport)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %s", err)
+	}
+	defer peer.Close()
+	const isn = 42
+	for i := 0; i < 5; i++ {
+		peer.Send(lsp.NewConnect(isn))
+	}
+	connID := -1
+	for _, msg := range peer.Collect(epochs(1)) {
+		if msg.Type != lsp.MsgAck || msg.SeqNum != isn {
+			continue
+		}
+		if connID != -1 && msg.ConnID != connID {
+			t.Fatalf("Repeated connects were acked with IDs %d and %d", connID, msg.ConnID)
+		}
+		connID = msg.ConnID
+	}
+	if connID == -1 {
+		t.Fatal("Server never acked the connect")
+	}
+	peer.Send(lsptest.Data(connID, isn+1, []byte("once")))
+	ts.expectRead(connID, "once")
+
+	// Keep the real connection alive for longer than the epoch limit. Any
+	// extra connections created by the duplicates would be lost by now.
+	for i := 0; i < 8; i++ {
+		peer.Send(lsp.NewAck(connID, 0))
+		ts.expectNoRead(epochs(1))
+	}
+}
+
+func TestAdversaryClientHostileServer(t *testing.T) {
+	fmt.Printf("=== TestAdversaryClientHostileServer: Client ignores bogus messages from the server\n")
+	port := 3000 + rand.Intn(50000)
+	peer, err := lsptest.Listen(port)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer peer.Close()
+	type result struct {
+		client lsp.Client
+		err    error
+	}
+	clients := make(chan result, 1)
+	go func() {
+		cli, err := lsp.NewClient(lspnet.JoinHostPort("localhost", strconv.Itoa(port)), 1, adversaryParams(1, 1))
+		clients <- result{cli, err}
+	}()
+	const connID = 5
+	if _, err := peer.Accept(connID, epochs(5)); err != nil {
+		t.Fatalf("Client never connected: %s", err)
+	}
+	res := <-clients
+	if res.err != nil {
+		t.Fatalf("Client failed to connect: %s", res.err)
+	}
+	cli := res.client
+	defer cli.Close()
+
+	reads := make(chan []byte, 10)
+	go func() {
+		for {
+			payload, err := cli.Read()
+			if err != nil {
+				return
+			}
+			reads <- payload
+		}
+	}()
+	peer.Send(lsp.NewAck(connID, 500))
+	peer.Send(lsptest.Data(connID+1, 1, []byte("wrong conn")))
+	size := 20
+	peer.Send(lsp.NewData(connID, 1, size, []byte("short"), lsp.CalculateChecksum(connID, 1, size, []byte("short"))))
+	peer.Send(lsp.NewData(connID, 1, 2, []byte("ok"), 0xbad))
+	peer.Send(lsptest.Data(connID, 1, []byte("ok")))
+	select {
+	case payload := <-reads:
+		if string(payload) != "ok" {
+			t.Fatalf("Client read %q, expected \"ok\"", payload)
+		}
+	case <-time.After(epochs(10)):
+		t.Fatal("Client never read the valid message")
+	}
+	select {
+	case payload := <-reads:
+		t.Fatalf("Client unexpectedly read %q", payload)
+	case <-time.After(epochs(2)):
+	}
+
+	// The bogus ack must not acknowledge the client's next message.
+	if err := cli.Write([]byte("w")); err != nil {
+		t.Fatalf("Client failed to write: %s", err)
+	}
+	expectPayload(t, peer, "w")
+	msg := expectPayload(t, peer, "w")
+	peer.Send(lsp.NewAck(connID, msg.SeqNum))
+}
@@ -0,0 +1,306 @@
+// Fuzz tests.
+
+// FuzzMessageDecode and FuzzChecksum check message decoding and checksums
+// against arbitrary input. FuzzStateful runs a client and a server over an
+// in-memory network while forging extra messages (acks for any sequence
+// number, corrupted or truncated data, stray connects) alongside the real
+// ones. Whatever is forged, each side must Read a prefix of what the other
+// side wrote, in order, with nothing duplicated or corrupted, and without
+// panicking or deadlocking. Only forged acks can make a message be lost, so
+// unless one was forged, each side must Read everything.
+//
+// The seed inputs run as part of the ordinary tests. To search for new
+// failures, run for example:
+//
+//     go test -run=XXX -fuzz=FuzzStateful -fuzztime=1m
+
+package lsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
+
+func FuzzMessageDecode(f *testing.F) {
+	for _, msg := range []*Message{
+		NewConnect(1),
+		NewData(1, 2, 5, []byte("hello"), CalculateChecksum(1, 2, 5, []byte("hello"))),
+		NewData(7, 3, 10, []byte("short"), 0),
+		NewAck(1, 0),
+		NewCAck(3, 9),
+	} {
+		b, _ := json.Marshal(msg)
+		f.Add(b)
+	}
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`{"Type":1,"Payload":null,"Size":-1}`))
+	f.Add([]byte(`{"Type":9,"ConnID":1e3,"Payload":"!!"}`))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var msg Message
+		if json.Unmarshal(b, &msg) != nil {
+			return
+		}
+		_ = msg.String()
+		out, err := json.Marshal(&msg)
+		if err != nil {
+			t.Fatalf("Failed to re-encode %s: %s", &msg, err)
+		}
+		var again Message
+		if err := json.Unmarshal(out, &again); err != nil {
+			t.Fatalf("Failed to decode re-encoded %q: %s", out, err)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Fatalf("Message %s changed to %s when re-encoded", &msg, &again)
+		}
+	})
+}
+
+func FuzzChecksum(f *testing.F) {
+	f.Add(1, 1, 5, []byte("hello"))
+	f.Add(0, 0, 0, []byte{})
+	f.Add(-1, 1<<40, 3, []byte{0xff, 0xff, 0xff})
+	f.Add(65535, 65536, 1, []byte{0})
+	f.Fuzz(func(t *testing.T, connID, seqNum, size int, payload []byte) {
+		orig := append([]byte(nil), payload...)
+		sum := CalculateChecksum(connID, seqNum, size, payload)
+		if !bytes.Equal(payload, orig) {
+			t.Fatal("CalculateChecksum modified the payload")
+		}
+		if again := CalculateChecksum(connID, seqNum, size, orig); again != sum {
+			t.Fatalf("Checksum changed from %d to %d for the same input", sum, again)
+		}
+
+		// Adding the checksum to the one's complement sum of the fields
+		// gives negative zero.
+		total := Int2Checksum(connID) + Int2Checksum(seqNum) + Int2Checksum(size) +
+			ByteArray2Checksum(payload) + uint32(sum)
+		for total > 0xffff {
+			total = total>>16 + total&0xffff
+		}
+		if total != 0xffff {
+			t.Fatalf("Checksum %d does not verify (sum is %#x)", sum, total)
+		}
+
+		// Odd length payloads are padded with a zero byte.
+		if len(payload)%2 == 1 {
+			padded := append(append([]byte(nil), payload...), 0)
+			if padded := CalculateChecksum(connID, seqNum, size, padded); padded != sum {
+				t.Fatalf("Checksum %d differs from %d with explicit padding", sum, padded)
+			}
+		}
+
+		// Any single flipped bit is detected.
+		for i := 0; i < len(payload) && i < 64; i++ {
+			flipped := append([]byte(nil), payload...)
+			flipped[i] ^= 1
+			if CalculateChecksum(connID, seqNum, size, flipped) == sum {
+				t.Fatalf("Flipping byte %d of the payload went undetected", i)
+			}
+		}
+	})
+}
+
+// A forger emits forged messages alongside the real ones written by the
+// client and the server. Its input is a series of records, one per forged
+// message:
+//
+//	kind, direction, ConnID offset, SeqNum offset, corruption, length, payload...
+//
+// Offsets are relative to the real message that triggers the forgery.
+type forger struct {
+	lock      sync.Mutex
+	records   [2][]*lspnet.TemporaryMessage // Indexed by lspnet.Direction.
+	forgedAck bool                          // True once an Ack or CAck has been forged.
+}
+
+func newForger(input []byte) *forger {
+	fg := new(forger)
+	for len(input) >= 6 {
+		kind, dir, connOff, seqOff, corruption := input[0]%4, input[1]%2, int8(input[2])%3, int8(input[3]), input[4]%3
+		n := int(input[5] % 16)
+		input = input[6:]
+		if n > len(input) {
+			n = len(input)
+		}
+		msg := &lspnet.TemporaryMessage{
+			ConnID:  int(connOff),
+			SeqNum:  int(seqOff),
+			Size:    int(corruption), // Resolved once the real message is known.
+			Payload: append([]byte(nil), input[:n]...),
+		}
+		input = input[n:]
+		switch kind {
+		case 0:
+			msg.Type = int(MsgData)
+		case 1:
+			msg.Type = int(MsgAck)
+		case 2:
+			msg.Type = int(MsgCAck)
+		case 3:
+			msg.Type = int(MsgConnect)
+		}
+		fg.records[dir] = append(fg.records[dir], msg)
+	}
+	return fg
+}
+
+func (fg *forger) Process(pkt *lspnet.Packet) []*lspnet.Packet {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+	if len(fg.records[pkt.Dir]) == 0 {
+		return []*lspnet.Packet{pkt}
+	}
+	rec := fg.records[pkt.Dir][0]
+	fg.records[pkt.Dir] = fg.records[pkt.Dir][1:]
+	forged := *rec
+	forged.ConnID += pkt.Msg.ConnID
+	forged.SeqNum += pkt.Msg.SeqNum
+	if forged.Type == int(MsgData) {
+		corrupt(&forged, int(rec.Size))
+	} else {
+		forged.Size, forged.Payload = 0, nil
+	}
+	if forged.Type == int(MsgAck) || forged.Type == int(MsgCAck) {
+		fg.forgedAck = true
+	}
+	return []*lspnet.Packet{pkt, pkt.WithMsg(&forged)}
+}
+
+// lossy reports whether an ack has been forged, which may make the sender
+// drop a message the receiver never got.
+func (fg *forger) lossy() bool {
+	fg.lock.Lock()
+	defer fg.lock.Unlock()
+	return fg.forgedAck
+}
+
+// corrupt makes sure a forged data message can never be accepted: either its
+// Size claims more than its payload, or its checksum is wrong whether or not
+// the payload is truncated to Size.
+func corrupt(msg *lspnet.TemporaryMessage, how int) {
+	n := len(msg.Payload)
+	switch how {
+	case 0:
+		msg.Size = n
+	case 1:
+		msg.Size = n + 1 + n%7
+		msg.Checksum = CalculateChecksum(msg.ConnID, msg.SeqNum, msg.Size, msg.Payload)
+		return
+	case 2:
+		msg.Size = n / 2
+	}
+	full := CalculateChecksum(msg.ConnID, msg.SeqNum, msg.Size, msg.Payload)
+	truncated := CalculateChecksum(msg.ConnID, msg.SeqNum, msg.Size, msg.Payload[:msg.Size])
+	for msg.Checksum = full + 1; msg.Checksum == full || msg.Checksum == truncated; msg.Checksum++ {
+	}
+}
+
+const fuzzPort = 7777
+
+func FuzzStateful(f *testing.F) {
+	f.Add(uint8(3), []byte{})
+	// Acks and CAcks for nearby sequence numbers in both directions.
+	f.Add(uint8(4), []byte{1, 0, 0, 1, 0, 0, 2, 1, 0, 2, 0, 0, 1, 1, 0, 0, 0, 0, 2, 0, 0, 0xfe, 0, 0})
+	// Data with bad checksums, inflated sizes and truncation.
+	f.Add(uint8(2), []byte{0, 0, 0, 1, 0, 3, 'b', 'a', 'd', 0, 1, 0, 1, 1, 2, 'n', 'o', 0, 0, 0, 2, 2, 4, 'l', 'o', 'n', 'g'})
+	// Stray connects and messages for other connections.
+	f.Add(uint8(3), []byte{3, 0, 0, 0, 0, 0, 0, 0, 1, 1, 0, 2, 'h', 'i', 1, 1, 2, 1, 0, 0})
+	f.Fuzz(func(t *testing.T, numMsgs uint8, input []byte) {
+		lspnet.SetTransport(lspnet.NewSimNetwork(lspnet.RealClock()))
+		defer lspnet.SetTransport(nil)
+		fg := newForger(input)
+		lspnet.SetChain(fg)
+		defer lspnet.ClearChain()
+		runStatefulFuzz(t, fg, int(numMsgs%5)+1)
+	})
+}
+
+func runStatefulFuzz(t *testing.T, fg *forger, numMsgs int) {
+	params := makeParams(5, 20, 3, 2)
+	srv, err := NewServer(fuzzPort, params)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	cli, err := NewClient(lspnet.JoinHostPort("localhost", fmt.Sprint(fuzzPort)), 100, params)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	var sent [][]byte
+	for i := 0; i < numMsgs; i++ {
+		sent = append(sent, []byte(fmt.Sprintf("msg-%d", i)))
+	}
+	// The server echoes what it reads.
+	srvReads := make(chan []byte, numMsgs)
+	go func() {
+		for {
+			connID, payload, err := srv.Read()
+			if err != nil {
+				return
+			}
+			srvReads <- payload
+			srv.Write(connID, payload)
+		}
+	}()
+	cliReads := make(chan []byte, numMsgs)
+	go func() {
+		for {
+			payload, err := cli.Read()
+			if err != nil {
+				return
+			}
+			cliReads <- payload
+		}
+	}()
+	for _, payload := range sent {
+		if err := cli.Write(payload); err != nil {
+			t.Fatalf("Client failed to write: %s", err)
+		}
+	}
+
+	// Forged acks may cause messages to be lost, so then Read need only
+	// return a prefix of what was written.
+	checkPrefix := func(side string, reads chan []byte) {
+		deadline := time.After(time.Duration(10*params.EpochMillis) * time.Millisecond)
+		for i := 0; i < numMsgs; i++ {
+			select {
+			case payload := <-reads:
+				if !bytes.Equal(payload, sent[i]) {
+					t.Fatalf("%s read %q as message %d, expected %q", side, payload, i, sent[i])
+				}
+			case <-deadline:
+				if !fg.lossy() {
+					t.Fatalf("%s read %d of %d messages, though no acks were forged", side, i, numMsgs)
+				}
+				return
+			}
+		}
+		select {
+		case payload := <-reads:
+			t.Fatalf("%s read extra message %q", side, payload)
+		case <-time.After(time.Duration(2*params.EpochMillis) * time.Millisecond):
+		}
+	}
+	checkPrefix("Server", srvReads)
+	checkPrefix("Client", cliReads)
+
+	closed := make(chan struct{})
+	go func() {
+		cli.Close()
+		srv.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close deadlocked")
+	}
+}
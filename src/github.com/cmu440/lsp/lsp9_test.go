@@ -0,0 +1,169 @@
+// Chaos tests. Clients exchange messages with an echo server while the
+// network drops packets and partitions the server from its clients. Every
+// call on the clients and the server is recorded, and the history is then
+// checked against LSP's delivery guarantees rather than by counting
+// messages.
+
+package lsp_test
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+	"github.com/cmu440/lsptest"
+)
+
+type chaosTestSystem struct {
+	t           *testing.T
+	desc        string
+	params      *lsp.Params
+	numClients  int
+	numMsgs     int
+	dropPercent int
+	partition   bool
+	history     *lsptest.History
+}
+
+func newChaosTestSystem(t *testing.T, desc string, numClients, numMsgs int, params *lsp.Params) *chaosTestSystem {
+	return &chaosTestSystem{
+		t:          t,
+		desc:       desc,
+		params:     params,
+		numClients: numClients,
+		numMsgs:    numMsgs,
+		history:    lsptest.NewHistory(),
+	}
+}
+
+func (ts *chaosTestSystem) setDropPercent(p int) *chaosTestSystem {
+	ts.dropPercent = p
+	return ts
+}
+
+func (ts *chaosTestSystem) setPartition(partition bool) *chaosTestSystem {
+	ts.partition = partition
+	return ts
+}
+
+func (ts *chaosTestSystem) run() {
+	fmt.Printf("=== %s (%d clients, %d msgs/client, %d%% drop rate, partition: %t)\n",
+		ts.desc, ts.numClients, ts.numMsgs, ts.dropPercent, ts.partition)
+	var srv lsp.Server
+	var port int
+	var err error
+	for i := 0; i < 5 && srv == nil; i++ {
+		port = 3000 + rand.Intn(50000)
+		srv, err = lsp.NewServer(port, ts.params)
+	}
+	if err != nil {
+		ts.t.Fatalf("Failed to start server: %s", err)
+	}
+	srv = ts.history.RecordServer(srv)
+	stopAcks := ts.history.WatchAcks()
+	go func() {
+		for {
+			connID, payload, err := srv.Read()
+			if err != nil {
+				if connID == 0 {
+					return
+				}
+				continue
+			}
+			srv.Write(connID, payload)
+		}
+	}()
+
+	clients := make([]lsp.Client, ts.numClients)
+	for i := range clients {
+		cli, err := lsp.NewClient(lspnet.JoinHostPort("localhost", strconv.Itoa(port)), rand.Intn(256)+1, ts.params)
+		if err != nil {
+			ts.t.Fatalf("Client failed to connect: %s", err)
+		}
+		clients[i] = ts.history.RecordClient(cli)
+	}
+
+	lspnet.SetWriteDropPercent(ts.dropPercent)
+	defer lspnet.SetWriteDropPercent(0)
+	if ts.partition {
+		epoch := time.Duration(ts.params.EpochMillis) * time.Millisecond
+		cancel := lspnet.PartitionDuring(epoch, 1, 2, []string{":" + strconv.Itoa(port)}, lspnet.ClientAddrs())
+		defer lspnet.Heal()
+		defer cancel()
+	}
+
+	var wg sync.WaitGroup
+	for i, cli := range clients {
+		wg.Add(2)
+		go func(i int, cli lsp.Client) {
+			defer wg.Done()
+			for j := 0; j < ts.numMsgs; j++ {
+				if cli.Write([]byte(fmt.Sprintf("client %d message %d", i, j))) != nil {
+					return
+				}
+			}
+		}(i, cli)
+		go func(cli lsp.Client) {
+			defer wg.Done()
+			for j := 0; j < ts.numMsgs; j++ {
+				if _, err := cli.Read(); err != nil {
+					return
+				}
+			}
+		}(cli)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(20*ts.params.EpochLimit*ts.params.EpochMillis) * time.Millisecond):
+		ts.t.Fatal("Test timed out waiting for the echoes")
+	}
+
+	lspnet.SetWriteDropPercent(0)
+	for _, cli := range clients {
+		cli.Close()
+	}
+	srv.Close()
+	stopAcks()
+	for _, a := range ts.history.Check() {
+		ts.t.Error(a)
+	}
+}
+
+func chaosParams() *lsp.Params {
+	return &lsp.Params{
+		EpochLimit:         20,
+		EpochMillis:        100,
+		WindowSize:         5,
+		MaxBackOffInterval: 2,
+		MaxUnackedMessages: 3,
+	}
+}
+
+func TestChaos1(t *testing.T) {
+	newChaosTestSystem(t, "TestChaos1: Echo over a lossy network", 3, 20, chaosParams()).
+		setDropPercent(20).
+		run()
+}
+
+func TestChaos2(t *testing.T) {
+	newChaosTestSystem(t, "TestChaos2: Echo across a temporary partition", 3, 20, chaosParams()).
+		setPartition(true).
+		run()
+}
+
+func TestChaos3(t *testing.T) {
+	newChaosTestSystem(t, "TestChaos3: Echo over a lossy, partitioned network", 5, 30, chaosParams()).
+		setDropPercent(10).
+		setPartition(true).
+		run()
+}
@@ -2,7 +2,12 @@
 
 package lsp
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+
+	"github.com/cmu440/lspnet"
+)
 
 // Default values for LSP parameters.
 const (
@@ -33,6 +38,11 @@ type Params struct {
 	// MaxUnackedMessages is the maximum number of unacknowledged messages
 	// allowed to be sent out within the sliding window.
 	MaxUnackedMessages int
+
+	// Clock is the source of time for epoch events. If nil, the system's wall
+	// clock is used. Implementations should create their epoch ticker with
+	// EpochTicker so that tests can step them through epochs with a FakeClock.
+	Clock lspnet.Clock
 }
 
 // NewParams returns a Params with default field values.
@@ -55,3 +65,13 @@ func (p *Params) String() string {
 		"MaxUnackedMessages: %d]",
 		p.EpochLimit, p.EpochMillis, p.WindowSize, p.MaxBackOffInterval, p.MaxUnackedMessages)
 }
+
+// EpochTicker returns a ticker that fires once every EpochMillis milliseconds
+// of p's Clock.
+func (p *Params) EpochTicker() lspnet.Ticker {
+	clock := p.Clock
+	if clock == nil {
+		clock = lspnet.RealClock()
+	}
+	return clock.NewTicker(time.Duration(p.EpochMillis) * time.Millisecond)
+}
@@ -0,0 +1,196 @@
+package lspnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func captureSample(t *testing.T) []*CapturedPacket {
+	srv, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	srvChan := receive(srv)
+	dropAcks := StageFunc(func(pkt *Packet) []*Packet {
+		if pkt.Msg.Type == TypeMsgAck {
+			return nil
+		}
+		return []*Packet{pkt}
+	})
+	delayData := StageFunc(func(pkt *Packet) []*Packet {
+		if pkt.Msg.SeqNum == 2 {
+			pkt.Delay = 10 * time.Millisecond
+		}
+		return []*Packet{pkt}
+	})
+	bumpSeqNum := Mutate(func(msg *TemporaryMessage) bool {
+		if msg.SeqNum != 3 {
+			return false
+		}
+		msg.SeqNum = 4
+		return true
+	})
+	SetChain(dropAcks, delayData, bumpSeqNum)
+	defer ClearChain()
+	StartSniff()
+
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 1, Payload: []byte("one")})
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgAck, ConnID: 1, SeqNum: 1})
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 2})
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 3})
+	received := 0
+	for received < 3 && readMsg(srvChan) != nil {
+		received++
+	}
+	pkts := StopSniff().Packets
+	if received != 3 {
+		t.Fatalf("Server received %d messages, expected 3", received)
+	}
+	return pkts
+}
+
+func TestCaptureRecordsFate(t *testing.T) {
+	pkts := captureSample(t)
+	if len(pkts) != 4 {
+		t.Fatalf("Captured %d packets, expected 4", len(pkts))
+	}
+	fates := make(map[int]string)
+	for _, p := range pkts {
+		if p.Dir != ClientToServer || p.Src == "" || p.Dst == "" || p.Time.IsZero() || len(p.Raw) == 0 {
+			t.Fatalf("Incomplete capture: %+v", p)
+		}
+		if p.Msg.Type == TypeMsgAck {
+			fates[0] = p.fate()
+		} else {
+			fates[p.Msg.SeqNum] = p.fate()
+		}
+	}
+	expected := map[int]string{0: "dropped", 1: "", 2: "delayed", 4: "mutated"}
+	for k, fate := range expected {
+		if fates[k] != fate {
+			t.Errorf("Packet %d captured as %q, expected %q", k, fates[k], fate)
+		}
+	}
+	// The delayed packet leaves the chain last.
+	if last := pkts[len(pkts)-1]; last.Msg.SeqNum != 2 {
+		t.Errorf("Last captured packet has SeqNum %d, expected 2", last.Msg.SeqNum)
+	}
+	res := &SniffResult{Packets: pkts}
+	if conns := res.ByConnection(); len(conns) != 1 || len(conns[pkts[0].Src]) != 4 {
+		t.Errorf("Unexpected split by connection: %v", conns)
+	}
+}
+
+func TestCaptureReadChain(t *testing.T) {
+	srv, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	srvChan := receive(srv)
+	dropAcks := StageFunc(func(pkt *Packet) []*Packet {
+		if pkt.Msg.Type == TypeMsgAck {
+			return nil
+		}
+		return []*Packet{pkt}
+	})
+	bumpSeqNum := Mutate(func(msg *TemporaryMessage) bool {
+		if msg.SeqNum != 1 {
+			return false
+		}
+		msg.SeqNum = 5
+		return true
+	})
+	SetReadChain(dropAcks, bumpSeqNum)
+	defer ClearReadChain()
+	StartSniff()
+
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 1})
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgAck, ConnID: 1, SeqNum: 1})
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 2})
+	received := 0
+	for received < 2 && readMsg(srvChan) != nil {
+		received++
+	}
+	pkts := StopSniff().Packets
+	if received != 2 {
+		t.Fatalf("Server received %d messages, expected 2", received)
+	}
+
+	// The written packets are all captured as they were sent, and only the
+	// ones the read chain dropped or changed are captured again.
+	var fates []string
+	for _, p := range pkts {
+		fates = append(fates, fmt.Sprintf("%d/%d:%s", p.Msg.Type, p.Msg.SeqNum, p.fate()))
+	}
+	sort.Strings(fates)
+	expected := []string{"1/1:", "1/2:", "1/5:read,mutated", "2/1:", "2/1:read,dropped"}
+	if fmt.Sprint(fates) != fmt.Sprint(expected) {
+		t.Fatalf("Captured %v, expected %v", fates, expected)
+	}
+}
+
+func TestCaptureJSONLinesRoundTrip(t *testing.T) {
+	pkts := captureSample(t)
+	var buf bytes.Buffer
+	if err := WriteJSONLines(&buf, pkts); err != nil {
+		t.Fatalf("WriteJSONLines failed: %s", err)
+	}
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != len(pkts) {
+		t.Fatalf("Wrote %d lines, expected %d", lines, len(pkts))
+	}
+	read, err := ReadJSONLines(&buf)
+	if err != nil {
+		t.Fatalf("ReadJSONLines failed: %s", err)
+	}
+	if len(read) != len(pkts) {
+		t.Fatalf("Read %d packets, expected %d", len(read), len(pkts))
+	}
+	for i := range pkts {
+		a, b := pkts[i], read[i]
+		if !a.Time.Equal(b.Time) || a.Src != b.Src || a.Dst != b.Dst || a.Dir != b.Dir ||
+			a.fate() != b.fate() || !bytes.Equal(a.Raw, b.Raw) ||
+			a.Msg.SeqNum != b.Msg.SeqNum || !bytes.Equal(a.Msg.Payload, b.Msg.Payload) {
+			t.Errorf("Packet %d read back as %+v, expected %+v", i, b, a)
+		}
+	}
+}
+
+func TestCapturePcapng(t *testing.T) {
+	pkts := captureSample(t)
+	var buf bytes.Buffer
+	if err := WritePcapng(&buf, pkts); err != nil {
+		t.Fatalf("WritePcapng failed: %s", err)
+	}
+	b := buf.Bytes()
+	var types []uint32
+	var packets [][]byte
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("Truncated block: %v", b)
+		}
+		blockType := binary.LittleEndian.Uint32(b[0:])
+		total := int(binary.LittleEndian.Uint32(b[4:]))
+		if total%4 != 0 || total > len(b) || binary.LittleEndian.Uint32(b[total-4:]) != uint32(total) {
+			t.Fatalf("Malformed block of length %d", total)
+		}
+		types = append(types, blockType)
+		if blockType == pcapngEnhancedPacket {
+			capLen := int(binary.LittleEndian.Uint32(b[20:]))
+			packets = append(packets, b[28:28+capLen])
+		}
+		b = b[total:]
+	}
+	if len(types) != 2+len(pkts) || types[0] != pcapngSectionHeader || types[1] != pcapngInterfaceDesc {
+		t.Fatalf("Unexpected blocks: %x", types)
+	}
+	for i, data := range packets {
+		if ipv4Checksum(data[:ipv4HeaderLen]) != 0 {
+			t.Errorf("Packet %d has a bad IPv4 header checksum", i)
+		}
+		if !bytes.Equal(data[ipv4HeaderLen+udpHeaderLen:], pkts[i].Raw) {
+			t.Errorf("Packet %d does not carry the captured bytes as its UDP payload", i)
+		}
+		_, dstPort := splitIPv4(pkts[i].Dst)
+		if int(binary.BigEndian.Uint16(data[ipv4HeaderLen+2:])) != dstPort {
+			t.Errorf("Packet %d has the wrong UDP destination port", i)
+		}
+	}
+}
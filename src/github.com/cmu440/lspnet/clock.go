@@ -0,0 +1,200 @@
+// DO NOT MODIFY THIS FILE!
+
+package lspnet
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a source of time. The real clock is backed by the time package,
+// while a VirtualClock only moves forward when a test advances it.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc waits for the duration to elapse and then calls f. The real
+	// clock calls it in its own goroutine, and a VirtualClock from Advance.
+	// The returned Timer can be used to cancel the call.
+	AfterFunc(d time.Duration, f func()) Timer
+
+	// NewTicker returns a Ticker that delivers the time on its channel every
+	// d, dropping ticks for slow receivers.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a cancellable, single event created by Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the Timer from firing. It returns false if the timer has
+	// already fired or been stopped.
+	Stop() bool
+}
+
+// Ticker holds a channel that delivers periodic ticks of a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock returns a Clock that reads the system's wall clock.
+func RealClock() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+
+func (t realTicker) Stop() { t.t.Stop() }
+
+// VirtualClock is a Clock whose time stands still until Advance is called.
+// Timers and tickers fire, in order, as Advance moves time past them: timer
+// functions are called one at a time by Advance itself, so each sees the
+// effects of those due before it. They must not block, or call Advance.
+type VirtualClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*virtualWaiter
+}
+
+type virtualWaiter struct {
+	clock  *VirtualClock
+	when   time.Time
+	period time.Duration // Non-zero for tickers.
+	fn     func()
+	ch     chan time.Time
+}
+
+// NewVirtualClock returns a VirtualClock whose current time is start.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+// Now returns the clock's current virtual time.
+func (c *VirtualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// AfterFunc calls f once the clock has been advanced by d.
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.add(&virtualWaiter{clock: c, when: c.Now().Add(d), fn: f})
+}
+
+// NewTicker returns a Ticker that ticks every time the clock advances past a
+// multiple of d.
+func (c *VirtualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("lspnet: non-positive interval for NewTicker")
+	}
+	return virtualTicker{c.add(&virtualWaiter{clock: c, when: c.Now().Add(d), period: d, ch: make(chan time.Time, 1)})}
+}
+
+// Advance moves the clock forward by d, firing every timer and ticker that
+// falls due along the way in chronological order, including those that the
+// timers themselves start. Timers due at the same time fire in the order they
+// were started.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	target := c.now.Add(d)
+	for len(c.waiters) > 0 && !c.waiters[0].when.After(target) {
+		w := c.waiters[0]
+		c.waiters = c.waiters[1:]
+		c.now = w.when
+		if w.period > 0 {
+			w.when = w.when.Add(w.period)
+			c.insert(w)
+		}
+		now := c.now
+		c.lock.Unlock()
+		w.fire(now)
+		c.lock.Lock()
+	}
+	c.now = target
+	c.lock.Unlock()
+}
+
+// AwaitTicks waits until the last tick of every ticker has been taken from
+// its channel, so that whoever reads the tickers has seen the time Advance
+// moved to, or until timeout has passed. It reports whether they all were.
+func (c *VirtualClock) AwaitTicks(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		c.lock.Lock()
+		waiting := false
+		for _, w := range c.waiters {
+			if w.ch != nil && len(w.ch) > 0 {
+				waiting = true
+				break
+			}
+		}
+		c.lock.Unlock()
+		if !waiting {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		runtime.Gosched()
+	}
+}
+
+func (c *VirtualClock) add(w *virtualWaiter) *virtualWaiter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.insert(w)
+	return w
+}
+
+// insert keeps waiters sorted by deadline. Must be called with c.lock held.
+func (c *VirtualClock) insert(w *virtualWaiter) {
+	i := sort.Search(len(c.waiters), func(i int) bool { return c.waiters[i].when.After(w.when) })
+	c.waiters = append(c.waiters, nil)
+	copy(c.waiters[i+1:], c.waiters[i:])
+	c.waiters[i] = w
+}
+
+func (w *virtualWaiter) fire(now time.Time) {
+	if w.fn != nil {
+		w.fn()
+		return
+	}
+	select {
+	case w.ch <- now:
+	default:
+	}
+}
+
+func (w *virtualWaiter) Stop() bool {
+	c := w.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type virtualTicker struct {
+	w *virtualWaiter
+}
+
+func (t virtualTicker) C() <-chan time.Time { return t.w.ch }
+
+func (t virtualTicker) Stop() { t.w.Stop() }
@@ -8,8 +8,8 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"sync"
 	"sync/atomic"
-	"time"
 )
 
 var enableDebugLogs uint32
@@ -46,23 +46,104 @@ func isLoggingEnabled() bool {
 // proxied directly to the corresponding methods in the net.UDPConn packge, but provide
 // some additional book-keeping that is necessary for testing the students' code.
 type UDPConn struct {
-	nconn *net.UDPConn
+	nconn PacketConn // Socket provided by the Transport the conn was created with.
+	clock Clock      // Clock of that same Transport.
+	dir   Direction  // Direction of packets written to the conn.
+	rx    *readQueue // Packets out of the read chain, waiting to be read.
+}
+
+// newUDPConn wraps nconn, which was created by a server if isServer is true,
+// and by a client otherwise. Nothing is read from it until readLoop is started.
+func newUDPConn(nconn PacketConn, clock Clock, isServer bool) *UDPConn {
+	dir := ClientToServer
+	if isServer {
+		dir = ServerToClient
+	}
+	return &UDPConn{nconn: nconn, clock: clock, dir: dir, rx: newReadQueue()}
+}
+
+// Number of packets (and errors) a conn holds for reading before further
+// packets are dropped, just as a socket's receive buffer would overflow.
+const readQueueSize = 4096
+
+// A readQueue holds the packets that have come out of a conn's read chain,
+// and the errors from reading its socket, until they are read. Readers block
+// until there is something in it, so that a packet the read chain delays, or
+// injects, is delivered as soon as it comes out, even to a reader that is
+// already waiting.
+type readQueue struct {
+	lock  sync.Mutex
+	ready *sync.Cond
+	items []readItem
+	err   error // Once set, every read fails with it.
+}
+
+// A readItem is either a packet or an error, in the order they were read.
+type readItem struct {
+	pkt *Packet
+	err error
+}
+
+func newReadQueue() *readQueue {
+	q := new(readQueue)
+	q.ready = sync.NewCond(&q.lock)
+	return q
+}
+
+// push queues pkts, dropping those that don't fit.
+func (q *readQueue) push(pkts ...*Packet) {
+	for _, pkt := range pkts {
+		q.add(readItem{pkt: pkt})
+	}
+}
+
+// pushErr queues an error from reading the socket, which may yet be read
+// again.
+func (q *readQueue) pushErr(err error) {
+	q.add(readItem{err: err})
+}
+
+func (q *readQueue) add(item readItem) {
+	q.lock.Lock()
+	full := len(q.items) >= readQueueSize
+	if !full {
+		q.items = append(q.items, item)
+	}
+	q.lock.Unlock()
+	if !full {
+		q.ready.Broadcast()
+	} else if isLoggingEnabled() && item.pkt != nil {
+		log.Printf("DROPPING read packet of length %d\n", len(item.pkt.bytes()))
+	}
+}
+
+// fail makes every read from now on fail with err, since the socket has been
+// closed.
+func (q *readQueue) fail(err error) {
+	q.lock.Lock()
+	q.items, q.err = nil, err
+	q.lock.Unlock()
+	q.ready.Broadcast()
+}
+
+// pop returns the next packet, waiting for one if need be, or an error.
+func (q *readQueue) pop() (*Packet, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.items) == 0 && q.err == nil {
+		q.ready.Wait()
+	}
+	if q.err != nil {
+		return nil, q.err
+	}
+	item := q.items[0]
+	q.items = q.items[1:]
+	return item.pkt, item.err
 }
 
 // Read implements the Conn Read method.
 func (c *UDPConn) Read(b []byte) (n int, err error) {
-	var buffer [2000]byte
-	for {
-		n, err = c.nconn.Read(buffer[0:])
-		if sometimes(readDropPercent(c)) {
-			if isLoggingEnabled() {
-				log.Printf("DROPPING read packet of length %d\n", n)
-			}
-		} else {
-			copy(b, buffer[0:])
-			break
-		}
-	}
+	n, _, err = c.read(b)
 	return n, err
 }
 
@@ -70,28 +151,59 @@ func (c *UDPConn) Read(b []byte) (n int, err error) {
 // It returns the number of bytes copied into b and the return address that
 // was on the packet.
 func (c *UDPConn) ReadFromUDP(b []byte) (n int, addr *UDPAddr, err error) {
-	var naddr *net.UDPAddr
+	return c.read(b)
+}
+
+// read copies the next packet to make it through the read chain into b. As
+// before, the length returned is that of the whole packet, even if b is too
+// short to hold it all.
+func (c *UDPConn) read(b []byte) (int, *UDPAddr, error) {
+	pkt, err := c.rx.pop()
+	if err != nil {
+		return 0, nil, err
+	}
+	data := pkt.bytes()
+	copy(b, data)
+	return len(data), pkt.addr, nil
+}
+
+// readLoop reads packets from the socket and passes them through the read
+// chain, until the socket is closed.
+func (c *UDPConn) readLoop() {
 	var buffer [2000]byte
 	for {
-		n, naddr, err = c.nconn.ReadFromUDP(buffer[0:])
-		if sometimes(readDropPercent(c)) {
-			if isLoggingEnabled() {
-				log.Printf("DROPPING read packet of length %d\n", n)
-			}
-		} else {
-			copy(b, buffer[0:])
-			if naddr != nil {
-				addr = &UDPAddr{naddr: naddr}
-			}
-			break
+		n, naddr, err := c.nconn.ReadFromUDP(buffer[0:])
+		if errors.Is(err, net.ErrClosed) {
+			c.rx.fail(err)
+			return
+		} else if err != nil {
+			c.rx.pushErr(err)
+			continue
+		}
+		var addr *UDPAddr
+		if naddr != nil {
+			addr = &UDPAddr{naddr: naddr}
+		}
+		pkt := &Packet{
+			Msg:  new(TemporaryMessage),
+			Dir:  c.dir.reverse(),
+			Dst:  c.nconn.LocalAddr().String(),
+			raw:  append([]byte(nil), buffer[:n]...),
+			conn: c,
+			addr: addr,
+			read: true,
 		}
+		if addr != nil {
+			pkt.Src = addr.String()
+		}
+		json.Unmarshal(pkt.raw, pkt.Msg)
+		runReadChain(readStages(), pkt, 0)
 	}
-	return n, addr, err
 }
 
 // Write implements the Conn Write method.
 func (c *UDPConn) Write(b []byte) (int, error) {
-	return c.writeWithDelay(b, nil)
+	return c.write(b, nil)
 }
 
 // WriteToUDP writes a UDP packet to addr via c, copying the payload from b.
@@ -99,24 +211,11 @@ func (c *UDPConn) WriteToUDP(b []byte, addr *UDPAddr) (int, error) {
 	if addr == nil {
 		return 0, errors.New("addr must not be nil")
 	}
-	return c.writeWithDelay(b, addr)
-}
-
-func (c *UDPConn) writeWithDelay(b []byte, addr *UDPAddr) (int, error) {
-	if sometimes(int(atomic.LoadUint32(&delayMessagePercent))) {
-		if isLoggingEnabled() {
-			log.Printf("DELAYING written packet of length %d\n", len(b))
-		}
-		var clonedB = append(make([]byte, 0), b...)
-		go func() {
-			time.Sleep(time.Millisecond * time.Duration(500))
-			c.write(clonedB, addr)
-		}()
-		return len(b), nil
-	}
 	return c.write(b, addr)
 }
 
+// write passes the packet through the middlebox chain on its way to addr
+// (or to the conn's remote address, if addr is nil).
 func (c *UDPConn) write(b []byte, addr *UDPAddr) (int, error) {
 	// This uses semantic packet data (i.e. assumes it's a "Message").
 	// This is not optimal and breaks an abstraction, but is sufficient
@@ -127,73 +226,22 @@ func (c *UDPConn) write(b []byte, addr *UDPAddr) (int, error) {
 		log.Printf("This should never be reached")
 	}
 
-	if sometimes(writeDropPercent(c)) {
-		if isLoggingEnabled() {
-			log.Printf("DROPPING written packet of length %d\n", len(b))
-		}
-		if isSniff() {
-			record(&msg, false)
-		}
-		// Drop it, but make it look like it was successful.
-		return len(b), nil
+	pkt := &Packet{
+		Msg:  &msg,
+		Dir:  c.dir,
+		Src:  c.nconn.LocalAddr().String(),
+		raw:  append([]byte(nil), b...),
+		conn: c,
+		addr: addr,
 	}
-
-	if isSniff() {
-		record(&msg, true)
-	}
-
-	// TODO: Replace the shortening/corruption code (or even
-	// the snifffer, for that matter) with the more generic
-	// middlebox abstraction. For the moment, we just have
-	// to be careful that these don't step on each other.
-	if isMiddleboxStarted() {
-		middleboxRes := runMiddlebox(&msg)
-		if !middleboxRes.SendMsg {
-			// Drop it, but make it look like it was successful.
-			return len(b), nil
-
-		} else if middleboxRes.ModifiedMsg {
-			b, _ = json.Marshal(msg)
-		}
-	} else if msg.Type == TypeMsgData {
-		shorten := sometimes(int(atomic.LoadUint32(&msgShorteningPercent)))
-		lengthen := sometimes(int(atomic.LoadUint32(&msgLengtheningPercent)))
-		corruptedFlag := false
-		if atomic.LoadUint32(&corruptedMessage) == 1 {
-			corruptedFlag = true
-		}
-
-		if shorten {
-			var payload int
-			err = json.Unmarshal(msg.Payload, &payload)
-			if err != nil {
-				shorterPayload, _ := json.Marshal(payload / 1000)
-				msg.Payload = shorterPayload
-			} else {
-				msg.Payload = msg.Payload[:len(msg.Payload)/2]
-			}
-		} else if lengthen {
-			var payload int
-			err = json.Unmarshal(msg.Payload, &payload)
-			if err != nil {
-				longerPayload, _ := json.Marshal(payload * 1000)
-				msg.Payload = longerPayload
-			} else {
-				msg.Payload = append(msg.Payload, 2, 3, 4)
-			}
-		} else if corruptedFlag {
-			if len(msg.Payload) == 0 {
-				msg.Payload = []byte{^byte(0)}
-			} else {
-				msg.Payload[0] = ^msg.Payload[0]
-			}
-		}
-
-		if shorten || lengthen || corruptedFlag {
-			b, _ = json.Marshal(msg)
-		}
+	if dst := c.remoteAddr(addr); dst != nil {
+		pkt.Dst = dst.String()
 	}
+	return runChain(writeStages(), pkt, 0)
+}
 
+// send puts b on the wire, bypassing the middlebox chain.
+func (c *UDPConn) send(b []byte, addr *UDPAddr) (int, error) {
 	if addr == nil {
 		n, err := c.nconn.Write(b)
 		if err != nil {
@@ -204,6 +252,14 @@ func (c *UDPConn) write(b []byte, addr *UDPAddr) (int, error) {
 	return c.nconn.WriteToUDP(b, addr.toNet())
 }
 
+// remoteAddr returns the address a packet written to addr will be sent to.
+func (c *UDPConn) remoteAddr(addr *UDPAddr) net.Addr {
+	if addr != nil {
+		return addr.naddr
+	}
+	return c.nconn.RemoteAddr()
+}
+
 // Close closes the connection.
 func (c *UDPConn) Close() error {
 	mapMutex.Lock()
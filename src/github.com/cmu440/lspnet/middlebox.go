@@ -4,46 +4,520 @@
 package lspnet
 
 import (
+	"encoding/json"
+	"fmt"
+	"log"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// Every written packet passes through a chain of stages before it reaches the
+// network. The chain always starts with the built-in delay, drop and sniffer
+// stages (driven by SetDelayMessagePercent, Set*WriteDropPercent, Partition and
+// StartSniff), followed by the stages installed with SetChain (or the
+// middlebox installed with StartMiddlebox). When no stages are installed, it
+// ends with the built-in shortening, lengthening and corruption stage (driven
+// by SetMsgShorteningPercent, SetMsgLengtheningPercent and SetMsgCorrupted),
+// which, as it always has, leaves alone packets that a middlebox handles.
+//
+// Likewise, every packet read from the network passes through the built-in
+// read drop stage (driven by Set*ReadDropPercent) followed by the stages
+// installed with SetReadChain before it is returned to the reader. Each conn
+// reads its socket on a goroutine of its own, and queues whatever comes out
+// of the read chain, so extra packets the read chain emits, and packets it
+// delays, wake a reader that is already blocked.
+
+// Direction tells which way a packet is travelling.
+type Direction int
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) reverse() Direction {
+	return 1 - d
+}
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
+func (d Direction) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Direction) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "client->server":
+		*d = ClientToServer
+	case "server->client":
+		*d = ServerToClient
+	default:
+		return fmt.Errorf("lspnet: unknown direction %q", text)
+	}
+	return nil
+}
+
+// Packet is a datagram passing through a middlebox chain.
+type Packet struct {
+	Msg      *TemporaryMessage // Decoded contents. Stages may modify it.
+	Modified bool              // Must be set by stages that modify Msg.
+	Dir      Direction         // Which way the packet is travelling.
+	Src, Dst string            // Addresses of the sender and the receiver.
+	Delay    time.Duration     // Set by a stage to hold the packet back.
+
+	raw     []byte   // Bytes as written by the sender.
+	conn    *UDPConn // Conn the packet was written to.
+	addr    *UDPAddr // Destination, or nil for a connected conn.
+	delayed bool     // True once any stage has delayed the packet.
+	read    bool     // True for packets on the read chain.
+}
+
+// ClientAddr returns the address of the client end of the packet's
+// connection. Together with Msg.ConnID it identifies the connection.
+func (p *Packet) ClientAddr() string {
+	if p.Dir == ClientToServer {
+		return p.Src
+	}
+	return p.Dst
+}
+
+// WithMsg returns a copy of p that carries msg instead, with the same
+// addressing. Stages use it to inject forged packets into a connection.
+func (p *Packet) WithMsg(msg *TemporaryMessage) *Packet {
+	clone := *p
+	clone.Msg = msg
+	clone.Modified = true
+	return &clone
+}
+
+// Clone returns a deep copy of p, e.g. for a stage that duplicates packets.
+func (p *Packet) Clone() *Packet {
+	clone := *p
+	msg := *p.Msg
+	msg.Payload = append([]byte(nil), p.Msg.Payload...)
+	clone.Msg = &msg
+	return &clone
+}
+
+// bytes returns the packet as it should be put on the wire.
+func (p *Packet) bytes() []byte {
+	if !p.Modified {
+		return p.raw
+	}
+	b, _ := json.Marshal(p.Msg)
+	return b
+}
+
+// Stage is one step of a middlebox chain. Process receives a packet and
+// returns the packets to pass on to the next stage: none to drop it, the
+// same packet to let it through, or several to duplicate or inject packets.
+// A returned packet with a non-zero Delay is held back for that long before
+// it continues through the rest of the chain.
+//
+// Calls to Process are serialized for each chain a stage is installed in, so
+// stages need no locking of their own unless they are installed in both the
+// write and the read chain.
+type Stage interface {
+	Process(pkt *Packet) []*Packet
+}
+
+// StageFunc adapts an ordinary function to the Stage interface.
+type StageFunc func(pkt *Packet) []*Packet
+
+// Process calls f(pkt).
+func (f StageFunc) Process(pkt *Packet) []*Packet {
+	return f(pkt)
+}
+
+// MiddleboxOutput is the verdict of a MiddleboxInterface on a single message.
 type MiddleboxOutput struct {
 	SendMsg     bool // True is message should be sent, false otherwise
 	ModifiedMsg bool // True if message was modified, false otherwise
 }
 
+// MiddleboxInterface is a single-message middlebox. It is equivalent to a
+// Stage that emits at most one packet, and is kept for existing tests.
 type MiddleboxInterface interface {
 	Run(msg *TemporaryMessage) MiddleboxOutput
 }
 
-var middleboxLock sync.Mutex
-var middleboxStarted uint32 = 0
-var middleboxImpl MiddleboxInterface = nil
+// Stages that run before and after the user's chains.
+var (
+	preStages     = []Stage{StageFunc(delayStage), StageFunc(dropStage), StageFunc(sniffStage)}
+	postStages    = []Stage{StageFunc(tamperStage)}
+	readPreStages = []Stage{StageFunc(readDropStage)}
+)
+
+// The whole write and read chains, as []Stage. Each packet runs through the
+// chain that was installed when it was written or read, without locking.
+var writeChain, readChain atomic.Value
+
+func init() {
+	SetChain()
+	SetReadChain()
+}
+
+// serialStage wraps a stage installed in a chain, so that calls to its
+// Process are serialized.
+type serialStage struct {
+	lock  sync.Mutex
+	stage Stage
+}
+
+func (s *serialStage) Process(pkt *Packet) []*Packet {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stage.Process(pkt)
+}
+
+// chain returns the built-in stages before, each of stages, and the built-in
+// stages after, in that order.
+func chain(before []Stage, stages []Stage, after []Stage) []Stage {
+	all := append([]Stage(nil), before...)
+	for _, s := range stages {
+		all = append(all, &serialStage{stage: s})
+	}
+	return append(all, after...)
+}
 
-func isMiddleboxStarted() bool {
-	if atomic.LoadUint32(&middleboxStarted) == 0 {
-		return false
+// SetChain installs stages, in order, as the middlebox chain, replacing any
+// chain or middlebox installed before.
+func SetChain(stages ...Stage) {
+	if len(stages) == 0 {
+		writeChain.Store(chain(preStages, nil, postStages))
+	} else {
+		writeChain.Store(chain(preStages, stages, nil))
 	}
-	return true
 }
 
-func runMiddlebox(msg *TemporaryMessage) MiddleboxOutput {
-	middleboxLock.Lock()
-	defer middleboxLock.Unlock()
-	return middleboxImpl.Run(msg)
+// ClearChain removes the middlebox chain.
+func ClearChain() {
+	SetChain()
+}
+
+// SetReadChain installs stages, in order, as the chain that packets pass
+// through when they are read, replacing any read chain installed before.
+// A read chain sees packets from the receiver's side: it can drop, mutate or
+// duplicate them, or inject packets that were never sent (see WithMsg).
+// Packets it delays are delivered as soon as the delay expires.
+func SetReadChain(stages ...Stage) {
+	readChain.Store(chain(readPreStages, stages, nil))
 }
 
+// ClearReadChain removes the read chain.
+func ClearReadChain() {
+	SetReadChain()
+}
+
+// StartMiddlebox installs m as the only stage of the middlebox chain.
 func StartMiddlebox(m MiddleboxInterface) {
-	middleboxLock.Lock()
-	middleboxImpl = m
-	middleboxLock.Unlock()
-	atomic.StoreUint32(&middleboxStarted, 1)
+	SetChain(FromMiddlebox(m))
 }
 
+// StopMiddlebox removes the middlebox chain.
 func StopMiddlebox() {
-	atomic.StoreUint32(&middleboxStarted, 0)
-	middleboxLock.Lock()
-	middleboxImpl = nil
-	defer middleboxLock.Unlock()
+	ClearChain()
+}
+
+// FromMiddlebox adapts a MiddleboxInterface into a Stage.
+func FromMiddlebox(m MiddleboxInterface) Stage {
+	return StageFunc(func(pkt *Packet) []*Packet {
+		out := m.Run(pkt.Msg)
+		if !out.SendMsg {
+			return nil
+		}
+		pkt.Modified = pkt.Modified || out.ModifiedMsg
+		return []*Packet{pkt}
+	})
+}
+
+// writeStages returns the write chain as it is now.
+func writeStages() []Stage {
+	return writeChain.Load().([]Stage)
+}
+
+// readStages returns the read chain as it is now.
+func readStages() []Stage {
+	return readChain.Load().([]Stage)
+}
+
+// runChain passes pkt through stages starting at index from, and writes
+// whatever comes out of the end to the network. It returns the result of the
+// first write it performs directly, or len(pkt.raw) and a nil error if the
+// packet was dropped or delayed.
+func runChain(stages []Stage, pkt *Packet, from int) (int, error) {
+	n, err := len(pkt.raw), error(nil)
+	for i, p := range processChain(stages, pkt, from) {
+		observe(p, false)
+		if m, e := p.conn.send(p.bytes(), p.addr); i == 0 {
+			n, err = m, e
+		}
+	}
+	return n, err
+}
+
+// processChain runs the write chain stages starting at index from, and
+// returns the packets that come out of the end without delay. Delayed packets
+// carry on through the same stages, even if another chain has been installed
+// since.
+func processChain(stages []Stage, pkt *Packet, from int) []*Packet {
+	return runStages(stages, pkt, from, func(delayed *Packet, resume int) {
+		runChain(stages, delayed, resume)
+	})
+}
+
+// runReadChain passes pkt through the read chain stages starting at index from,
+// and queues whatever comes out of the end for the conn's reader. Packets the
+// chain delayed or changed are reported to the sniffer; the others were
+// captured as they were written.
+func runReadChain(stages []Stage, pkt *Packet, from int) {
+	pkts := processReadChain(stages, pkt, from)
+	for _, p := range pkts {
+		if p.delayed || p.Modified {
+			observe(p, false)
+		}
+	}
+	pkt.conn.rx.push(pkts...)
+}
+
+// processReadChain runs the read chain stages starting at index from, and
+// returns the packets that come out of the end without delay.
+func processReadChain(stages []Stage, pkt *Packet, from int) []*Packet {
+	return runStages(stages, pkt, from, func(delayed *Packet, resume int) {
+		runReadChain(stages, delayed, resume)
+	})
+}
+
+// runStages passes pkt through stages, starting at index from. Packets that
+// a stage delays are handed to resume once the delay has expired, along with
+// the index of the stage they should resume at.
+func runStages(stages []Stage, pkt *Packet, from int, resume func(pkt *Packet, from int)) []*Packet {
+	pkts := []*Packet{pkt}
+	for i := from; i < len(stages) && len(pkts) > 0; i++ {
+		var next []*Packet
+		for _, p := range pkts {
+			outs := stages[i].Process(p)
+			if len(outs) == 0 {
+				observe(p, true)
+			}
+			for _, out := range outs {
+				if out.Delay > 0 {
+					delayed, at, delay := out, i+1, out.Delay
+					delayed.Delay, delayed.delayed = 0, true
+					delayed.conn.clock.AfterFunc(delay, func() { resume(delayed, at) })
+				} else {
+					next = append(next, out)
+				}
+			}
+		}
+		pkts = next
+	}
+	return pkts
+}
+
+// Drop returns a stage that drops percent% of packets.
+func Drop(percent int) Stage {
+	return StageFunc(func(pkt *Packet) []*Packet {
+		if sometimes(percent) {
+			return nil
+		}
+		return []*Packet{pkt}
+	})
+}
+
+// Delay returns a stage that holds percent% of packets back for d.
+func Delay(percent int, d time.Duration) Stage {
+	return StageFunc(func(pkt *Packet) []*Packet {
+		if sometimes(percent) {
+			pkt.Delay += d
+		}
+		return []*Packet{pkt}
+	})
+}
+
+// Mutate returns a stage that calls fn on every message. fn must return
+// true if it modified the message.
+func Mutate(fn func(msg *TemporaryMessage) bool) Stage {
+	return StageFunc(func(pkt *Packet) []*Packet {
+		if fn(pkt.Msg) {
+			pkt.Modified = true
+		}
+		return []*Packet{pkt}
+	})
+}
+
+// Record returns a stage that passes every packet through unchanged, after
+// handing a copy of it to fn.
+func Record(fn func(pkt *Packet)) Stage {
+	return StageFunc(func(pkt *Packet) []*Packet {
+		fn(pkt.Clone())
+		return []*Packet{pkt}
+	})
+}
+
+// Only returns a stage that applies s to packets travelling in direction dir
+// and passes all other packets through unchanged.
+func Only(dir Direction, s Stage) Stage {
+	return StageFunc(func(pkt *Packet) []*Packet {
+		if pkt.Dir != dir {
+			return []*Packet{pkt}
+		}
+		return s.Process(pkt)
+	})
+}
+
+// CoalesceAcks returns a stage that coalesces every n data Acks sent on a
+// connection into a single CAck. The first n-1 Acks are dropped and the nth
+// is turned into a CAck of the same sequence number. Since a CAck covers all
+// earlier messages, this is only faithful if the receiver acks in order.
+func CoalesceAcks(n int) Stage {
+	type connKey struct {
+		dir    Direction
+		client string
+		connID int
+	}
+	pending := make(map[connKey]int)
+	return StageFunc(func(pkt *Packet) []*Packet {
+		msg := pkt.Msg
+		if msg.Type != TypeMsgAck || msg.SeqNum == 0 {
+			return []*Packet{pkt}
+		}
+		key := connKey{pkt.Dir, pkt.ClientAddr(), msg.ConnID}
+		if pending[key]++; pending[key] < n {
+			return nil
+		}
+		delete(pending, key)
+		msg.Type = TypeMsgCAck
+		pkt.Modified = true
+		return []*Packet{pkt}
+	})
+}
+
+// Shorten returns a stage that truncates the payload of percent% of data
+// messages.
+func Shorten(percent int) Stage {
+	return dataStage(percent, shortenPayload)
+}
+
+// Lengthen returns a stage that pads the payload of percent% of data
+// messages.
+func Lengthen(percent int) Stage {
+	return dataStage(percent, lengthenPayload)
+}
+
+// Corrupt returns a stage that flips the bits of the first payload byte of
+// percent% of data messages.
+func Corrupt(percent int) Stage {
+	return dataStage(percent, corruptPayload)
+}
+
+func dataStage(percent int, fn func(msg *TemporaryMessage)) Stage {
+	return StageFunc(func(pkt *Packet) []*Packet {
+		if pkt.Msg.Type == TypeMsgData && sometimes(percent) {
+			fn(pkt.Msg)
+			pkt.Modified = true
+		}
+		return []*Packet{pkt}
+	})
+}
+
+// delayStage implements SetDelayMessagePercent.
+func delayStage(pkt *Packet) []*Packet {
+	if sometimes(int(atomic.LoadUint32(&delayMessagePercent))) {
+		if isLoggingEnabled() {
+			log.Printf("DELAYING written packet of length %d\n", len(pkt.raw))
+		}
+		pkt.Delay = time.Millisecond * time.Duration(500)
+	}
+	return []*Packet{pkt}
+}
+
+// dropStage implements the write drop percents and network partitions.
+func dropStage(pkt *Packet) []*Packet {
+	c := pkt.conn
+	if sometimes(writeDropPercent(c)) || isPartitioned(c.nconn.LocalAddr(), c.remoteAddr(pkt.addr)) {
+		if isLoggingEnabled() {
+			log.Printf("DROPPING written packet of length %d\n", len(pkt.raw))
+		}
+		if isSniff() {
+			record(pkt.Msg, false)
+		}
+		return nil
+	}
+	return []*Packet{pkt}
+}
+
+// readDropStage implements the read drop percents.
+func readDropStage(pkt *Packet) []*Packet {
+	if sometimes(readDropPercent(pkt.conn)) {
+		if isLoggingEnabled() {
+			log.Printf("DROPPING read packet of length %d\n", len(pkt.raw))
+		}
+		return nil
+	}
+	return []*Packet{pkt}
+}
+
+// sniffStage records sent packets while the sniffer is running.
+func sniffStage(pkt *Packet) []*Packet {
+	if isSniff() {
+		msg := *pkt.Msg
+		record(&msg, true)
+	}
+	return []*Packet{pkt}
+}
+
+// tamperStage implements the message shortening, lengthening and corruption
+// settings. At most one of them is applied to any message.
+func tamperStage(pkt *Packet) []*Packet {
+	if pkt.Msg.Type != TypeMsgData {
+		return []*Packet{pkt}
+	}
+	if sometimes(int(atomic.LoadUint32(&msgShorteningPercent))) {
+		shortenPayload(pkt.Msg)
+	} else if sometimes(int(atomic.LoadUint32(&msgLengtheningPercent))) {
+		lengthenPayload(pkt.Msg)
+	} else if atomic.LoadUint32(&corruptedMessage) == 1 {
+		corruptPayload(pkt.Msg)
+	} else {
+		return []*Packet{pkt}
+	}
+	pkt.Modified = true
+	return []*Packet{pkt}
+}
+
+func shortenPayload(msg *TemporaryMessage) {
+	var payload int
+	err := json.Unmarshal(msg.Payload, &payload)
+	if err != nil {
+		shorterPayload, _ := json.Marshal(payload / 1000)
+		msg.Payload = shorterPayload
+	} else {
+		msg.Payload = msg.Payload[:len(msg.Payload)/2]
+	}
+}
+
+func lengthenPayload(msg *TemporaryMessage) {
+	var payload int
+	err := json.Unmarshal(msg.Payload, &payload)
+	if err != nil {
+		longerPayload, _ := json.Marshal(payload * 1000)
+		msg.Payload = longerPayload
+	} else {
+		msg.Payload = append(msg.Payload, 2, 3, 4)
+	}
+}
+
+func corruptPayload(msg *TemporaryMessage) {
+	if len(msg.Payload) == 0 {
+		msg.Payload = []byte{^byte(0)}
+	} else {
+		msg.Payload[0] = ^msg.Payload[0]
+	}
 }
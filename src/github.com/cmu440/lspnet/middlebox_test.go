@@ -0,0 +1,224 @@
+package lspnet
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// receive decodes every message read from conn onto the returned channel.
+func receive(conn *UDPConn) <-chan *TemporaryMessage {
+	msgChan := make(chan *TemporaryMessage, 100)
+	go func() {
+		buf := make([]byte, 2000)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var msg TemporaryMessage
+			json.Unmarshal(buf[:n], &msg)
+			msgChan <- &msg
+		}
+	}()
+	return msgChan
+}
+
+// readMsg returns the next message on msgChan, or nil if none arrives soon.
+func readMsg(msgChan <-chan *TemporaryMessage) *TemporaryMessage {
+	select {
+	case msg := <-msgChan:
+		return msg
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func writeMsg(t *testing.T, conn *UDPConn, msg *TemporaryMessage) {
+	b, _ := json.Marshal(msg)
+	if _, err := conn.Write(b); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+}
+
+func TestChainComposesStages(t *testing.T) {
+	srv, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	srvChan := receive(srv)
+	var recorded []*Packet
+	duplicate := StageFunc(func(pkt *Packet) []*Packet {
+		return []*Packet{pkt, pkt.Clone()}
+	})
+	bumpSeqNum := Mutate(func(msg *TemporaryMessage) bool {
+		msg.SeqNum++
+		return true
+	})
+	SetChain(
+		Only(ClientToServer, duplicate),
+		Record(func(pkt *Packet) { recorded = append(recorded, pkt) }),
+		bumpSeqNum)
+	defer ClearChain()
+
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 1})
+	for i := 0; i < 2; i++ {
+		msg := readMsg(srvChan)
+		if msg == nil {
+			t.Fatalf("Server received %d copies of the message, expected 2", i)
+		}
+		if msg.SeqNum != 2 {
+			t.Fatalf("Server received SeqNum %d, expected 2", msg.SeqNum)
+		}
+	}
+	if msg := readMsg(srvChan); msg != nil {
+		t.Fatalf("Server received an unexpected third copy: %v", msg)
+	}
+	if len(recorded) != 2 || recorded[0].Dir != ClientToServer || recorded[0].ClientAddr() != recorded[0].Src {
+		t.Fatalf("Unexpected packets recorded: %v", recorded)
+	}
+}
+
+func TestChainCoalescesAcks(t *testing.T) {
+	srv, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	srvChan := receive(srv)
+	SetChain(CoalesceAcks(3))
+	defer ClearChain()
+
+	for seqNum := 1; seqNum <= 3; seqNum++ {
+		writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgAck, ConnID: 1, SeqNum: seqNum})
+	}
+	msg := readMsg(srvChan)
+	if msg == nil || msg.Type != TypeMsgCAck || msg.SeqNum != 3 {
+		t.Fatalf("Server received %v, expected a CAck for SeqNum 3", msg)
+	}
+	if msg := readMsg(srvChan); msg != nil {
+		t.Fatalf("Server received an unexpected message: %v", msg)
+	}
+}
+
+func TestChainDelayResumesLater(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	srv, cli := newSimPair(t, NewSimNetwork(clock))
+	srvChan := receive(srv)
+	SetChain(Delay(100, time.Second), Drop(0))
+	defer ClearChain()
+
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 1})
+	if msg := readMsg(srvChan); msg != nil {
+		t.Fatalf("Server received delayed message early: %v", msg)
+	}
+	clock.Advance(time.Second)
+	if msg := readMsg(srvChan); msg == nil {
+		t.Fatalf("Server didn't receive delayed message")
+	}
+}
+
+func TestReadChainInjectsForgedAcks(t *testing.T) {
+	srv, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	srvChan := receive(srv)
+	forgeAck := StageFunc(func(pkt *Packet) []*Packet {
+		if pkt.Msg.Type != TypeMsgData {
+			return []*Packet{pkt}
+		}
+		forged := pkt.WithMsg(&TemporaryMessage{Type: TypeMsgAck, ConnID: pkt.Msg.ConnID, SeqNum: 100})
+		return []*Packet{pkt, forged}
+	})
+	SetReadChain(Only(ClientToServer, forgeAck))
+	defer ClearReadChain()
+
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 1})
+	if msg := readMsg(srvChan); msg == nil || msg.Type != TypeMsgData {
+		t.Fatalf("Server received %v, expected the data message", msg)
+	}
+	if msg := readMsg(srvChan); msg == nil || msg.Type != TypeMsgAck || msg.SeqNum != 100 {
+		t.Fatalf("Server received %v, expected the forged Ack", msg)
+	}
+}
+
+func TestReadChainDrops(t *testing.T) {
+	srv, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	srvChan := receive(srv)
+	SetReadChain(Mutate(func(msg *TemporaryMessage) bool {
+		msg.SeqNum = -msg.SeqNum
+		return true
+	}), Drop(100))
+	defer ClearReadChain()
+
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 1})
+	if msg := readMsg(srvChan); msg != nil {
+		t.Fatalf("Server received %v, expected it to be dropped", msg)
+	}
+}
+
+func TestReadChainDelayWakesBlockedReader(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	srv, cli := newSimPair(t, NewSimNetwork(clock))
+	// The reader is blocked before the packet is even sent.
+	srvChan := receive(srv)
+	SetReadChain(Delay(100, time.Second))
+	defer ClearReadChain()
+
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 1})
+	if msg := readMsg(srvChan); msg != nil {
+		t.Fatalf("Server received delayed message early: %v", msg)
+	}
+	// Nothing else is sent, so only the expiry of the delay can wake it.
+	clock.Advance(time.Second)
+	if msg := readMsg(srvChan); msg == nil || msg.SeqNum != 1 {
+		t.Fatalf("Server received %v, expected the delayed message", msg)
+	}
+}
+
+func TestReadReportsTruncatedPacket(t *testing.T) {
+	srv, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	b, _ := json.Marshal(&TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 1})
+	if _, err := cli.Write(b); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	buf := make([]byte, 4)
+	n, _, err := srv.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if n != len(b) || string(buf) != string(b[:len(buf)]) {
+		t.Fatalf("Read %d bytes %q, expected %d bytes starting %q", n, buf, len(b), b[:len(buf)])
+	}
+}
+
+func TestReadQueueDropsWhenFull(t *testing.T) {
+	q := newReadQueue()
+	for i := 0; i <= readQueueSize; i++ {
+		q.push(&Packet{Msg: &TemporaryMessage{SeqNum: i}})
+	}
+	if len(q.items) != readQueueSize {
+		t.Fatalf("Queue holds %d packets, expected %d", len(q.items), readQueueSize)
+	}
+	if pkt, _ := q.pop(); pkt.Msg.SeqNum != 0 {
+		t.Fatalf("Read SeqNum %d first, expected 0", pkt.Msg.SeqNum)
+	}
+}
+
+func TestChainSkipsTampering(t *testing.T) {
+	srv, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	srvChan := receive(srv)
+	SetMsgCorrupted(true)
+	defer SetMsgCorrupted(false)
+	payload := []byte("intact")
+
+	// Tampering is left to the middlebox while one is running.
+	StartMiddlebox(&passMiddlebox{})
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 1, Payload: payload})
+	if msg := readMsg(srvChan); msg == nil || string(msg.Payload) != string(payload) {
+		t.Fatalf("Server received %v through the middlebox, expected it untouched", msg)
+	}
+	StopMiddlebox()
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 2, Payload: payload})
+	if msg := readMsg(srvChan); msg == nil || string(msg.Payload) == string(payload) {
+		t.Fatalf("Server received %v without a middlebox, expected it corrupted", msg)
+	}
+}
+
+// passMiddlebox lets every message through unchanged.
+type passMiddlebox struct{}
+
+func (passMiddlebox) Run(msg *TemporaryMessage) MiddleboxOutput {
+	return MiddleboxOutput{SendMsg: true}
+}
@@ -22,9 +22,10 @@ var (
 )
 
 // ResolveUDPAddr behaves the same as the net.UDPAddr.ResolveUDPAddr method
-// (with some additional book-keeping).
+// (with some additional book-keeping). Addresses are resolved by the current
+// Transport (see SetTransport).
 func ResolveUDPAddr(ntwk, addr string) (*UDPAddr, error) {
-	a, err := net.ResolveUDPAddr(ntwk, addr)
+	a, err := transport().ResolveUDPAddr(ntwk, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -41,16 +42,18 @@ func ListenUDP(ntwk string, laddr *UDPAddr) (*UDPConn, error) {
 	if laddr != nil {
 		nladdr = laddr.toNet()
 	}
-	nconn, err := net.ListenUDP(ntwk, nladdr)
+	t := transport()
+	nconn, err := t.ListenUDP(ntwk, nladdr)
 	if err != nil {
 		return nil, err
 	}
-	conn := UDPConn{nconn: nconn}
+	conn := newUDPConn(nconn, t.Clock(), true)
 	mapMutex.Lock()
 	// Add the server connection to the map.
-	connectionMap[conn] = true
+	connectionMap[*conn] = true
 	mapMutex.Unlock()
-	return &conn, nil
+	go conn.readLoop()
+	return conn, nil
 }
 
 // DialUDP behaves the same as the net.DialUDP method (with some additional
@@ -65,16 +68,18 @@ func DialUDP(ntwk string, laddr, raddr *UDPAddr) (*UDPConn, error) {
 	if raddr != nil {
 		nraddr = raddr.toNet()
 	}
-	nconn, err := net.DialUDP(ntwk, nladdr, nraddr)
+	t := transport()
+	nconn, err := t.DialUDP(ntwk, nladdr, nraddr)
 	if err != nil {
 		return nil, err
 	}
-	conn := UDPConn{nconn: nconn}
+	conn := newUDPConn(nconn, t.Clock(), false)
 	mapMutex.Lock()
 	// Add the client connection to the map.
-	connectionMap[conn] = false
+	connectionMap[*conn] = false
 	mapMutex.Unlock()
-	return &conn, nil
+	go conn.readLoop()
+	return conn, nil
 }
 
 // JoinHostPort behaves the same as the net.JoinHostPort function.
@@ -0,0 +1,220 @@
+// DO NOT MODIFY THIS FILE!
+// STUDENTS MUST NOT CALL ANY METHODS IN THIS FILE!
+
+package lspnet
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every endpoint in a test lives on the local host, so endpoints are identified
+// by port number alone. This lets tests name the server by ":port" and saves
+// them from caring whether it listens on "localhost", "127.0.0.1" or "[::]".
+
+var (
+	partitioned   uint32 = 0
+	partitionLock sync.Mutex
+	blockedLinks  = make(map[[2]int]int) // Counts the cuts of each (src port, dst port) link.
+	isolatedPorts = make(map[int]bool)
+	heals         = 0 // Number of calls to Heal so far.
+)
+
+// A Step is a single action in a fault schedule.
+type Step struct {
+	Epochs int    // Epochs to wait after the previous step (or the start).
+	Do     func() // Action to perform, e.g. a call to Partition or Heal.
+}
+
+// Partition cuts all traffic between groupA and groupB, in both directions.
+// Addresses are "host:port" strings; the host part may be omitted (":port").
+// Partitions accumulate until Heal is called.
+func Partition(groupA, groupB []string) {
+	cut(groupA, groupB, true)
+}
+
+// PartitionOneWay drops every packet sent from an address in from to an
+// address in to, while traffic in the opposite direction is unaffected.
+func PartitionOneWay(from, to []string) {
+	cut(from, to, false)
+}
+
+// cut blocks every link from an address in from to an address in to, and
+// the reverse links too if both is set. It returns the links it blocked and
+// the number of Heals so far, for restore.
+func cut(from, to []string, both bool) ([][2]int, int) {
+	partitionLock.Lock()
+	defer partitionLock.Unlock()
+	var links [][2]int
+	for _, src := range from {
+		for _, dst := range to {
+			sp, dp := portOf(src), portOf(dst)
+			if sp != 0 && dp != 0 {
+				links = append(links, [2]int{sp, dp})
+				if both {
+					links = append(links, [2]int{dp, sp})
+				}
+			}
+		}
+	}
+	for _, link := range links {
+		blockedLinks[link]++
+	}
+	atomic.StoreUint32(&partitioned, 1)
+	return links, heals
+}
+
+// restore unblocks the links returned by cut, leaving alone any other cuts
+// of the same links. It does nothing if Heal has been called since.
+func restore(links [][2]int, healed int) {
+	partitionLock.Lock()
+	defer partitionLock.Unlock()
+	if healed != heals {
+		return
+	}
+	for _, link := range links {
+		if blockedLinks[link]--; blockedLinks[link] <= 0 {
+			delete(blockedLinks, link)
+		}
+	}
+	if len(blockedLinks) == 0 && len(isolatedPorts) == 0 {
+		atomic.StoreUint32(&partitioned, 0)
+	}
+}
+
+// Isolate cuts addr off from every other endpoint, in both directions.
+func Isolate(addr string) {
+	partitionLock.Lock()
+	defer partitionLock.Unlock()
+	if p := portOf(addr); p != 0 {
+		isolatedPorts[p] = true
+	}
+	atomic.StoreUint32(&partitioned, 1)
+}
+
+// Heal removes all partitions and isolations. Steps of a schedule started by
+// RunSchedule that have not yet run are unaffected.
+func Heal() {
+	partitionLock.Lock()
+	defer partitionLock.Unlock()
+	atomic.StoreUint32(&partitioned, 0)
+	blockedLinks = make(map[[2]int]int)
+	isolatedPorts = make(map[int]bool)
+	heals++
+}
+
+// RunSchedule performs the given steps in order, each one Epochs epochs of
+// the given length after the step before it. Steps due at the start run
+// before RunSchedule returns, and the rest in the background. The epochs are
+// timed by the clock of the current transport, so under a VirtualClock the
+// steps run as the test advances it. For example, to partition the server
+// from all clients two epochs from now for three epochs:
+//
+//     lspnet.RunSchedule(epoch,
+//         lspnet.Step{Epochs: 2, Do: func() { lspnet.Partition(srv, cli) }},
+//         lspnet.Step{Epochs: 3, Do: lspnet.Heal})
+//
+// The returned function cancels any steps that have not yet run.
+func RunSchedule(epoch time.Duration, steps ...Step) (cancel func()) {
+	s := &schedule{
+		clock: transport().Clock(),
+		epoch: epoch,
+		steps: append([]Step(nil), steps...),
+	}
+	s.run()
+	return s.cancel
+}
+
+// A schedule waits for one step at a time, so that steps due at the same
+// time still run in order.
+type schedule struct {
+	lock      sync.Mutex
+	clock     Clock
+	epoch     time.Duration
+	steps     []Step // Steps not yet run. The first one's Epochs is the wait left.
+	timer     Timer
+	cancelled bool
+}
+
+// run performs the steps that are due, and sets a timer for the next one.
+func (s *schedule) run() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for !s.cancelled && len(s.steps) > 0 {
+		if wait := s.steps[0].Epochs; wait > 0 {
+			s.steps[0].Epochs = 0
+			s.timer = s.clock.AfterFunc(time.Duration(wait)*s.epoch, s.run)
+			return
+		}
+		step := s.steps[0]
+		s.steps = s.steps[1:]
+		step.Do()
+	}
+}
+
+func (s *schedule) cancel() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cancelled = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// PartitionDuring partitions groupA from groupB after start epochs, and
+// removes that partition again length epochs later. Other partitions, even of
+// the same links, are left in place.
+func PartitionDuring(epoch time.Duration, start, length int, groupA, groupB []string) (cancel func()) {
+	var links [][2]int
+	var healed int
+	return RunSchedule(epoch,
+		Step{Epochs: start, Do: func() { links, healed = cut(groupA, groupB, true) }},
+		Step{Epochs: length, Do: func() { restore(links, healed) }})
+}
+
+// ServerAddrs returns the local addresses of all open server connections.
+func ServerAddrs() []string {
+	return localAddrs(true)
+}
+
+// ClientAddrs returns the local addresses of all open client connections.
+func ClientAddrs() []string {
+	return localAddrs(false)
+}
+
+func localAddrs(isServer bool) []string {
+	mapMutex.Lock()
+	defer mapMutex.Unlock()
+	var addrs []string
+	for conn, server := range connectionMap {
+		if server == isServer {
+			addrs = append(addrs, conn.nconn.LocalAddr().String())
+		}
+	}
+	return addrs
+}
+
+func isPartitioned(src, dst net.Addr) bool {
+	if atomic.LoadUint32(&partitioned) == 0 || src == nil || dst == nil {
+		return false
+	}
+	sp, dp := portOf(src.String()), portOf(dst.String())
+	partitionLock.Lock()
+	defer partitionLock.Unlock()
+	return isolatedPorts[sp] || isolatedPorts[dp] || blockedLinks[[2]int{sp, dp}] > 0
+}
+
+func portOf(addr string) int {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return 0
+	}
+	return p
+}
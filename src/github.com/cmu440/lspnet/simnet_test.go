@@ -0,0 +1,186 @@
+package lspnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func newSimPair(t *testing.T, sim *SimNetwork) (srv, cli *UDPConn) {
+	SetTransport(sim)
+	t.Cleanup(func() { SetTransport(nil) })
+	laddr, err := ResolveUDPAddr("udp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to resolve listen address: %s", err)
+	}
+	srv, err = ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	raddr, err := ResolveUDPAddr("udp", srv.nconn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to resolve server address: %s", err)
+	}
+	cli, err = DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	t.Cleanup(func() {
+		cli.Close()
+		srv.Close()
+	})
+	return srv, cli
+}
+
+func TestSimNetworkEcho(t *testing.T) {
+	srv, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	if _, err := cli.Write([]byte(`{"Type":1,"Payload":"aGk="}`)); err != nil {
+		t.Fatalf("Client write failed: %s", err)
+	}
+	buf := make([]byte, 1000)
+	n, addr, err := srv.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Server read failed: %s", err)
+	}
+	if _, err := srv.WriteToUDP(buf[:n], addr); err != nil {
+		t.Fatalf("Server write failed: %s", err)
+	}
+	m, err := cli.Read(buf)
+	if err != nil {
+		t.Fatalf("Client read failed: %s", err)
+	}
+	if m != n {
+		t.Fatalf("Client read %d bytes, expected %d", m, n)
+	}
+}
+
+func TestSimNetworkPortInUse(t *testing.T) {
+	srv, _ := newSimPair(t, NewSimNetwork(RealClock()))
+	laddr, _ := ResolveUDPAddr("udp", srv.nconn.LocalAddr().String())
+	if conn, err := ListenUDP("udp", laddr); err == nil {
+		conn.Close()
+		t.Fatalf("Listened twice on %s", laddr)
+	}
+}
+
+func TestSimNetworkVirtualLatency(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	sim := NewSimNetwork(clock)
+	sim.SetLatency(time.Second)
+	srv, cli := newSimPair(t, sim)
+
+	readChan := make(chan error, 1)
+	go func() {
+		_, _, err := srv.ReadFromUDP(make([]byte, 1000))
+		readChan <- err
+	}()
+	cli.Write([]byte(`{"Type":2}`))
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-readChan:
+		t.Fatalf("Packet arrived before the latency elapsed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case err := <-readChan:
+		if err != nil {
+			t.Fatalf("Server read failed: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Packet didn't arrive after the latency elapsed")
+	}
+}
+
+func TestVirtualClockTicker(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	ticker := clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	for i := 1; i <= 3; i++ {
+		clock.Advance(time.Second)
+		select {
+		case now := <-ticker.C():
+			if now != time.Unix(int64(i), 0) {
+				t.Fatalf("Tick %d at %s, expected %s", i, now, time.Unix(int64(i), 0))
+			}
+		default:
+			t.Fatalf("Missing tick %d", i)
+		}
+	}
+}
+
+func TestVirtualClockAwaitTicks(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	ticker := clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	clock.Advance(time.Second)
+	if clock.AwaitTicks(10 * time.Millisecond) {
+		t.Fatal("AwaitTicks returned true before the tick was taken")
+	}
+	go func() { <-ticker.C() }()
+	if !clock.AwaitTicks(time.Second) {
+		t.Fatal("AwaitTicks returned false after the tick was taken")
+	}
+}
+
+func TestVirtualClockRunsTimersInOrder(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	var fired []int
+	for _, n := range []int{3, 1, 2} {
+		n := n
+		clock.AfterFunc(time.Duration(n)*time.Second, func() {
+			fired = append(fired, n)
+			if n == 1 {
+				// Due between the other two.
+				clock.AfterFunc(500*time.Millisecond, func() { fired = append(fired, 15) })
+			}
+		})
+	}
+	clock.Advance(3 * time.Second)
+	if fmt.Sprint(fired) != "[1 15 2 3]" {
+		t.Fatalf("Timers fired in the order %v, expected [1 15 2 3]", fired)
+	}
+}
+
+func TestRunScheduleFollowsTransportClock(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	SetTransport(NewSimNetwork(clock))
+	defer SetTransport(nil)
+	defer Heal()
+	cancel := PartitionDuring(time.Second, 1, 2, []string{":1"}, []string{":2"})
+	defer cancel()
+	src, dst := &net.UDPAddr{Port: 1}, &net.UDPAddr{Port: 2}
+	for i, want := range []bool{false, true, true, false} {
+		if got := isPartitioned(src, dst); got != want {
+			t.Fatalf("Partitioned is %t after %d epochs, expected %t", got, i, want)
+		}
+		clock.Advance(time.Second)
+	}
+}
+
+func TestPartitionDuringLeavesOtherPartitions(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	SetTransport(NewSimNetwork(clock))
+	defer SetTransport(nil)
+	defer Heal()
+	src, dst := &net.UDPAddr{Port: 1}, &net.UDPAddr{Port: 2}
+
+	// A partition for no time at all is removed as soon as it is made.
+	PartitionDuring(time.Second, 0, 0, []string{":1"}, []string{":2"})
+	if isPartitioned(src, dst) {
+		t.Fatal("Partitioned after a partition of length 0")
+	}
+
+	// Overlapping partitions of the same link each remove only their own.
+	outer := PartitionDuring(time.Second, 0, 3, []string{":1"}, []string{":2"})
+	defer outer()
+	inner := PartitionDuring(time.Second, 1, 1, []string{":2"}, []string{":1"})
+	defer inner()
+	for i, want := range []bool{true, true, true, false} {
+		if got := isPartitioned(src, dst); got != want {
+			t.Fatalf("Partitioned is %t after %d epochs, expected %t", got, i, want)
+		}
+		clock.Advance(time.Second)
+	}
+}
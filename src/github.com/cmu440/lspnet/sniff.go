@@ -6,6 +6,7 @@ package lspnet
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type SniffResult struct {
@@ -15,6 +16,43 @@ type SniffResult struct {
 	NumDroppedData int
 	AllMessages    []*TemporaryMessage
 	SentMessages   []*TemporaryMessage
+	Packets        []*CapturedPacket // Every written packet, and every packet the read chain dropped, delayed or changed, in capture order.
+}
+
+// CapturedPacket records the fate of a single packet. Written packets are
+// captured as they leave the write chain. Packets are captured again as they
+// leave the read chain only if it dropped, delayed or changed them, since the
+// others arrive just as they were written.
+type CapturedPacket struct {
+	Time    time.Time         // When the packet was sent or dropped.
+	Src     string            // Address of the sender.
+	Dst     string            // Address of the receiver.
+	Dir     Direction         // Which way the packet was travelling.
+	Dropped bool              // True if the packet never made it onto the network.
+	Delayed bool              // True if the packet was held back on the way.
+	Mutated bool              // True if the packet was modified on the way.
+	Msg     *TemporaryMessage // Decoded contents, after any modification.
+	Raw     []byte            // Bytes as sent (or as they would have been).
+	Read    bool              // True if captured on the receiver's read chain.
+}
+
+// ClientAddr returns the address of the client end of the packet's
+// connection. Each client socket carries exactly one LSP connection.
+func (p *CapturedPacket) ClientAddr() string {
+	if p.Dir == ClientToServer {
+		return p.Src
+	}
+	return p.Dst
+}
+
+// ByConnection splits the captured packets by connection, keyed by the
+// address of the client end. The packets of each connection stay in order.
+func (r *SniffResult) ByConnection() map[string][]*CapturedPacket {
+	conns := make(map[string][]*CapturedPacket)
+	for _, p := range r.Packets {
+		conns[p.ClientAddr()] = append(conns[p.ClientAddr()], p)
+	}
+	return conns
 }
 
 var isSniffing uint32 = 0
@@ -51,6 +89,35 @@ func record(msg *TemporaryMessage, isSent bool) {
 	}
 }
 
+// observe reports the fate of pkt at the end of the write or read chain to
+// the sniffer and to any subscribers.
+func observe(pkt *Packet, dropped bool) {
+	if !isSniff() && !hasSubscribers() {
+		return
+	}
+	msg := *pkt.Msg
+	p := &CapturedPacket{
+		Time:    pkt.conn.clock.Now(),
+		Src:     pkt.Src,
+		Dst:     pkt.Dst,
+		Dir:     pkt.Dir,
+		Dropped: dropped,
+		Delayed: pkt.delayed,
+		Mutated: pkt.Modified,
+		Msg:     &msg,
+		Raw:     pkt.bytes(),
+		Read:    pkt.read,
+	}
+	if isSniff() {
+		sniffResLock.Lock()
+		sniffRes.Packets = append(sniffRes.Packets, p)
+		sniffResLock.Unlock()
+	}
+	if hasSubscribers() {
+		publish(p)
+	}
+}
+
 func StartSniff() {
 	sniffResLock.Lock()
 	sniffRes.NumSentACKs = 0
@@ -59,6 +126,7 @@ func StartSniff() {
 	sniffRes.NumDroppedData = 0
 	sniffRes.AllMessages = []*TemporaryMessage{}
 	sniffRes.SentMessages = []*TemporaryMessage{}
+	sniffRes.Packets = []*CapturedPacket{}
 	sniffResLock.Unlock()
 	atomic.StoreUint32(&isSniffing, 1)
 }
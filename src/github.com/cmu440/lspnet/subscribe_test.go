@@ -0,0 +1,101 @@
+package lspnet
+
+import (
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, events <-chan PacketEvent) PacketEvent {
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("Subscription closed unexpectedly")
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for a packet event")
+	}
+	return PacketEvent{}
+}
+
+func TestSubscribeFilters(t *testing.T) {
+	srv, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	srvChan := receive(srv)
+	data := Subscribe(Filter{Types: []int{TypeMsgData}, Dirs: []Direction{ClientToServer}})
+	defer Unsubscribe(data)
+	conn2 := Subscribe(Filter{ConnIDs: []int{2}})
+	defer Unsubscribe(conn2)
+
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgAck, ConnID: 1, SeqNum: 1})
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 1})
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgAck, ConnID: 2, SeqNum: 1})
+	for i := 0; i < 3; i++ {
+		readMsg(srvChan)
+	}
+
+	if ev := nextEvent(t, data); ev.Msg.Type != TypeMsgData || ev.Msg.ConnID != 1 || ev.Seq != 1 {
+		t.Errorf("Data subscription received %+v, expected the data message", ev)
+	}
+	if ev := nextEvent(t, conn2); ev.Msg.ConnID != 2 || ev.Seq != 1 {
+		t.Errorf("ConnID subscription received %+v, expected the ack for ConnID 2", ev)
+	}
+	select {
+	case ev := <-data:
+		t.Errorf("Data subscription received unexpected %+v", ev)
+	case ev := <-conn2:
+		t.Errorf("ConnID subscription received unexpected %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	_, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	const buffer, sent = 4, 20
+	events := Subscribe(Filter{Buffer: buffer})
+	defer Unsubscribe(events)
+
+	// Nobody reads while the packets are written, so all but the buffered
+	// ones are lost.
+	for seqNum := 1; seqNum <= sent; seqNum++ {
+		writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: seqNum})
+	}
+	overflows := Overflows(events)
+	if overflows != sent-buffer {
+		t.Fatalf("Counted %d overflows, expected %d", overflows, sent-buffer)
+	}
+	var last PacketEvent
+	for received := uint64(0); received < sent-overflows; received++ {
+		ev := nextEvent(t, events)
+		if ev.Seq <= last.Seq || ev.Msg.SeqNum != int(ev.Seq) {
+			t.Fatalf("Received event %d (SeqNum %d) after event %d", ev.Seq, ev.Msg.SeqNum, last.Seq)
+		}
+		last = ev
+	}
+	if last.Seq != sent {
+		t.Fatalf("Last event received was %d, expected %d", last.Seq, sent)
+	}
+	if n := Unsubscribe(events); n != overflows {
+		t.Fatalf("Unsubscribe counted %d overflows, expected %d", n, overflows)
+	}
+}
+
+func TestUnsubscribeClosesChannel(t *testing.T) {
+	_, cli := newSimPair(t, NewSimNetwork(RealClock()))
+	events := Subscribe(Filter{})
+	writeMsg(t, cli, &TemporaryMessage{Type: TypeMsgData, ConnID: 1, SeqNum: 1})
+	Unsubscribe(events)
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				if hasSubscribers() {
+					t.Fatal("Subscription still registered after Unsubscribe")
+				}
+				return
+			}
+		case <-deadline:
+			t.Fatal("Channel not closed by Unsubscribe")
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// DO NOT MODIFY THIS FILE!
+// STUDENTS MUST NOT CALL ANY METHODS IN THIS FILE!
+
+package lspnet
+
+import (
+	"net"
+	"sync"
+)
+
+// Transport provides the datagram sockets underneath lspnet. By default this
+// is the operating system's UDP stack, but tests may swap in a SimNetwork so
+// that no real sockets are bound. The fault injection performed by UDPConn
+// (drops, delays, partitions, middleboxes and sniffing) sits on top of the
+// transport and works the same regardless of which one is in use.
+type Transport interface {
+	// ResolveUDPAddr behaves the same as the net.ResolveUDPAddr function.
+	ResolveUDPAddr(ntwk, addr string) (*net.UDPAddr, error)
+
+	// ListenUDP behaves the same as the net.ListenUDP function.
+	ListenUDP(ntwk string, laddr *net.UDPAddr) (PacketConn, error)
+
+	// DialUDP behaves the same as the net.DialUDP function.
+	DialUDP(ntwk string, laddr, raddr *net.UDPAddr) (PacketConn, error)
+
+	// Clock returns the clock used to time delayed packets.
+	Clock() Clock
+}
+
+// PacketConn is the subset of *net.UDPConn's methods used by UDPConn.
+type PacketConn interface {
+	Read(b []byte) (int, error)
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	Write(b []byte) (int, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+var (
+	transportLock    sync.Mutex
+	currentTransport Transport = netTransport{}
+)
+
+// SetTransport makes t the transport for all connections created from now
+// on. Connections that are already open keep using their old transport. A nil
+// t restores the operating system's UDP stack.
+func SetTransport(t Transport) {
+	if t == nil {
+		t = netTransport{}
+	}
+	transportLock.Lock()
+	currentTransport = t
+	transportLock.Unlock()
+}
+
+func transport() Transport {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	return currentTransport
+}
+
+// netTransport is the default Transport, backed by the net package.
+type netTransport struct{}
+
+func (netTransport) ResolveUDPAddr(ntwk, addr string) (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr(ntwk, addr)
+}
+
+func (netTransport) ListenUDP(ntwk string, laddr *net.UDPAddr) (PacketConn, error) {
+	nconn, err := net.ListenUDP(ntwk, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return nconn, nil
+}
+
+func (netTransport) DialUDP(ntwk string, laddr, raddr *net.UDPAddr) (PacketConn, error) {
+	nconn, err := net.DialUDP(ntwk, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return nconn, nil
+}
+
+func (netTransport) Clock() Clock {
+	return RealClock()
+}
@@ -0,0 +1,359 @@
+// Package lspreplay turns a captured LSP conversation into a regression test.
+// A Player takes the place of one end of the recorded connection, sending
+// what that end sent at the same pace, while a real lsp.Server or lsp.Client
+// takes the place of the other end. The messages the implementation sends are
+// checked against the ones in the recording.
+//
+// To replay the client side of a connection against a live server:
+//
+//	trace := lspnet.StopSniff().ByConnection()[clientAddr]
+//	srv, _ := lsp.NewServer(port, params)
+//	go echo(srv) // Whatever the server application did when recorded.
+//	player, _ := lspreplay.NewClientPlayer(hostport, trace, lspreplay.Options{})
+//	report := player.Run()
+//
+// Heartbeats (acks for sequence number 0) and retransmissions depend on the
+// timing of epochs, so they are ignored on both sides of the comparison.
+package lspreplay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+// Default values for Options.
+const (
+	DefaultTimeout = 2 * time.Second
+	DefaultSpeed   = 1.0
+)
+
+// Options controls how a trace is played.
+type Options struct {
+	// Speed scales the pace of the recording; 2 plays it twice as fast.
+	Speed float64
+
+	// Timeout is how long to wait for each message the implementation is
+	// expected to send.
+	Timeout time.Duration
+}
+
+// Mismatch describes a difference between the recording and the
+// implementation's behavior. Exactly one of Expected and Got is set.
+type Mismatch struct {
+	Expected *lsp.Message // A recorded message the implementation never sent.
+	Got      *lsp.Message // A message the implementation sent that was not recorded.
+}
+
+func (m Mismatch) String() string {
+	if m.Expected != nil {
+		return fmt.Sprintf("missing %s", m.Expected)
+	}
+	return fmt.Sprintf("unexpected %s", m.Got)
+}
+
+// Report is the outcome of a replay.
+type Report struct {
+	Matched    int // Number of recorded messages the implementation sent.
+	Mismatches []Mismatch
+}
+
+// OK returns true if the implementation sent exactly what was recorded.
+func (r *Report) OK() bool {
+	return len(r.Mismatches) == 0
+}
+
+// Player plays one side of a recorded connection.
+type Player struct {
+	conn   *lspnet.UDPConn
+	peer   *lspnet.UDPAddr // Nil for a client player, which is connected.
+	trace  []*lspnet.CapturedPacket
+	side   lspnet.Direction // Direction of the messages the player sends.
+	opts   Options
+	lock   sync.Mutex
+	live   []*received
+	arrive chan struct{} // Signalled when a message arrives.
+	connID map[int]int   // Maps recorded connection IDs to live ones.
+	acked  bool          // True once the server has acked the connect.
+}
+
+type received struct {
+	msg     *lsp.Message
+	matched bool
+}
+
+// NewClientPlayer returns a Player that plays the client side of trace
+// against the server at hostport. The server may assign a different
+// connection ID than the one recorded.
+func NewClientPlayer(hostport string, trace []*lspnet.CapturedPacket, opts Options) (*Player, error) {
+	addr, err := lspnet.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := lspnet.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newPlayer(conn, trace, lspnet.ClientToServer, opts), nil
+}
+
+// NewServerPlayer returns a Player that listens on port and plays the server
+// side of trace against the first client that connects. The client must use
+// the recorded initial sequence number.
+func NewServerPlayer(port int, trace []*lspnet.CapturedPacket, opts Options) (*Player, error) {
+	addr, err := lspnet.ResolveUDPAddr("udp", lspnet.JoinHostPort("localhost", fmt.Sprint(port)))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := lspnet.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newPlayer(conn, trace, lspnet.ServerToClient, opts), nil
+}
+
+func newPlayer(conn *lspnet.UDPConn, trace []*lspnet.CapturedPacket, side lspnet.Direction, opts Options) *Player {
+	if opts.Speed <= 0 {
+		opts.Speed = DefaultSpeed
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	p := &Player{
+		conn:   conn,
+		trace:  trace,
+		side:   side,
+		opts:   opts,
+		arrive: make(chan struct{}, 1),
+		connID: make(map[int]int),
+	}
+	go p.readLoop()
+	return p
+}
+
+// Close releases the Player's socket.
+func (p *Player) Close() error {
+	return p.conn.Close()
+}
+
+// Run plays the trace and reports how the implementation's messages differed
+// from the recording. Each recorded message from the player's side is sent
+// once all the implementation's messages recorded before it have arrived (or
+// timed out), and no sooner after the previous one than in the recording.
+func (p *Player) Run() *Report {
+	report := &Report{}
+	var last time.Time
+	var expected []*lsp.Message
+	connectAcked := false
+	for _, pkt := range p.trace {
+		// Replay what each side wrote; the implementation's own read chain
+		// is not part of the recording.
+		if pkt.Read {
+			continue
+		}
+		msg := toMessage(pkt.Msg)
+		if pkt.Dir == lspnet.ServerToClient && msg.Type == lsp.MsgAck && !connectAcked {
+			// The first ack from the server accepts the connection, even if
+			// the client's initial sequence number was zero.
+			connectAcked = true
+		} else if isHeartbeat(msg) {
+			continue
+		}
+		if pkt.Dir != p.side {
+			if containsMessage(expected, msg) {
+				continue
+			}
+			expected = append(expected, msg)
+			if p.await(msg) {
+				report.Matched++
+			} else {
+				report.Mismatches = append(report.Mismatches, Mismatch{Expected: msg})
+			}
+			continue
+		}
+		// Packets dropped on the way never reached the implementation.
+		if pkt.Dropped {
+			continue
+		}
+		if !last.IsZero() {
+			time.Sleep(time.Duration(float64(pkt.Time.Sub(last)) / p.opts.Speed))
+		}
+		last = pkt.Time
+		p.send(pkt)
+	}
+
+	// Give the implementation a moment to send anything it shouldn't.
+	time.Sleep(p.opts.Timeout / 4)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, r := range p.live {
+		if !r.matched && !containsMessage(expected, p.unmap(r.msg)) {
+			report.Mismatches = append(report.Mismatches, Mismatch{Got: r.msg})
+		}
+	}
+	return report
+}
+
+// await waits for the implementation to send msg.
+func (p *Player) await(msg *lsp.Message) bool {
+	timeout := time.After(p.opts.Timeout)
+	for {
+		if p.take(msg) {
+			return true
+		}
+		select {
+		case <-p.arrive:
+		case <-timeout:
+			return p.take(msg)
+		}
+	}
+}
+
+// take marks the first unmatched live message equal to msg as matched.
+func (p *Player) take(msg *lsp.Message) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, r := range p.live {
+		if r.matched {
+			continue
+		}
+		// A server reveals the live connection ID in its connect ack,
+		// which is the first ack it sends.
+		if p.side == lspnet.ClientToServer && len(p.connID) == 0 && msg.Type == lsp.MsgAck && r.msg.Type == lsp.MsgAck {
+			p.connID[msg.ConnID] = r.msg.ConnID
+		}
+		if sameMessage(p.unmap(r.msg), msg) {
+			r.matched = true
+			return true
+		}
+	}
+	return false
+}
+
+// send writes the recorded packet, adjusted to the live connection ID.
+func (p *Player) send(pkt *lspnet.CapturedPacket) {
+	msg := *pkt.Msg
+	b := pkt.Raw
+	p.lock.Lock()
+	if live, ok := p.connID[msg.ConnID]; ok && live != msg.ConnID {
+		if msg.Type == int(lsp.MsgData) && msg.Checksum == lsp.CalculateChecksum(msg.ConnID, msg.SeqNum, msg.Size, msg.Payload) {
+			msg.Checksum = lsp.CalculateChecksum(live, msg.SeqNum, msg.Size, msg.Payload)
+		}
+		msg.ConnID = live
+		b, _ = json.Marshal(&msg)
+	}
+	peer := p.peer
+	p.lock.Unlock()
+	if peer != nil {
+		p.conn.WriteToUDP(b, peer)
+	} else if p.side == lspnet.ClientToServer {
+		p.conn.Write(b)
+	}
+}
+
+func (p *Player) readLoop() {
+	buf := make([]byte, 2000)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var msg lsp.Message
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			continue
+		}
+		p.lock.Lock()
+		if p.side == lspnet.ServerToClient && p.peer == nil {
+			p.peer = addr
+		}
+		dup := false
+		if msg.Type == lsp.MsgAck && (p.side == lspnet.ServerToClient || p.acked) {
+			dup = isHeartbeat(&msg)
+		} else if msg.Type == lsp.MsgAck {
+			p.acked = true
+		}
+		for _, r := range p.live {
+			dup = dup || (r.matched && sameMessage(r.msg, &msg))
+		}
+		if !dup {
+			p.live = append(p.live, &received{msg: &msg})
+		}
+		p.lock.Unlock()
+		select {
+		case p.arrive <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// unmap translates a live message's connection ID back to the recorded one.
+// Must be called with p.lock held.
+func (p *Player) unmap(msg *lsp.Message) *lsp.Message {
+	for recorded, live := range p.connID {
+		if msg.ConnID == live && recorded != live {
+			m := *msg
+			m.ConnID = recorded
+			if m.Type == lsp.MsgData && m.Checksum == lsp.CalculateChecksum(live, m.SeqNum, m.Size, m.Payload) {
+				m.Checksum = lsp.CalculateChecksum(recorded, m.SeqNum, m.Size, m.Payload)
+			}
+			return &m
+		}
+	}
+	return msg
+}
+
+// ErrEmptyTrace is returned by Connection when there is nothing to replay.
+var ErrEmptyTrace = errors.New("lspreplay: empty trace")
+
+// Connection returns the packets of the connection from clientAddr among
+// pkts, which may have been read back with lspnet.ReadJSONLines. If
+// clientAddr is empty, pkts must hold exactly one connection.
+func Connection(pkts []*lspnet.CapturedPacket, clientAddr string) ([]*lspnet.CapturedPacket, error) {
+	conns := (&lspnet.SniffResult{Packets: pkts}).ByConnection()
+	if clientAddr == "" {
+		if len(conns) > 1 {
+			return nil, fmt.Errorf("lspreplay: trace holds %d connections", len(conns))
+		}
+		for addr := range conns {
+			clientAddr = addr
+		}
+	}
+	if len(conns[clientAddr]) == 0 {
+		return nil, ErrEmptyTrace
+	}
+	return conns[clientAddr], nil
+}
+
+func toMessage(m *lspnet.TemporaryMessage) *lsp.Message {
+	return &lsp.Message{
+		Type:     lsp.MsgType(m.Type),
+		ConnID:   m.ConnID,
+		SeqNum:   m.SeqNum,
+		Size:     m.Size,
+		Checksum: m.Checksum,
+		Payload:  m.Payload,
+	}
+}
+
+func isHeartbeat(m *lsp.Message) bool {
+	return m.Type == lsp.MsgAck && m.SeqNum == 0
+}
+
+func sameMessage(a, b *lsp.Message) bool {
+	return a.Type == b.Type && a.ConnID == b.ConnID && a.SeqNum == b.SeqNum &&
+		a.Size == b.Size && a.Checksum == b.Checksum && string(a.Payload) == string(b.Payload)
+}
+
+func containsMessage(msgs []*lsp.Message, m *lsp.Message) bool {
+	for _, other := range msgs {
+		if sameMessage(other, m) {
+			return true
+		}
+	}
+	return false
+}
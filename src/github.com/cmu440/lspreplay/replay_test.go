@@ -0,0 +1,158 @@
+package lspreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+const (
+	isn        = 100
+	serverPort = 9100
+)
+
+var start = time.Unix(1600000000, 0)
+
+// echoTrace is a recording of a client sending "hi" to an echo server.
+func echoTrace() []*lspnet.CapturedPacket {
+	c2s, s2c := lspnet.ClientToServer, lspnet.ServerToClient
+	hi := []byte("hi")
+	var trace []*lspnet.CapturedPacket
+	add := func(at time.Duration, dir lspnet.Direction, msg *lsp.Message) {
+		tmp := &lspnet.TemporaryMessage{
+			Type: int(msg.Type), ConnID: msg.ConnID, SeqNum: msg.SeqNum,
+			Size: msg.Size, Checksum: msg.Checksum, Payload: msg.Payload,
+		}
+		raw, _ := json.Marshal(msg)
+		trace = append(trace, &lspnet.CapturedPacket{Time: start.Add(at), Dir: dir, Msg: tmp, Raw: raw})
+	}
+	add(0, c2s, lsp.NewConnect(isn))
+	add(1*time.Millisecond, s2c, lsp.NewAck(1, isn))
+	add(2*time.Millisecond, c2s, lsp.NewData(1, isn+1, 2, hi, lsp.CalculateChecksum(1, isn+1, 2, hi)))
+	add(3*time.Millisecond, s2c, lsp.NewAck(1, isn+1))
+	add(3*time.Millisecond, s2c, lsp.NewData(1, 1, 2, hi, lsp.CalculateChecksum(1, 1, 2, hi)))
+	add(4*time.Millisecond, s2c, lsp.NewAck(1, 0)) // Heartbeat.
+	add(5*time.Millisecond, c2s, lsp.NewAck(1, 1))
+	return trace
+}
+
+func useSimNetwork(t *testing.T) {
+	lspnet.SetTransport(lspnet.NewSimNetwork(lspnet.RealClock()))
+	t.Cleanup(func() { lspnet.SetTransport(nil) })
+}
+
+func writeMsg(conn *lspnet.UDPConn, addr *lspnet.UDPAddr, msg *lsp.Message) {
+	b, _ := json.Marshal(msg)
+	if addr == nil {
+		conn.Write(b)
+	} else {
+		conn.WriteToUDP(b, addr)
+	}
+}
+
+// fakeEchoServer acks everything and echoes data back with reply applied.
+func fakeEchoServer(t *testing.T, connID int, reply func([]byte) []byte) {
+	addr, _ := lspnet.ResolveUDPAddr("udp", fmt.Sprintf(":%d", serverPort))
+	conn, err := lspnet.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2000)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var msg lsp.Message
+			json.Unmarshal(buf[:n], &msg)
+			switch msg.Type {
+			case lsp.MsgConnect:
+				writeMsg(conn, from, lsp.NewAck(connID, msg.SeqNum))
+			case lsp.MsgData:
+				writeMsg(conn, from, lsp.NewAck(connID, msg.SeqNum))
+				writeMsg(conn, from, lsp.NewAck(connID, 0))
+				payload := reply(msg.Payload)
+				writeMsg(conn, from, lsp.NewData(connID, 1, len(payload), payload,
+					lsp.CalculateChecksum(connID, 1, len(payload), payload)))
+			}
+		}
+	}()
+}
+
+func TestReplayClientMatches(t *testing.T) {
+	useSimNetwork(t)
+	// The live server hands out a different connection ID.
+	fakeEchoServer(t, 7, func(b []byte) []byte { return b })
+	player, err := NewClientPlayer(fmt.Sprintf("localhost:%d", serverPort), echoTrace(), Options{Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewClientPlayer failed: %s", err)
+	}
+	defer player.Close()
+	report := player.Run()
+	if !report.OK() || report.Matched != 3 {
+		t.Fatalf("Replay matched %d messages with mismatches %v, expected 3 and none", report.Matched, report.Mismatches)
+	}
+}
+
+func TestReplayClientMismatch(t *testing.T) {
+	useSimNetwork(t)
+	fakeEchoServer(t, 1, func(b []byte) []byte { return []byte("bye") })
+	player, err := NewClientPlayer(fmt.Sprintf("localhost:%d", serverPort), echoTrace(), Options{Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewClientPlayer failed: %s", err)
+	}
+	defer player.Close()
+	report := player.Run()
+	if len(report.Mismatches) != 2 || report.Mismatches[0].Expected == nil ||
+		string(report.Mismatches[0].Expected.Payload) != "hi" ||
+		report.Mismatches[1].Got == nil || string(report.Mismatches[1].Got.Payload) != "bye" {
+		t.Fatalf("Unexpected mismatches %v", report.Mismatches)
+	}
+}
+
+func TestReplayServerMatches(t *testing.T) {
+	useSimNetwork(t)
+	player, err := NewServerPlayer(serverPort, echoTrace(), Options{Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewServerPlayer failed: %s", err)
+	}
+	defer player.Close()
+	reports := make(chan *Report)
+	go func() { reports <- player.Run() }()
+
+	// A fake client that connects, sends "hi" and acks whatever it gets.
+	addr, _ := lspnet.ResolveUDPAddr("udp", fmt.Sprintf("localhost:%d", serverPort))
+	conn, err := lspnet.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer conn.Close()
+	writeMsg(conn, nil, lsp.NewConnect(isn))
+	buf := make([]byte, 2000)
+	for sentData := false; ; {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		var msg lsp.Message
+		json.Unmarshal(buf[:n], &msg)
+		if msg.Type == lsp.MsgAck && !sentData {
+			hi := []byte("hi")
+			writeMsg(conn, nil, lsp.NewData(msg.ConnID, isn+1, 2, hi, lsp.CalculateChecksum(msg.ConnID, isn+1, 2, hi)))
+			sentData = true
+		} else if msg.Type == lsp.MsgData {
+			writeMsg(conn, nil, lsp.NewAck(msg.ConnID, msg.SeqNum))
+			break
+		}
+	}
+	report := <-reports
+	if !report.OK() || report.Matched != 3 {
+		t.Fatalf("Replay matched %d messages with mismatches %v, expected 3 and none", report.Matched, report.Mismatches)
+	}
+}
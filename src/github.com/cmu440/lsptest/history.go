@@ -0,0 +1,396 @@
+package lsptest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+// OpKind is the method called in an Op.
+type OpKind int
+
+const (
+	OpWrite OpKind = iota
+	OpRead
+	OpCloseConn
+	OpClose
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpWrite:
+		return "Write"
+	case OpRead:
+		return "Read"
+	case OpCloseConn:
+		return "CloseConn"
+	default:
+		return "Close"
+	}
+}
+
+// Op is a single completed call on a Client or Server.
+type Op struct {
+	Kind    OpKind
+	Server  bool   // True for calls on a Server, false for calls on a Client.
+	ConnID  int    // Connection the call applied to, or 0 for Server.Close.
+	Payload []byte // Written or read, if any.
+	Err     error
+	Call    time.Time // When the method was invoked.
+	Return  time.Time // When it returned.
+}
+
+func (op *Op) String() string {
+	side := "Client"
+	if op.Server {
+		side = "Server"
+	}
+	return fmt.Sprintf("%s.%s(%d, %q) = %v", side, op.Kind, op.ConnID, op.Payload, op.Err)
+}
+
+// History records the calls made on any number of clients and servers, so
+// that Check can verify afterwards that they behaved as LSP promises.
+//
+//	h := lsptest.NewHistory()
+//	srv = h.RecordServer(srv)
+//	cli = h.RecordClient(cli)
+//	... use srv and cli as usual ...
+//	for _, a := range h.Check() {
+//	    t.Error(a)
+//	}
+//
+// Calls that have not returned are not part of the history. To tell a Close
+// that did not wait for its messages to be acked from a reader that never
+// read them, also call WatchAcks while the calls are made.
+type History struct {
+	lock sync.Mutex
+	ops  []*Op
+	acks []*ack
+}
+
+// An ack is an acknowledgement of a data message seen on the network.
+type ack struct {
+	connID   int
+	toServer bool // Direction of the data message, not of the ack.
+	payload  []byte
+	time     time.Time
+}
+
+// NewHistory returns an empty History.
+func NewHistory() *History {
+	return &History{}
+}
+
+// Ops returns the recorded calls in the order they returned.
+func (h *History) Ops() []*Op {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]*Op(nil), h.ops...)
+}
+
+func (h *History) record(op *Op) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.ops = append(h.ops, op)
+}
+
+func (h *History) acked(connID int, toServer bool, payload []byte, at time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.acks = append(h.acks, &ack{connID: connID, toServer: toServer, payload: payload, time: at})
+}
+
+// WatchAcks records the acks written to the network until the returned
+// function is called. Acks are timed by the clock of the conn that wrote
+// them, so this is only meaningful when that clock follows real time.
+func (h *History) WatchAcks() (stop func()) {
+	ch := lspnet.Subscribe(lspnet.Filter{Types: []int{lspnet.TypeMsgData, lspnet.TypeMsgAck, lspnet.TypeMsgCAck}})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		type key struct {
+			connID, seqNum int
+			toServer       bool
+		}
+		sent := make(map[key][]byte)
+		for ev := range ch {
+			if ev.Read {
+				continue
+			}
+			msg, toServer := ev.Msg, ev.Dir == lspnet.ClientToServer
+			switch {
+			case msg.Type == lspnet.TypeMsgData:
+				sent[key{msg.ConnID, msg.SeqNum, toServer}] = msg.Payload
+			case ev.Dropped:
+			case msg.Type == lspnet.TypeMsgAck:
+				k := key{msg.ConnID, msg.SeqNum, !toServer}
+				if payload, ok := sent[k]; ok {
+					delete(sent, k)
+					h.acked(k.connID, k.toServer, payload, ev.Time)
+				}
+			default:
+				for k, payload := range sent {
+					if k.connID == msg.ConnID && k.toServer != toServer && k.seqNum <= msg.SeqNum {
+						delete(sent, k)
+						h.acked(k.connID, k.toServer, payload, ev.Time)
+					}
+				}
+			}
+		}
+	}()
+	return func() {
+		lspnet.Unsubscribe(ch)
+		<-done
+	}
+}
+
+// RecordClient returns a Client that records every call made on c.
+func (h *History) RecordClient(c lsp.Client) lsp.Client {
+	return &recordedClient{c: c, h: h, connID: c.ConnID()}
+}
+
+// RecordServer returns a Server that records every call made on s.
+func (h *History) RecordServer(s lsp.Server) lsp.Server {
+	return &recordedServer{s: s, h: h}
+}
+
+type recordedClient struct {
+	c      lsp.Client
+	h      *History
+	connID int
+}
+
+func (r *recordedClient) ConnID() int {
+	return r.connID
+}
+
+func (r *recordedClient) Read() ([]byte, error) {
+	op := &Op{Kind: OpRead, ConnID: r.connID, Call: time.Now()}
+	payload, err := r.c.Read()
+	op.Payload, op.Err, op.Return = payload, err, time.Now()
+	r.h.record(op)
+	return payload, err
+}
+
+func (r *recordedClient) Write(payload []byte) error {
+	op := &Op{Kind: OpWrite, ConnID: r.connID, Payload: append([]byte(nil), payload...), Call: time.Now()}
+	err := r.c.Write(payload)
+	op.Err, op.Return = err, time.Now()
+	r.h.record(op)
+	return err
+}
+
+func (r *recordedClient) Close() error {
+	op := &Op{Kind: OpClose, ConnID: r.connID, Call: time.Now()}
+	err := r.c.Close()
+	op.Err, op.Return = err, time.Now()
+	r.h.record(op)
+	return err
+}
+
+type recordedServer struct {
+	s lsp.Server
+	h *History
+}
+
+func (r *recordedServer) Read() (int, []byte, error) {
+	op := &Op{Kind: OpRead, Server: true, Call: time.Now()}
+	connID, payload, err := r.s.Read()
+	op.ConnID, op.Payload, op.Err, op.Return = connID, payload, err, time.Now()
+	r.h.record(op)
+	return connID, payload, err
+}
+
+func (r *recordedServer) Write(connID int, payload []byte) error {
+	op := &Op{Kind: OpWrite, Server: true, ConnID: connID, Payload: append([]byte(nil), payload...), Call: time.Now()}
+	err := r.s.Write(connID, payload)
+	op.Err, op.Return = err, time.Now()
+	r.h.record(op)
+	return err
+}
+
+func (r *recordedServer) CloseConn(connID int) error {
+	op := &Op{Kind: OpCloseConn, Server: true, ConnID: connID, Call: time.Now()}
+	err := r.s.CloseConn(connID)
+	op.Err, op.Return = err, time.Now()
+	r.h.record(op)
+	return err
+}
+
+func (r *recordedServer) Close() error {
+	op := &Op{Kind: OpClose, Server: true, Call: time.Now()}
+	err := r.s.Close()
+	op.Err, op.Return = err, time.Now()
+	r.h.record(op)
+	return err
+}
+
+// AnomalyKind classifies a breach of LSP's guarantees.
+type AnomalyKind string
+
+const (
+	// Duplicate: a message was read more times than it was written.
+	Duplicate AnomalyKind = "duplicate"
+	// Reordered: a message was read before one that was written before it.
+	Reordered AnomalyKind = "reordered"
+	// Corrupted: a message was read that was never written.
+	Corrupted AnomalyKind = "corrupted"
+	// Missing: a message was written successfully but never read, although
+	// the connection was not reported lost.
+	Missing AnomalyKind = "missing"
+	// EarlyClose: a message's ack was seen only after the writer's Close
+	// returned successfully, so Close did not wait for it, whether or not
+	// the message was read.
+	EarlyClose AnomalyKind = "close before ack"
+)
+
+// Anomaly reports a breach of LSP's guarantees.
+type Anomaly struct {
+	Kind     AnomalyKind
+	ConnID   int
+	ToServer bool // Direction of the message concerned.
+	Op       *Op  // The read or write concerned.
+}
+
+func (a Anomaly) String() string {
+	dir := "server->client"
+	if a.ToServer {
+		dir = "client->server"
+	}
+	return fmt.Sprintf("%s: connection %d %s: %s", a.Kind, a.ConnID, dir, a.Op)
+}
+
+// Check verifies the history against LSP's guarantees, for each connection
+// and in each direction: every successfully written message is read exactly
+// once and in order, unless the connection was reported lost (by an error
+// from any call for that connection) or the reader was closed. A message left
+// unread whose ack was seen after the writer's Close returned is reported
+// regardless. Writes that overlapped in time may be read in either order.
+func (h *History) Check() []Anomaly {
+	ops := h.Ops()
+	h.lock.Lock()
+	acks := append([]*ack(nil), h.acks...)
+	h.lock.Unlock()
+	conns := make(map[int]bool)
+	for _, op := range ops {
+		if op.Kind != OpClose || !op.Server {
+			conns[op.ConnID] = true
+		}
+	}
+	var ids []int
+	for connID := range conns {
+		ids = append(ids, connID)
+	}
+	sort.Ints(ids)
+	var anomalies []Anomaly
+	for _, connID := range ids {
+		anomalies = append(anomalies, checkDirection(ops, acks, connID, true)...)
+		anomalies = append(anomalies, checkDirection(ops, acks, connID, false)...)
+	}
+	return anomalies
+}
+
+func checkDirection(ops []*Op, acks []*ack, connID int, toServer bool) []Anomaly {
+	var writes, reads []*Op
+	var lost, readerClosed bool
+	var writerClosed *Op
+	for _, op := range ops {
+		if op.ConnID != connID && !(op.Kind == OpClose && op.Server) {
+			continue
+		}
+		writer := op.Server != toServer
+		if op.Err != nil && op.Kind != OpClose && op.ConnID == connID {
+			lost = true
+		}
+		switch {
+		case op.Kind == OpWrite && writer && op.Err == nil:
+			writes = append(writes, op)
+		case op.Kind == OpRead && !writer && op.Err == nil:
+			reads = append(reads, op)
+		case op.Kind == OpClose && writer && op.Err == nil:
+			writerClosed = op
+		case op.Kind == OpClose && !writer:
+			readerClosed = true
+		}
+	}
+	sort.SliceStable(reads, func(i, j int) bool { return reads[i].Return.Before(reads[j].Return) })
+	sort.SliceStable(writes, func(i, j int) bool { return writes[i].Call.Before(writes[j].Call) })
+
+	var anomalies []Anomaly
+	report := func(kind AnomalyKind, op *Op) {
+		anomalies = append(anomalies, Anomaly{Kind: kind, ConnID: connID, ToServer: toServer, Op: op})
+	}
+	matched := make([]bool, len(writes))
+	for _, r := range reads {
+		i, inOrder := match(writes, matched, r)
+		switch {
+		case i >= 0:
+			matched[i] = true
+			if !inOrder {
+				report(Reordered, r)
+			}
+		case written(writes, r):
+			report(Duplicate, r)
+		default:
+			report(Corrupted, r)
+		}
+	}
+	for i, w := range writes {
+		if writerClosed != nil && w.Return.Before(writerClosed.Call) && ackedAfter(acks, connID, toServer, w, writerClosed.Return) {
+			report(EarlyClose, w)
+		} else if !matched[i] && !readerClosed && !lost {
+			report(Missing, w)
+		}
+	}
+	return anomalies
+}
+
+// match finds the unmatched write that r read. It prefers writes that no
+// other unmatched write strictly precedes; if only a write that some other
+// unmatched write precedes matches, the read was out of order.
+func match(writes []*Op, matched []bool, r *Op) (int, bool) {
+	first := -1
+	for i, w := range writes {
+		if matched[i] || !bytes.Equal(w.Payload, r.Payload) || r.Return.Before(w.Call) {
+			continue
+		}
+		if first == -1 {
+			first = i
+		}
+		inOrder := true
+		for j, other := range writes {
+			if !matched[j] && j != i && other.Return.Before(w.Call) {
+				inOrder = false
+				break
+			}
+		}
+		if inOrder {
+			return i, true
+		}
+	}
+	return first, false
+}
+
+// ackedAfter reports whether an ack for w's payload was seen after t.
+func ackedAfter(acks []*ack, connID int, toServer bool, w *Op, t time.Time) bool {
+	for _, a := range acks {
+		if a.connID == connID && a.toServer == toServer && bytes.Equal(a.payload, w.Payload) && a.time.After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func written(writes []*Op, r *Op) bool {
+	for _, w := range writes {
+		if bytes.Equal(w.Payload, r.Payload) {
+			return true
+		}
+	}
+	return false
+}
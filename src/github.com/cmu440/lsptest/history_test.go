@@ -0,0 +1,125 @@
+package lsptest
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var epoch0 = time.Unix(1600000000, 0)
+
+// at adds a call to h that ran from start to end milliseconds.
+func at(h *History, start, end int, kind OpKind, server bool, connID int, payload string, err error) {
+	op := &Op{
+		Kind:   kind,
+		Server: server,
+		ConnID: connID,
+		Err:    err,
+		Call:   epoch0.Add(time.Duration(start) * time.Millisecond),
+		Return: epoch0.Add(time.Duration(end) * time.Millisecond),
+	}
+	if payload != "" {
+		op.Payload = []byte(payload)
+	}
+	h.record(op)
+}
+
+func expectAnomalies(t *testing.T, h *History, kinds ...AnomalyKind) {
+	t.Helper()
+	anomalies := h.Check()
+	if len(anomalies) != len(kinds) {
+		t.Fatalf("Got anomalies %v, expected %v", anomalies, kinds)
+	}
+	for i, a := range anomalies {
+		if a.Kind != kinds[i] {
+			t.Fatalf("Got anomalies %v, expected %v", anomalies, kinds)
+		}
+	}
+}
+
+func TestHistoryCorrect(t *testing.T) {
+	h := NewHistory()
+	at(h, 0, 1, OpWrite, false, 1, "a", nil)
+	at(h, 2, 3, OpWrite, false, 1, "b", nil)
+	at(h, 0, 4, OpRead, true, 1, "a", nil)
+	at(h, 4, 5, OpRead, true, 1, "b", nil)
+	at(h, 5, 6, OpWrite, true, 1, "a", nil)
+	at(h, 6, 7, OpRead, false, 1, "a", nil)
+	at(h, 8, 20, OpClose, false, 1, "", nil)
+	at(h, 9, 30, OpRead, true, 1, "", errors.New("lost"))
+	expectAnomalies(t, h)
+}
+
+func TestHistoryDuplicateAndCorrupted(t *testing.T) {
+	h := NewHistory()
+	at(h, 0, 1, OpWrite, false, 1, "a", nil)
+	at(h, 1, 2, OpRead, true, 1, "a", nil)
+	at(h, 2, 3, OpRead, true, 1, "a", nil)
+	at(h, 3, 4, OpRead, true, 1, "?", nil)
+	expectAnomalies(t, h, Duplicate, Corrupted)
+}
+
+func TestHistoryReordered(t *testing.T) {
+	h := NewHistory()
+	at(h, 0, 1, OpWrite, true, 2, "a", nil)
+	at(h, 2, 3, OpWrite, true, 2, "b", nil)
+	at(h, 4, 5, OpRead, false, 2, "b", nil)
+	at(h, 5, 6, OpRead, false, 2, "a", nil)
+	expectAnomalies(t, h, Reordered)
+
+	// Overlapping writes may be read in either order.
+	h = NewHistory()
+	at(h, 0, 3, OpWrite, true, 2, "a", nil)
+	at(h, 1, 2, OpWrite, true, 2, "b", nil)
+	at(h, 4, 5, OpRead, false, 2, "b", nil)
+	at(h, 5, 6, OpRead, false, 2, "a", nil)
+	expectAnomalies(t, h)
+}
+
+func TestHistoryMissing(t *testing.T) {
+	h := NewHistory()
+	at(h, 0, 1, OpWrite, false, 1, "a", nil)
+	at(h, 0, 1, OpWrite, false, 2, "a", nil)
+	at(h, 5, 6, OpRead, false, 2, "", errors.New("lost"))
+	expectAnomalies(t, h, Missing)
+	if a := h.Check()[0]; a.ConnID != 1 || !a.ToServer {
+		t.Fatalf("Got anomaly %v, expected one for connection 1", a)
+	}
+}
+
+func TestHistoryEarlyClose(t *testing.T) {
+	h := NewHistory()
+	at(h, 0, 1, OpWrite, true, 3, "a", nil)
+	at(h, 2, 3, OpClose, true, 0, "", nil)
+	at(h, 10, 11, OpRead, false, 3, "", errors.New("lost"))
+	h.acked(3, false, []byte("a"), epoch0.Add(5*time.Millisecond))
+	expectAnomalies(t, h, EarlyClose)
+
+	// Reading the message doesn't make up for Close not waiting for its ack.
+	h = NewHistory()
+	at(h, 0, 1, OpWrite, true, 3, "a", nil)
+	at(h, 0, 4, OpRead, false, 3, "a", nil)
+	at(h, 2, 3, OpClose, true, 0, "", nil)
+	h.acked(3, false, []byte("a"), epoch0.Add(5*time.Millisecond))
+	expectAnomalies(t, h, EarlyClose)
+
+	// A message that was never acked was lost, not closed before its ack,
+	// and one acked before Close returned was simply never read.
+	for _, acked := range []bool{false, true} {
+		h = NewHistory()
+		at(h, 0, 1, OpWrite, true, 3, "a", nil)
+		at(h, 2, 3, OpClose, true, 0, "", nil)
+		at(h, 10, 11, OpRead, false, 3, "", errors.New("lost"))
+		if acked {
+			h.acked(3, false, []byte("a"), epoch0.Add(2*time.Millisecond))
+		}
+		expectAnomalies(t, h)
+	}
+
+	// It is fine for a closed reader to leave messages unread.
+	h = NewHistory()
+	at(h, 0, 1, OpWrite, true, 3, "a", nil)
+	at(h, 2, 3, OpClose, false, 3, "", nil)
+	at(h, 4, 5, OpClose, true, 0, "", nil)
+	expectAnomalies(t, h)
+}
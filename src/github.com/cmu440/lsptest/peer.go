@@ -0,0 +1,210 @@
+// Package lsptest provides helpers for testing LSP clients and servers.
+//
+// A Peer is a scripted LSP endpoint for testing against hostile or unusual
+// input. It speaks raw LSP messages over lspnet and does nothing the test
+// doesn't tell it to: it never acks, retransmits or sends heartbeats on its
+// own, so a test can send any sequence of messages, valid or not, and watch
+// how the implementation responds.
+//
+// A History records the calls made on real clients and servers and checks
+// afterwards that they kept LSP's delivery guarantees.
+package lsptest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+// ErrTimeout is returned when an expected message does not arrive in time.
+var ErrTimeout = errors.New("lsptest: timed out waiting for a message")
+
+// Peer is one end of an LSP connection, driven entirely by the test.
+type Peer struct {
+	conn   *lspnet.UDPConn
+	dialed bool
+	lock   sync.Mutex
+	remote *lspnet.UDPAddr // Where a listening peer sends to.
+	msgs   chan *lsp.Message
+}
+
+// Dial returns a Peer that plays a client of the server at hostport. No
+// messages are sent until the test sends them; see Connect.
+func Dial(hostport string) (*Peer, error) {
+	addr, err := lspnet.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := lspnet.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newPeer(conn, true), nil
+}
+
+// Listen returns a Peer that plays a server on port. Messages are sent to
+// whichever client most recently sent one to the peer.
+func Listen(port int) (*Peer, error) {
+	addr, err := lspnet.ResolveUDPAddr("udp", lspnet.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := lspnet.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newPeer(conn, false), nil
+}
+
+func newPeer(conn *lspnet.UDPConn, dialed bool) *Peer {
+	p := &Peer{
+		conn:   conn,
+		dialed: dialed,
+		msgs:   make(chan *lsp.Message, 1000),
+	}
+	go p.readLoop()
+	return p
+}
+
+func (p *Peer) readLoop() {
+	defer close(p.msgs)
+	buf := make([]byte, 2000)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var msg lsp.Message
+		if json.Unmarshal(buf[:n], &msg) != nil {
+			continue
+		}
+		if !p.dialed {
+			p.lock.Lock()
+			p.remote = addr
+			p.lock.Unlock()
+		}
+		select {
+		case p.msgs <- &msg:
+		default:
+			// The test isn't keeping up; behave like a full socket buffer.
+		}
+	}
+}
+
+// Close closes the peer's socket.
+func (p *Peer) Close() error {
+	return p.conn.Close()
+}
+
+// Send sends msg exactly as given.
+func (p *Peer) Send(msg *lsp.Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return p.SendRaw(b)
+}
+
+// SendRaw sends b as a single datagram, which need not be a valid message.
+func (p *Peer) SendRaw(b []byte) error {
+	if p.dialed {
+		_, err := p.conn.Write(b)
+		return err
+	}
+	p.lock.Lock()
+	remote := p.remote
+	p.lock.Unlock()
+	if remote == nil {
+		return errors.New("lsptest: no client has contacted the peer yet")
+	}
+	_, err := p.conn.WriteToUDP(b, remote)
+	return err
+}
+
+// Recv returns the next message sent to the peer.
+func (p *Peer) Recv(timeout time.Duration) (*lsp.Message, error) {
+	select {
+	case msg, ok := <-p.msgs:
+		if !ok {
+			return nil, errors.New("lsptest: peer closed")
+		}
+		return msg, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Expect discards messages until one satisfies match, and returns it.
+func (p *Peer) Expect(timeout time.Duration, match func(*lsp.Message) bool) (*lsp.Message, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		msg, err := p.Recv(time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		if match(msg) {
+			return msg, nil
+		}
+	}
+}
+
+// Collect returns every message sent to the peer during the next d.
+func (p *Peer) Collect(d time.Duration) []*lsp.Message {
+	var msgs []*lsp.Message
+	deadline := time.Now().Add(d)
+	for {
+		msg, err := p.Recv(time.Until(deadline))
+		if err != nil {
+			return msgs
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// Connect sends a connect message with the given initial sequence number
+// and returns the connection ID in the server's ack.
+func (p *Peer) Connect(isn int, timeout time.Duration) (int, error) {
+	if err := p.Send(lsp.NewConnect(isn)); err != nil {
+		return 0, err
+	}
+	ack, err := p.Expect(timeout, func(m *lsp.Message) bool {
+		return m.Type == lsp.MsgAck && m.SeqNum == isn
+	})
+	if err != nil {
+		return 0, fmt.Errorf("lsptest: connect with ISN %d: %s", isn, err)
+	}
+	return ack.ConnID, nil
+}
+
+// Accept waits for a connect message and acks it with connID, returning the
+// client's initial sequence number.
+func (p *Peer) Accept(connID int, timeout time.Duration) (int, error) {
+	connect, err := p.Expect(timeout, IsType(lsp.MsgConnect))
+	if err != nil {
+		return 0, err
+	}
+	return connect.SeqNum, p.Send(lsp.NewAck(connID, connect.SeqNum))
+}
+
+// Data returns a well-formed data message carrying payload.
+func Data(connID, seqNum int, payload []byte) *lsp.Message {
+	return lsp.NewData(connID, seqNum, len(payload), payload,
+		lsp.CalculateChecksum(connID, seqNum, len(payload), payload))
+}
+
+// IsType returns a matcher for Expect that accepts messages of type t.
+func IsType(t lsp.MsgType) func(*lsp.Message) bool {
+	return func(m *lsp.Message) bool { return m.Type == t }
+}
+
+// IsData returns a matcher for Expect that accepts the data message with
+// sequence number seqNum.
+func IsData(seqNum int) func(*lsp.Message) bool {
+	return func(m *lsp.Message) bool { return m.Type == lsp.MsgData && m.SeqNum == seqNum }
+}
@@ -0,0 +1,56 @@
+package lsptest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+func TestPeersTalk(t *testing.T) {
+	lspnet.SetTransport(lspnet.NewSimNetwork(lspnet.RealClock()))
+	defer lspnet.SetTransport(nil)
+	server, err := Listen(9200)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer server.Close()
+	client, err := Dial("localhost:9200")
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer client.Close()
+	if err := server.Send(lsp.NewAck(1, 0)); err == nil {
+		t.Fatal("Listening peer sent before any client contacted it")
+	}
+
+	isns := make(chan int, 1)
+	go func() {
+		isn, err := server.Accept(3, time.Second)
+		if err != nil {
+			t.Errorf("Accept failed: %s", err)
+		}
+		isns <- isn
+	}()
+	connID, err := client.Connect(7, time.Second)
+	if err != nil || connID != 3 {
+		t.Fatalf("Connect returned (%d, %v), expected (3, <nil>)", connID, err)
+	}
+	if isn := <-isns; isn != 7 {
+		t.Fatalf("Accept returned ISN %d, expected 7", isn)
+	}
+
+	client.SendRaw([]byte("not json"))
+	client.Send(Data(3, 8, []byte("hi")))
+	msg, err := server.Expect(time.Second, IsData(8))
+	if err != nil {
+		t.Fatalf("Expect failed: %s", err)
+	}
+	if msg.Checksum != lsp.CalculateChecksum(3, 8, 2, []byte("hi")) || msg.Size != 2 {
+		t.Fatalf("Received malformed data message %s", msg)
+	}
+	if msgs := server.Collect(50 * time.Millisecond); len(msgs) != 0 {
+		t.Fatalf("Received unexpected messages %v", msgs)
+	}
+}
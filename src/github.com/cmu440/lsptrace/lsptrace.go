@@ -0,0 +1,263 @@
+// Package lsptrace checks that LSP traffic captured by the lspnet sniffer
+// obeys the protocol, so that tests can assert conformance rather than only
+// end-to-end delivery:
+//
+//	lspnet.StartSniff()
+//	... run the test ...
+//	res := lspnet.StopSniff()
+//	for _, v := range lsptrace.Check(params, res.Packets) {
+//	    t.Error(v)
+//	}
+//
+// Traffic is checked from what can be seen on the network, so the checks err
+// on the side of leniency: for instance, an ack that was sent is assumed to
+// have been received unless the sniffer saw it being dropped.
+package lsptrace
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+// Rule names a protocol invariant.
+type Rule string
+
+const (
+	// WindowExceeded: a new data message was sent WindowSize or more
+	// sequence numbers past the oldest unacknowledged one.
+	WindowExceeded Rule = "window exceeded"
+	// TooManyUnacked: a new data message was sent while MaxUnackedMessages
+	// messages were already unacknowledged.
+	TooManyUnacked Rule = "too many unacked messages"
+	// BackOffTooEarly: a data message was retransmitted before its backoff
+	// interval had passed.
+	BackOffTooEarly Rule = "retransmitted too early"
+	// BackOffTooLate: a data message was retransmitted after waiting longer
+	// than its backoff interval, which is capped by MaxBackOffInterval.
+	BackOffTooLate Rule = "retransmitted too late"
+	// CAckRegressed: a cumulative ack acknowledged less than an earlier one.
+	CAckRegressed Rule = "cumulative ack went backwards"
+	// BadChecksum: a data message was sent with the wrong checksum.
+	BadChecksum Rule = "bad checksum"
+	// AckForUnreceived: an ack was sent for a sequence number that never
+	// arrived.
+	AckForUnreceived Rule = "ack for unreceived message"
+)
+
+// Violation reports a single breach of a Rule.
+type Violation struct {
+	Rule   Rule
+	Conn   string           // Address of the client end of the connection.
+	Dir    lspnet.Direction // Direction of the offending message.
+	SeqNum int              // Sequence number of the offending message.
+	Time   time.Time        // When the offending message was sent.
+	Detail string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s %s seq %d: %s", v.Rule, v.Conn, v.Dir, v.SeqNum, v.Detail)
+}
+
+// Analyzer checks captured traffic against a set of LSP parameters.
+type Analyzer struct {
+	Params *lsp.Params
+
+	// Slack is how far a retransmission may stray from its expected epoch
+	// before it is reported. If zero, half an epoch is allowed.
+	Slack time.Duration
+}
+
+// Check is shorthand for checking pkts with an Analyzer for params that
+// allows the default slack.
+func Check(params *lsp.Params, pkts []*lspnet.CapturedPacket) []Violation {
+	a := &Analyzer{Params: params}
+	return a.Check(pkts)
+}
+
+// stream is the traffic one end of a connection sends to the other, along
+// with what that end has received.
+type stream struct {
+	sent     map[int][]time.Time // Maps data SeqNums to their transmission times.
+	acked    map[int]bool        // Data SeqNums acked by the other end.
+	ackedTo  int                 // Every SeqNum up to this one has been cumulatively acked.
+	received map[int]bool        // SeqNums that arrived from the other end.
+	lastCAck int                 // SeqNum of the last cumulative ack sent.
+}
+
+func newStream() *stream {
+	return &stream{
+		sent:     make(map[int][]time.Time),
+		acked:    make(map[int]bool),
+		received: make(map[int]bool),
+		lastCAck: -1,
+	}
+}
+
+func (s *stream) isAcked(seqNum int) bool {
+	return seqNum <= s.ackedTo || s.acked[seqNum]
+}
+
+// unacked returns the oldest unacknowledged SeqNum and the number of
+// unacknowledged messages.
+func (s *stream) unacked() (oldest, count int) {
+	oldest = -1
+	for seqNum := range s.sent {
+		if !s.isAcked(seqNum) {
+			if oldest == -1 || seqNum < oldest {
+				oldest = seqNum
+			}
+			count++
+		}
+	}
+	return oldest, count
+}
+
+type streamKey struct {
+	conn string
+	dir  lspnet.Direction
+}
+
+// Check returns every violation of the protocol in pkts, which must be in
+// the order they were captured.
+func (a *Analyzer) Check(pkts []*lspnet.CapturedPacket) []Violation {
+	var violations []Violation
+	streams := make(map[streamKey]*stream)
+	get := func(conn string, dir lspnet.Direction) *stream {
+		key := streamKey{conn, dir}
+		if streams[key] == nil {
+			streams[key] = newStream()
+		}
+		return streams[key]
+	}
+	for _, p := range pkts {
+		conn := p.ClientAddr()
+		out := get(conn, p.Dir)
+		in := get(conn, 1-p.Dir)
+		report := func(rule Rule, format string, args ...interface{}) {
+			violations = append(violations, Violation{
+				Rule:   rule,
+				Conn:   conn,
+				Dir:    p.Dir,
+				SeqNum: p.Msg.SeqNum,
+				Time:   p.Time,
+				Detail: fmt.Sprintf(format, args...),
+			})
+		}
+		msg := p.Msg
+		if p.Read {
+			// The receiver's read chain dropped, delayed or changed the
+			// packet. Only what it let through counts as received; the
+			// sender is judged by what it wrote.
+			if !p.Dropped {
+				switch lsp.MsgType(msg.Type) {
+				case lsp.MsgConnect, lsp.MsgData:
+					in.received[msg.SeqNum] = true
+				case lsp.MsgAck:
+					in.acked[msg.SeqNum] = true
+				case lsp.MsgCAck:
+					if msg.SeqNum > in.ackedTo {
+						in.ackedTo = msg.SeqNum
+					}
+				}
+			}
+			continue
+		}
+		switch lsp.MsgType(msg.Type) {
+		case lsp.MsgConnect:
+			if !p.Dropped {
+				in.received[msg.SeqNum] = true
+			}
+		case lsp.MsgData:
+			if !p.Mutated {
+				if sum := lsp.CalculateChecksum(msg.ConnID, msg.SeqNum, msg.Size, msg.Payload); sum != msg.Checksum {
+					report(BadChecksum, "checksum is %d, expected %d", msg.Checksum, sum)
+				}
+			}
+			// A delayed packet is captured when the network lets it go,
+			// not when it was written, so it says nothing of the sender's
+			// timing.
+			if !p.Delayed {
+				if times := out.sent[msg.SeqNum]; len(times) > 0 {
+					a.checkBackOff(times, p.Time, report)
+				} else {
+					a.checkWindow(out, msg.SeqNum, report)
+				}
+				out.sent[msg.SeqNum] = append(out.sent[msg.SeqNum], p.Time)
+			}
+			if !p.Dropped {
+				in.received[msg.SeqNum] = true
+			}
+		case lsp.MsgAck:
+			// Heartbeats are acks for SeqNum 0.
+			if msg.SeqNum != 0 && !out.received[msg.SeqNum] {
+				report(AckForUnreceived, "SeqNum %d was never received", msg.SeqNum)
+			}
+			if !p.Dropped {
+				in.acked[msg.SeqNum] = true
+			}
+		case lsp.MsgCAck:
+			if msg.SeqNum < out.lastCAck {
+				report(CAckRegressed, "follows a cumulative ack for SeqNum %d", out.lastCAck)
+			} else {
+				out.lastCAck = msg.SeqNum
+			}
+			if msg.SeqNum != 0 && !out.received[msg.SeqNum] {
+				report(AckForUnreceived, "SeqNum %d was never received", msg.SeqNum)
+			}
+			if !p.Dropped && msg.SeqNum > in.ackedTo {
+				in.ackedTo = msg.SeqNum
+			}
+		}
+	}
+	return violations
+}
+
+func (a *Analyzer) checkWindow(s *stream, seqNum int, report func(Rule, string, ...interface{})) {
+	oldest, count := s.unacked()
+	if oldest == -1 {
+		return
+	}
+	if seqNum >= oldest+a.Params.WindowSize {
+		report(WindowExceeded, "oldest unacked is SeqNum %d and the window size is %d",
+			oldest, a.Params.WindowSize)
+	}
+	if count >= a.Params.MaxUnackedMessages {
+		report(TooManyUnacked, "%d messages were already unacked and the limit is %d",
+			count, a.Params.MaxUnackedMessages)
+	}
+}
+
+// checkBackOff checks the gap between the last transmission in times and a
+// retransmission at now. The backoff after the first transmission is zero
+// epochs, then one, doubling after each retransmission up to
+// MaxBackOffInterval; a message is retransmitted in the epoch after its
+// backoff runs out.
+func (a *Analyzer) checkBackOff(times []time.Time, now time.Time, report func(Rule, string, ...interface{})) {
+	epoch := time.Duration(a.Params.EpochMillis) * time.Millisecond
+	slack := a.Slack
+	if slack == 0 {
+		slack = epoch / 2
+	}
+	backOff := 0
+	if n := len(times) - 1; n > 0 {
+		backOff = 1 << uint(n-1)
+		if n > 30 || backOff > a.Params.MaxBackOffInterval {
+			backOff = a.Params.MaxBackOffInterval
+		}
+	}
+	expected := time.Duration(backOff+1) * epoch
+	gap := now.Sub(times[len(times)-1])
+	// The first transmission happens part way through an epoch, so the
+	// first retransmission may come arbitrarily soon after it.
+	if len(times) > 1 && gap < expected-slack {
+		report(BackOffTooEarly, "retransmission %d came %v after the last, expected %v",
+			len(times), gap, expected)
+	}
+	if gap > expected+slack {
+		report(BackOffTooLate, "retransmission %d came %v after the last, expected %v",
+			len(times), gap, expected)
+	}
+}
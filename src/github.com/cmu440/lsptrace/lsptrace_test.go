@@ -0,0 +1,194 @@
+package lsptrace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+const (
+	clientAddr = "127.0.0.1:50000"
+	serverAddr = "127.0.0.1:9999"
+	epoch      = 100 * time.Millisecond
+)
+
+var start = time.Unix(1600000000, 0)
+
+// trace builds captured packets for a single connection.
+type trace struct {
+	pkts []*lspnet.CapturedPacket
+}
+
+func (tr *trace) add(at time.Duration, dir lspnet.Direction, msg *lsp.Message) *lspnet.CapturedPacket {
+	p := &lspnet.CapturedPacket{
+		Time: start.Add(at),
+		Dir:  dir,
+		Msg: &lspnet.TemporaryMessage{
+			Type:     int(msg.Type),
+			ConnID:   msg.ConnID,
+			SeqNum:   msg.SeqNum,
+			Size:     msg.Size,
+			Checksum: msg.Checksum,
+			Payload:  msg.Payload,
+		},
+	}
+	if dir == lspnet.ClientToServer {
+		p.Src, p.Dst = clientAddr, serverAddr
+	} else {
+		p.Src, p.Dst = serverAddr, clientAddr
+	}
+	tr.pkts = append(tr.pkts, p)
+	return p
+}
+
+func (tr *trace) data(at time.Duration, dir lspnet.Direction, seqNum int) *lspnet.CapturedPacket {
+	payload := []byte("hello")
+	sum := lsp.CalculateChecksum(1, seqNum, len(payload), payload)
+	return tr.add(at, dir, lsp.NewData(1, seqNum, len(payload), payload, sum))
+}
+
+func (tr *trace) ack(at time.Duration, dir lspnet.Direction, seqNum int) *lspnet.CapturedPacket {
+	return tr.add(at, dir, lsp.NewAck(1, seqNum))
+}
+
+func (tr *trace) cack(at time.Duration, dir lspnet.Direction, seqNum int) *lspnet.CapturedPacket {
+	return tr.add(at, dir, lsp.NewCAck(1, seqNum))
+}
+
+// connected returns a trace of a client with initial SeqNum 0 connecting.
+func connected() *trace {
+	tr := &trace{}
+	tr.add(0, lspnet.ClientToServer, lsp.NewConnect(0))
+	tr.ack(0, lspnet.ServerToClient, 0)
+	return tr
+}
+
+func params(windowSize, maxUnacked, maxBackOff int) *lsp.Params {
+	return &lsp.Params{
+		EpochLimit:         5,
+		EpochMillis:        int(epoch / time.Millisecond),
+		WindowSize:         windowSize,
+		MaxBackOffInterval: maxBackOff,
+		MaxUnackedMessages: maxUnacked,
+	}
+}
+
+func expectRules(t *testing.T, violations []Violation, rules ...Rule) {
+	t.Helper()
+	if len(violations) != len(rules) {
+		t.Fatalf("Got violations %v, expected %v", violations, rules)
+	}
+	for i, v := range violations {
+		if v.Rule != rules[i] || v.Conn != clientAddr {
+			t.Fatalf("Got violations %v, expected %v", violations, rules)
+		}
+	}
+}
+
+func TestConformingTrace(t *testing.T) {
+	tr := connected()
+	c2s, s2c := lspnet.ClientToServer, lspnet.ServerToClient
+	tr.data(10*time.Millisecond, c2s, 1)
+	tr.data(20*time.Millisecond, c2s, 2)
+	tr.data(20*time.Millisecond, s2c, 1).Dropped = true
+	tr.ack(30*time.Millisecond, s2c, 1)
+	tr.data(40*time.Millisecond, c2s, 3)
+	tr.cack(50*time.Millisecond, s2c, 3)
+	// The server's message is retransmitted with backoffs of 0, 1 and 2.
+	tr.data(100*time.Millisecond, s2c, 1).Dropped = true
+	tr.data(300*time.Millisecond, s2c, 1).Dropped = true
+	tr.data(600*time.Millisecond, s2c, 1)
+	tr.cack(610*time.Millisecond, c2s, 1)
+	tr.add(620*time.Millisecond, s2c, lsp.NewAck(1, 0)) // Heartbeat.
+	expectRules(t, Check(params(3, 2, 2), tr.pkts))
+}
+
+func TestWindowAndUnacked(t *testing.T) {
+	tr := connected()
+	c2s := lspnet.ClientToServer
+	tr.data(10*time.Millisecond, c2s, 1)
+	tr.data(20*time.Millisecond, c2s, 2)
+	tr.data(30*time.Millisecond, c2s, 3)
+	expectRules(t, Check(params(2, 5, 0), tr.pkts), WindowExceeded)
+	expectRules(t, Check(params(5, 2, 0), tr.pkts), TooManyUnacked)
+
+	// Once message 1 is acked, message 3 fits in the window.
+	tr = connected()
+	tr.data(10*time.Millisecond, c2s, 1)
+	tr.data(20*time.Millisecond, c2s, 2)
+	tr.ack(25*time.Millisecond, lspnet.ServerToClient, 1)
+	tr.data(30*time.Millisecond, c2s, 3)
+	expectRules(t, Check(params(2, 2, 0), tr.pkts))
+}
+
+func TestBackOff(t *testing.T) {
+	c2s := lspnet.ClientToServer
+	tr := connected()
+	tr.data(50*time.Millisecond, c2s, 1)
+	tr.data(100*time.Millisecond, c2s, 1)
+	tr.data(200*time.Millisecond, c2s, 1) // Should have waited two epochs.
+	expectRules(t, Check(params(1, 1, 4), tr.pkts), BackOffTooEarly)
+
+	tr = connected()
+	tr.data(50*time.Millisecond, c2s, 1)
+	tr.data(100*time.Millisecond, c2s, 1)
+	tr.data(300*time.Millisecond, c2s, 1)
+	tr.data(700*time.Millisecond, c2s, 1) // Backoff is capped at two epochs.
+	expectRules(t, Check(params(1, 1, 2), tr.pkts), BackOffTooLate)
+
+	// Copies the network delayed, or that were seen on the read chain,
+	// don't count as transmissions.
+	tr = connected()
+	tr.data(50*time.Millisecond, c2s, 1)
+	tr.data(60*time.Millisecond, c2s, 1).Read = true
+	tr.data(100*time.Millisecond, c2s, 1)
+	tr.data(120*time.Millisecond, c2s, 1).Delayed = true
+	tr.data(300*time.Millisecond, c2s, 1)
+	tr.data(310*time.Millisecond, c2s, 1).Delayed = true
+	expectRules(t, Check(params(1, 1, 4), tr.pkts))
+}
+
+func TestCAckRegressed(t *testing.T) {
+	tr := connected()
+	c2s, s2c := lspnet.ClientToServer, lspnet.ServerToClient
+	tr.data(10*time.Millisecond, c2s, 1)
+	tr.data(10*time.Millisecond, c2s, 2)
+	tr.cack(20*time.Millisecond, s2c, 2)
+	tr.cack(30*time.Millisecond, s2c, 1)
+	expectRules(t, Check(params(5, 5, 0), tr.pkts), CAckRegressed)
+}
+
+func TestBadChecksum(t *testing.T) {
+	tr := connected()
+	tr.data(10*time.Millisecond, lspnet.ClientToServer, 1).Msg.Checksum++
+	// Packets mutated by the network are not the sender's fault.
+	p := tr.data(10*time.Millisecond, lspnet.ServerToClient, 1)
+	p.Msg.Checksum++
+	p.Mutated = true
+	expectRules(t, Check(params(5, 5, 0), tr.pkts), BadChecksum)
+}
+
+func TestAckForUnreceived(t *testing.T) {
+	tr := connected()
+	c2s, s2c := lspnet.ClientToServer, lspnet.ServerToClient
+	tr.data(10*time.Millisecond, c2s, 1).Dropped = true
+	tr.ack(20*time.Millisecond, s2c, 1)
+	tr.cack(20*time.Millisecond, s2c, 2)
+	expectRules(t, Check(params(5, 5, 0), tr.pkts), AckForUnreceived, AckForUnreceived)
+}
+
+func TestReadChainPackets(t *testing.T) {
+	tr := connected()
+	c2s, s2c := lspnet.ClientToServer, lspnet.ServerToClient
+	// The server's read chain injects message 1, and the server acks it.
+	injected := tr.data(10*time.Millisecond, c2s, 1)
+	injected.Read, injected.Mutated = true, true
+	tr.ack(20*time.Millisecond, s2c, 1)
+	// A retransmission seen only on the read chain is not the sender's.
+	tr.data(30*time.Millisecond, c2s, 2)
+	tr.data(31*time.Millisecond, c2s, 2).Read = true
+	tr.data(32*time.Millisecond, c2s, 2).Read = true
+	expectRules(t, Check(params(5, 5, 0), tr.pkts))
+}
@@ -0,0 +1,446 @@
+// A long-running soak test for LSP. It runs several echo servers, each with
+// many clients that keep connecting, exchanging messages and disconnecting,
+// while the network's drop, delay, corruption and partition settings change
+// from one phase to the next. Every echo is checked as it arrives, and the
+// goroutine count, memory use and throughput are reported periodically, so
+// that leaks and rare races show up over hours rather than in a single test.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cmu440/lsp"
+	"github.com/cmu440/lspnet"
+)
+
+var (
+	duration           = flag.Duration("d", time.Hour, "how long to run for")
+	numServers         = flag.Int("servers", 2, "number of servers")
+	numClients         = flag.Int("clients", 20, "number of clients per server")
+	maxMsgs            = flag.Int("msgs", 200, "maximum number of messages per connection")
+	maxSize            = flag.Int("size", 200, "maximum payload size (bytes)")
+	inFlight           = flag.Int("inflight", 10, "maximum number of unechoed messages per client")
+	phase              = flag.Duration("phase", 10*time.Second, "how long each network setting lasts")
+	maxDrop            = flag.Int("maxdrop", 20, "maximum drop percent")
+	maxDelay           = flag.Int("maxdelay", 20, "maximum percent of messages delayed")
+	maxCorrupt         = flag.Int("maxcorrupt", 5, "maximum percent of messages corrupted")
+	partitionOdds      = flag.Int("partition", 20, "percent of phases with a partition")
+	restart            = flag.Duration("restart", 5*time.Minute, "how often to restart a server (0 to never)")
+	stall              = flag.Duration("stall", 30*time.Second, "how long a connection may go without progress")
+	report             = flag.Duration("report", 30*time.Second, "how often to report")
+	seed               = flag.Int64("seed", 0, "random seed (0 to use the time)")
+	epochLimit         = flag.Int("elim", lsp.DefaultEpochLimit, "epoch limit")
+	epochMillis        = flag.Int("ems", lsp.DefaultEpochMillis, "epoch duration (ms)")
+	windowSize         = flag.Int("wsize", lsp.DefaultWindowSize, "window size")
+	maxUnackedMessages = flag.Int("maxUnackMessages", lsp.DefaultMaxUnackedMessages, "max unacknowledged messages")
+	maxBackoff         = flag.Int("maxbackoff", lsp.DefaultMaxBackOffInterval, "maximum interval epoch")
+	showLogs           = flag.Bool("v", false, "show soak logs")
+)
+
+func init() {
+	// Display time, file, and line number in log messages.
+	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
+}
+
+// stats are updated atomically by every server and client.
+type stats struct {
+	msgs       uint64 // Echoes received by clients.
+	bytes      uint64 // Payload bytes in those echoes.
+	conns      uint64 // Connections opened.
+	lost       uint64 // Client reads that returned an error.
+	connFails  uint64 // Failed attempts to connect.
+	stalls     uint64 // Connections abandoned for lack of progress.
+	restarts   uint64 // Servers restarted.
+	violations uint64 // Breaches of LSP's guarantees.
+	stuck      uint64 // Client reads that did not return after Close.
+}
+
+var st stats
+
+// violation reports a breach of LSP's guarantees.
+func violation(format string, args ...interface{}) {
+	atomic.AddUint64(&st.violations, 1)
+	fmt.Printf("VIOLATION: "+format+"\n", args...)
+}
+
+func main() {
+	flag.Parse()
+	if !*showLogs {
+		log.SetOutput(ioutil.Discard)
+	} else {
+		lspnet.EnableDebugLogs(true)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rand.Seed(*seed)
+	params := &lsp.Params{
+		EpochLimit:         *epochLimit,
+		EpochMillis:        *epochMillis,
+		WindowSize:         *windowSize,
+		MaxBackOffInterval: *maxBackoff,
+		MaxUnackedMessages: *maxUnackedMessages,
+	}
+	fmt.Printf("Soaking %d servers with %d clients each for %s (seed %d)...\n",
+		*numServers, *numClients, *duration, *seed)
+	startGoroutines := runtime.NumGoroutine()
+
+	servers := make([]*soakServer, *numServers)
+	for i := range servers {
+		servers[i] = &soakServer{params: params}
+		if err := servers[i].start(); err != nil {
+			fmt.Printf("Failed to start server: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		for i := 0; i < *numClients; i++ {
+			wg.Add(1)
+			go func(srv *soakServer) {
+				defer wg.Done()
+				runClient(srv, params, stop)
+			}(srv)
+		}
+	}
+	go runFaults(servers, stop)
+	if *restart > 0 {
+		go runRestarts(servers, stop)
+	}
+
+	end := time.After(*duration)
+	ticker := time.NewTicker(*report)
+	r := newReporter()
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			r.report()
+		case <-end:
+			running = false
+		}
+	}
+	ticker.Stop()
+
+	fmt.Println("Stopping...")
+	close(stop)
+	lspnet.ClearChain()
+	lspnet.Heal()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(*stall):
+		violation("clients failed to stop within %s", *stall)
+	}
+	for _, srv := range servers {
+		srv.close()
+	}
+	// Give background goroutines a few epochs to exit.
+	time.Sleep(time.Duration(2**epochMillis) * time.Millisecond)
+	r.report()
+	// Readers stuck in Read after Close are leaks too: they hold on to their
+	// clients for good.
+	leaked := runtime.NumGoroutine() - startGoroutines
+	fmt.Printf("Goroutines: %d at start, %d at end (%d reads stuck after Close)\n",
+		startGoroutines, runtime.NumGoroutine(), atomic.LoadUint64(&st.stuck))
+	if leaked > 0 {
+		buf := make([]byte, 1<<20)
+		fmt.Printf("%d goroutines leaked:\n%s\n", leaked, buf[:runtime.Stack(buf, true)])
+	}
+	if v := atomic.LoadUint64(&st.violations); v > 0 || leaked > 0 {
+		fmt.Printf("FAIL: %d violations, %d goroutines leaked\n", v, leaked)
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
+
+// A soakServer echoes every message it reads, checking that each connection's
+// messages arrive in order.
+type soakServer struct {
+	params *lsp.Params
+	lock   sync.Mutex
+	srv    lsp.Server
+	port   int
+}
+
+func (s *soakServer) start() error {
+	var srv lsp.Server
+	var port int
+	var err error
+	for i := 0; i < 5 && srv == nil; i++ {
+		port = 3000 + rand.Intn(50000)
+		srv, err = lsp.NewServer(port, s.params)
+	}
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.srv, s.port = srv, port
+	s.lock.Unlock()
+	go echo(srv)
+	return nil
+}
+
+func (s *soakServer) hostport() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return lspnet.JoinHostPort("localhost", strconv.Itoa(s.port))
+}
+
+func (s *soakServer) addr() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return ":" + strconv.Itoa(s.port)
+}
+
+// restart replaces the server with a new one on another port. Its clients
+// lose their connections and reconnect to the new one.
+func (s *soakServer) restart() {
+	s.lock.Lock()
+	old := s.srv
+	s.lock.Unlock()
+	if err := s.start(); err != nil {
+		fmt.Printf("Failed to restart server: %s\n", err)
+		return
+	}
+	atomic.AddUint64(&st.restarts, 1)
+	go old.Close()
+}
+
+func (s *soakServer) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.srv.Close()
+}
+
+// echo writes back every message srv reads. Each client numbers its messages
+// from 0, so the server can check they arrive in order.
+func echo(srv lsp.Server) {
+	next := make(map[int]int)
+	for {
+		connID, payload, err := srv.Read()
+		if err != nil {
+			if connID == 0 {
+				return
+			}
+			delete(next, connID)
+			continue
+		}
+		n := -1
+		if fields := bytes.Fields(payload); len(fields) > 0 {
+			n, _ = strconv.Atoi(string(fields[0]))
+		}
+		if n != next[connID] {
+			violation("server read %q from connection %d, expected message %d", payload, connID, next[connID])
+		}
+		next[connID] = n + 1
+		srv.Write(connID, payload)
+	}
+}
+
+// runClient opens one connection after another to srv until stop is closed.
+func runClient(srv *soakServer, params *lsp.Params, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		cli, err := lsp.NewClient(srv.hostport(), rand.Intn(1000), params)
+		if err != nil {
+			atomic.AddUint64(&st.connFails, 1)
+			time.Sleep(time.Duration(params.EpochMillis) * time.Millisecond)
+			continue
+		}
+		atomic.AddUint64(&st.conns, 1)
+		runSession(cli, 1+rand.Intn(*maxMsgs), stop)
+	}
+}
+
+// runSession writes n messages on cli, checks their echoes and closes it.
+func runSession(cli lsp.Client, n int, stop chan struct{}) {
+	pending := make(chan []byte, *inFlight)
+	readerDone := make(chan struct{})
+	progress := make(chan struct{}, 1)
+	go func() {
+		defer close(readerDone)
+		for i := 0; i < n; i++ {
+			payload, err := cli.Read()
+			if err != nil {
+				atomic.AddUint64(&st.lost, 1)
+				return
+			}
+			select {
+			case want := <-pending:
+				if !bytes.Equal(payload, want) {
+					violation("client %d read %q, expected %q", cli.ConnID(), payload, want)
+				}
+			default:
+				violation("client %d read %q, which it never wrote", cli.ConnID(), payload)
+			}
+			atomic.AddUint64(&st.msgs, 1)
+			atomic.AddUint64(&st.bytes, uint64(len(payload)))
+			select {
+			case progress <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	stalled := time.NewTimer(*stall)
+	defer stalled.Stop()
+	wait := func() bool {
+		select {
+		case <-progress:
+			if !stalled.Stop() {
+				<-stalled.C
+			}
+			stalled.Reset(*stall)
+			return true
+		case <-readerDone:
+		case <-stop:
+		case <-stalled.C:
+			atomic.AddUint64(&st.stalls, 1)
+			fmt.Printf("Client %d made no progress for %s\n", cli.ConnID(), *stall)
+		}
+		return false
+	}
+	for i := 0; i < n; i++ {
+		payload := newPayload(i)
+		for len(pending) == cap(pending) {
+			if !wait() {
+				closeSession(cli, readerDone)
+				return
+			}
+		}
+		pending <- payload
+		if cli.Write(payload) != nil {
+			break
+		}
+	}
+	for len(pending) > 0 && wait() {
+	}
+	closeSession(cli, readerDone)
+}
+
+// closeSession closes cli, and waits for its reader to return. A Read may
+// block for good once Close has been called, but one that is still blocked
+// when the connection would have timed out is reported, since it keeps the
+// client from being freed.
+func closeSession(cli lsp.Client, readerDone chan struct{}) {
+	cli.Close()
+	limit := time.Duration(*epochLimit**epochMillis) * time.Millisecond
+	select {
+	case <-readerDone:
+	case <-time.After(limit):
+		atomic.AddUint64(&st.stuck, 1)
+		fmt.Printf("Client %d's Read did not return within %s of Close\n", cli.ConnID(), limit)
+	}
+}
+
+func newPayload(n int) []byte {
+	payload := []byte(strconv.Itoa(n) + " ")
+	for size := rand.Intn(*maxSize); len(payload) < size; {
+		payload = append(payload, byte('a'+rand.Intn(26)))
+	}
+	return payload
+}
+
+// runFaults changes the network's settings at the start of every phase.
+func runFaults(servers []*soakServer, stop chan struct{}) {
+	ticker := time.NewTicker(*phase)
+	defer ticker.Stop()
+	cancel := func() {}
+	defer func() { cancel() }()
+	for {
+		cancel()
+		lspnet.Heal()
+		drop, delay, corrupt := rand.Intn(*maxDrop+1), rand.Intn(*maxDelay+1), rand.Intn(*maxCorrupt+1)
+		delayFor := time.Duration(rand.Intn(2**epochMillis)) * time.Millisecond
+		lspnet.SetChain(lspnet.Drop(drop), lspnet.Delay(delay, delayFor), lspnet.Corrupt(corrupt))
+		setting := fmt.Sprintf("%d%% drop, %d%% delayed by %s, %d%% corrupt", drop, delay, delayFor, corrupt)
+		if rand.Intn(100) < *partitionOdds {
+			// Cut one server off from some of the clients, for anything
+			// from a few epochs to the rest of the phase.
+			srv := servers[rand.Intn(len(servers))].addr()
+			var cut []string
+			for _, addr := range lspnet.ClientAddrs() {
+				if rand.Intn(2) == 0 {
+					cut = append(cut, addr)
+				}
+			}
+			epoch := time.Duration(*epochMillis) * time.Millisecond
+			length := rand.Intn(int(*phase/epoch) + 1)
+			cancel = lspnet.PartitionDuring(epoch, 0, length, []string{srv}, cut)
+			setting += fmt.Sprintf(", %s cut off from %d clients for %d epochs", srv, len(cut), length)
+		}
+		fmt.Printf("Network: %s\n", setting)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// runRestarts restarts a random server every so often.
+func runRestarts(servers []*soakServer, stop chan struct{}) {
+	ticker := time.NewTicker(*restart)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			servers[rand.Intn(len(servers))].restart()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// A reporter prints the change in the statistics since its last report.
+type reporter struct {
+	start, last time.Time
+	lastStats   stats
+	startHeap   uint64
+}
+
+func newReporter() *reporter {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	now := time.Now()
+	return &reporter{start: now, last: now, startHeap: mem.HeapAlloc}
+}
+
+func (r *reporter) report() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	now := time.Now()
+	secs := now.Sub(r.last).Seconds()
+	msgs, bytes := atomic.LoadUint64(&st.msgs), atomic.LoadUint64(&st.bytes)
+	fmt.Printf("[%s] %.0f msgs/s, %.0f bytes/s | %d goroutines, heap %d KB (%+d KB), sys %d KB | "+
+		"%d conns, %d lost, %d connect failures, %d stalls, %d stuck reads, %d restarts | %d violations\n",
+		now.Sub(r.start).Round(time.Second),
+		float64(msgs-r.lastStats.msgs)/secs, float64(bytes-r.lastStats.bytes)/secs,
+		runtime.NumGoroutine(), mem.HeapAlloc/1024, (int64(mem.HeapAlloc)-int64(r.startHeap))/1024, mem.Sys/1024,
+		atomic.LoadUint64(&st.conns), atomic.LoadUint64(&st.lost), atomic.LoadUint64(&st.connFails),
+		atomic.LoadUint64(&st.stalls), atomic.LoadUint64(&st.stuck), atomic.LoadUint64(&st.restarts),
+		atomic.LoadUint64(&st.violations))
+	r.last = now
+	r.lastStats.msgs, r.lastStats.bytes = msgs, bytes
+}